@@ -1,47 +1,50 @@
 package main
 
 import (
-	"fmt"
 	"os"
 
+	"github.com/30x/enrober/pkg/auth"
+	"github.com/30x/enrober/pkg/config"
+	"github.com/30x/enrober/pkg/logging"
 	"github.com/30x/enrober/pkg/server"
-
-	"k8s.io/kubernetes/pkg/client/restclient"
 )
 
 func main() {
 
-	//Default to local client
-	clientConfig := restclient.Config{
-		Host: "127.0.0.1:8080",
+	cfg, err := config.Load(os.Args[1:], os.Getenv)
+	if err != nil {
+		logging.Errorf("Error loading configuration: %v", err)
+		os.Exit(2)
+	}
+
+	//Validated by config.Load
+	level, _ := logging.ParseLevel(cfg.Logging.Level)
+	logging.SetLevel(level)
+
+	logging.Default().With(cfg.Fields()...).Infof("Configuration loaded")
+
+	kubeClient, err := server.Init(cfg)
+	if err != nil {
+		logging.Errorf("Error initializing server: %v", err)
+		return
 	}
 
-	envState := os.Getenv("DEPLOY_STATE")
-
-	switch envState {
-	case "PROD":
-		fmt.Printf("DEPLOY_STATE set to PROD\n")
-		clientConfig.Host = ""
-	case "DEV_CONTAINER":
-		fmt.Printf("DEPLOY_STATE set to DEV_CONTAINER\n")
-		clientConfig.Host = ""
-	case "DEV":
-		fmt.Printf("DEPLOY_STATE set to DEV\n")
-		clientConfig.Host = "127.0.0.1:8080"
-	default:
-		fmt.Printf("Defaulting to Local Dev Setup\n")
+	authorizer, err := auth.New(cfg.Auth, server.NewRoleBindings(kubeClient))
+	if err != nil {
+		logging.Errorf("Error initializing authorization: %v", err)
+		return
 	}
 
-	err := server.Init(clientConfig)
+	auditSink, err := server.NewAuditSink(cfg.Audit, kubeClient)
 	if err != nil {
-		fmt.Printf("Error initializing server: %v\n", err)
+		logging.Errorf("Error initializing audit: %v", err)
 		return
 	}
 
-	server := server.NewServer()
+	server := server.NewServer(kubeClient, authorizer, cfg, auditSink)
 	err = server.Start()
 	if err != nil {
-		fmt.Printf("Error starting server\n")
+		logging.Errorf("Error starting server: %v", err)
 	}
 
 	return
@@ -0,0 +1,478 @@
+//Package apigee is a small client for the parts of the Apigee Edge management API enrober uses.
+//Every call passes through the Authorization header of the request it is made on behalf of.
+package apigee
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	//DefaultBaseURL is the management API of Apigee Edge cloud
+	DefaultBaseURL = "https://api.enterprise.apigee.com/v1"
+
+	//CPSProperty is the organization property set on orgs using Core Persistence Services
+	CPSProperty = "features.isCpsEnabled"
+
+	defaultTimeout   = 30 * time.Second
+	defaultRetries   = 2
+	defaultRetryWait = 500 * time.Millisecond
+	defaultOrgTTL    = 10 * time.Minute
+)
+
+//Config holds the settings of a Client, zero values are replaced with defaults
+type Config struct {
+	//BaseURL is the management API root including the version, e.g. https://api.enterprise.apigee.com/v1
+	BaseURL string
+	//Timeout of a single attempt
+	Timeout time.Duration
+	//Retries is the number of extra attempts made on network errors, 429 and 5xx responses
+	//Set it to a negative value to disable retries
+	Retries int
+	//RetryWait is the wait before the first retry, it doubles on each following one
+	RetryWait time.Duration
+	//OrgCacheTTL is how long organization feature flags such as CPS are cached for
+	//Set it to a negative value to disable caching
+	OrgCacheTTL time.Duration
+	//Transport sends the requests, http.DefaultTransport if nil
+	Transport http.RoundTripper
+}
+
+//Client talks to the Apigee management API
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	retries    int
+	retryWait  time.Duration
+	orgs       *orgCache
+}
+
+//NewClient creates a Client from the given config
+func NewClient(config Config) *Client {
+	if config.BaseURL == "" {
+		config.BaseURL = DefaultBaseURL
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultTimeout
+	}
+	if config.Retries == 0 {
+		config.Retries = defaultRetries
+	} else if config.Retries < 0 {
+		config.Retries = 0
+	}
+	if config.RetryWait == 0 {
+		config.RetryWait = defaultRetryWait
+	}
+	if config.OrgCacheTTL == 0 {
+		config.OrgCacheTTL = defaultOrgTTL
+	}
+
+	return &Client{
+		baseURL: config.BaseURL,
+		httpClient: &http.Client{
+			Timeout:   config.Timeout,
+			Transport: config.Transport,
+		},
+		retries:   config.Retries,
+		retryWait: config.RetryWait,
+		orgs:      newOrgCache(config.OrgCacheTTL),
+	}
+}
+
+//Error is returned for every non successful response of the management API
+type Error struct {
+	Method     string `json:"-"`
+	URL        string `json:"-"`
+	StatusCode int    `json:"-"`
+	//Code and Message are taken from the Apigee error body if there is one
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%s %s: status %d", e.Method, e.URL, e.StatusCode)
+	}
+	return fmt.Sprintf("%s %s: status %d: %s", e.Method, e.URL, e.StatusCode, e.Message)
+}
+
+//IsNotFound returns true if err is an Apigee 404
+func IsNotFound(err error) bool {
+	apigeeErr, ok := err.(*Error)
+	return ok && apigeeErr.StatusCode == http.StatusNotFound
+}
+
+//IsConflict returns true if err is an Apigee 409
+func IsConflict(err error) bool {
+	apigeeErr, ok := err.(*Error)
+	return ok && apigeeErr.StatusCode == http.StatusConflict
+}
+
+//isAuthError returns true if err is an Apigee 401 or 403, which depends on the credentials of the caller
+func isAuthError(err error) bool {
+	apigeeErr, ok := err.(*Error)
+	return ok && (apigeeErr.StatusCode == http.StatusUnauthorized || apigeeErr.StatusCode == http.StatusForbidden)
+}
+
+//Property is a single name/value organization property
+type Property struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+//Organization is an Apigee organization
+type Organization struct {
+	Name       string `json:"name"`
+	Properties struct {
+		Property []Property `json:"property"`
+	} `json:"properties"`
+}
+
+//Property returns the value of an organization property
+func (org *Organization) Property(name string) (string, bool) {
+	for _, prop := range org.Properties.Property {
+		if prop.Name == name {
+			return prop.Value, true
+		}
+	}
+	return "", false
+}
+
+//CPSEnabled returns true if the organization uses Core Persistence Services
+func (org *Organization) CPSEnabled() bool {
+	value, _ := org.Property(CPSProperty)
+	return value == "true"
+}
+
+//KVMEntry is a single entry of a key value map
+type KVMEntry struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+//KVM is an environment scoped key value map
+type KVM struct {
+	Name      string     `json:"name"`
+	Encrypted bool       `json:"encrypted,omitempty"`
+	Entry     []KVMEntry `json:"entry"`
+}
+
+//GetEntry returns the entry with the given name
+func (kvm *KVM) GetEntry(name string) (*KVMEntry, bool) {
+	for i := range kvm.Entry {
+		if kvm.Entry[i].Name == name {
+			return &kvm.Entry[i], true
+		}
+	}
+	return nil, false
+}
+
+//SetEntry adds the entry or replaces the value of an existing one with the same name
+func (kvm *KVM) SetEntry(entry KVMEntry) {
+	if existing, ok := kvm.GetEntry(entry.Name); ok {
+		existing.Value = entry.Value
+		return
+	}
+	kvm.Entry = append(kvm.Entry, entry)
+}
+
+//RemoveEntry removes the entry with the given name, it returns false if there was none
+func (kvm *KVM) RemoveEntry(name string) bool {
+	for i := range kvm.Entry {
+		if kvm.Entry[i].Name == name {
+			kvm.Entry = append(kvm.Entry[:i], kvm.Entry[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+//Ping checks the management API can be reached, enrober has no credentials of its own so any response short of a 5xx will do
+//It is sent once without retries
+func (c *Client) Ping() error {
+	req, err := http.NewRequest("GET", c.baseURL+"/organizations", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return &Error{
+			Method:     req.Method,
+			URL:        req.URL.String(),
+			StatusCode: resp.StatusCode,
+		}
+	}
+	return nil
+}
+
+//GetOrganization returns an organization along with its properties
+func (c *Client) GetOrganization(authz, org string) (*Organization, error) {
+	var organization Organization
+	err := c.do("GET", authz, orgPath(org), nil, &organization)
+	if err != nil {
+		return nil, err
+	}
+	return &organization, nil
+}
+
+//IsCPSEnabled returns true if the organization uses Core Persistence Services
+//CPS orgs only accept KVM updates one entry at a time
+//The answer is cached for OrgCacheTTL, an error is returned rather than guessing if it can't be determined
+func (c *Client) IsCPSEnabled(authz, org string) (bool, error) {
+	organization, err := c.orgs.get(org, func() (*Organization, error) {
+		return c.GetOrganization(authz, org)
+	})
+	if err != nil {
+		return false, err
+	}
+	return organization.CPSEnabled(), nil
+}
+
+//InvalidateOrganization drops the cached feature flags of an organization
+func (c *Client) InvalidateOrganization(org string) {
+	c.orgs.invalidate(org)
+}
+
+//InvalidateOrganizations drops the cached feature flags of every organization
+func (c *Client) InvalidateOrganizations() {
+	c.orgs.invalidateAll()
+}
+
+//GetKVM returns an environment key value map along with its entries
+func (c *Client) GetKVM(authz, org, env, name string) (*KVM, error) {
+	var kvm KVM
+	err := c.do("GET", authz, kvmPath(org, env, name), nil, &kvm)
+	if err != nil {
+		return nil, err
+	}
+	return &kvm, nil
+}
+
+//CreateKVM creates an environment key value map, it fails with a conflict if it already exists
+func (c *Client) CreateKVM(authz, org, env string, kvm *KVM) error {
+	return c.do("POST", authz, kvmPath(org, env, ""), kvm, nil)
+}
+
+//UpdateKVM replaces all entries of an existing key value map
+//This is not supported on CPS orgs, use UpdateKVMEntry there
+func (c *Client) UpdateKVM(authz, org, env string, kvm *KVM) error {
+	return c.do("POST", authz, kvmPath(org, env, kvm.Name), kvm, nil)
+}
+
+//DeleteKVM deletes an environment key value map
+func (c *Client) DeleteKVM(authz, org, env, name string) error {
+	return c.do("DELETE", authz, kvmPath(org, env, name), nil, nil)
+}
+
+//CreateKVMEntry adds an entry to an existing key value map, CPS orgs only
+func (c *Client) CreateKVMEntry(authz, org, env, kvmName string, entry KVMEntry) error {
+	return c.do("POST", authz, kvmPath(org, env, kvmName)+"/entries", entry, nil)
+}
+
+//UpdateKVMEntry updates an existing entry of a key value map, CPS orgs only
+func (c *Client) UpdateKVMEntry(authz, org, env, kvmName string, entry KVMEntry) error {
+	return c.do("POST", authz, kvmEntryPath(org, env, kvmName, entry.Name), entry, nil)
+}
+
+//DeleteKVMEntry deletes an entry of a key value map, CPS orgs only
+func (c *Client) DeleteKVMEntry(authz, org, env, kvmName, entryName string) error {
+	return c.do("DELETE", authz, kvmEntryPath(org, env, kvmName, entryName), nil, nil)
+}
+
+//SetKVMEntry creates the key value map holding the entry, or sets the entry if the map already exists
+//It picks the CPS or non-CPS endpoints depending on the organization
+func (c *Client) SetKVMEntry(authz, org, env, kvmName string, entry KVMEntry) error {
+	err := c.CreateKVM(authz, org, env, &KVM{
+		Name:  kvmName,
+		Entry: []KVMEntry{entry},
+	})
+	if !IsConflict(err) {
+		return err
+	}
+
+	cps, err := c.IsCPSEnabled(authz, org)
+	if err != nil {
+		return err
+	}
+
+	if cps {
+		err = c.UpdateKVMEntry(authz, org, env, kvmName, entry)
+		if IsNotFound(err) {
+			return c.CreateKVMEntry(authz, org, env, kvmName, entry)
+		}
+		return err
+	}
+
+	//Without CPS the whole map is sent so the other entries have to be kept
+	kvm, err := c.GetKVM(authz, org, env, kvmName)
+	if err != nil {
+		return err
+	}
+	kvm.SetEntry(entry)
+	return c.UpdateKVM(authz, org, env, kvm)
+}
+
+//GetKVMEntry returns a single entry of a key value map
+//It fails with a not found error if either the map or the entry doesn't exist
+func (c *Client) GetKVMEntry(authz, org, env, kvmName, entryName string) (*KVMEntry, error) {
+	kvm, err := c.GetKVM(authz, org, env, kvmName)
+	if err != nil {
+		return nil, err
+	}
+	entry, ok := kvm.GetEntry(entryName)
+	if !ok {
+		return nil, &Error{
+			Method:     "GET",
+			URL:        c.baseURL + kvmEntryPath(org, env, kvmName, entryName),
+			StatusCode: http.StatusNotFound,
+			Message:    fmt.Sprintf("entry %s does not exist in %s", entryName, kvmName),
+		}
+	}
+	return entry, nil
+}
+
+//RemoveKVMEntry removes an entry from a key value map, deleting the map once it holds nothing else
+//A missing map or entry is not an error
+func (c *Client) RemoveKVMEntry(authz, org, env, kvmName, entryName string) error {
+	kvm, err := c.GetKVM(authz, org, env, kvmName)
+	if IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !kvm.RemoveEntry(entryName) {
+		return nil
+	}
+
+	if len(kvm.Entry) == 0 {
+		err = c.DeleteKVM(authz, org, env, kvmName)
+	} else {
+		var cps bool
+		cps, err = c.IsCPSEnabled(authz, org)
+		if err != nil {
+			return err
+		}
+		if cps {
+			err = c.DeleteKVMEntry(authz, org, env, kvmName, entryName)
+		} else {
+			err = c.UpdateKVM(authz, org, env, kvm)
+		}
+	}
+
+	if IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func orgPath(org string) string {
+	return "/organizations/" + url.QueryEscape(org)
+}
+
+func kvmPath(org, env, name string) string {
+	path := orgPath(org) + "/environments/" + url.QueryEscape(env) + "/keyvaluemaps"
+	if name != "" {
+		path += "/" + url.QueryEscape(name)
+	}
+	return path
+}
+
+func kvmEntryPath(org, env, kvmName, entryName string) string {
+	return kvmPath(org, env, kvmName) + "/entries/" + url.QueryEscape(entryName)
+}
+
+//retryable returns true if a request that got the given status code can safely be sent again
+//POSTs are only retried when Apigee signals the request wasn't processed
+func retryable(method string, statusCode int) bool {
+	switch statusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	}
+	return method != "POST" && statusCode >= 500
+}
+
+//do sends a request, retrying on network errors and retryable statuses, and decodes the response into out
+func (c *Client) do(method, authz, path string, in interface{}, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		body, err = json.Marshal(in)
+		if err != nil {
+			return err
+		}
+	}
+
+	wait := c.retryWait
+	var err error
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(wait)
+			wait *= 2
+		}
+
+		var retry bool
+		retry, err = c.attempt(method, authz, path, body, out)
+		if !retry {
+			return err
+		}
+	}
+	return err
+}
+
+//attempt sends a single request, the returned bool tells whether it is worth retrying
+func (c *Client) attempt(method, authz, path string, body []byte, out interface{}) (bool, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+path, reader)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", authz)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apigeeErr := &Error{
+			Method:     method,
+			URL:        req.URL.String(),
+			StatusCode: resp.StatusCode,
+		}
+		//The error body is best effort, the status is what matters
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		json.Unmarshal(respBody, apigeeErr)
+		return retryable(method, resp.StatusCode), apigeeErr
+	}
+
+	if out == nil {
+		return false, nil
+	}
+	err = json.NewDecoder(resp.Body).Decode(out)
+	if err != nil {
+		return false, fmt.Errorf("%s %s: decoding response: %v", method, req.URL.String(), err)
+	}
+	return false, nil
+}
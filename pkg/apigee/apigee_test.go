@@ -0,0 +1,192 @@
+package apigee_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/30x/enrober/pkg/apigee"
+	"github.com/30x/enrober/pkg/fakeapigee"
+)
+
+const testAuthz = "Bearer test"
+
+func newTestClient() (*fakeapigee.API, *apigee.Client, func()) {
+	api, server := fakeapigee.NewServer()
+	api.AddOrganization("cpsorg", true)
+	api.AddOrganization("classicorg", false)
+
+	client := apigee.NewClient(apigee.Config{
+		BaseURL:   server.URL + "/v1",
+		RetryWait: time.Millisecond,
+	})
+	return api, client, server.Close
+}
+
+func contains(calls []string, call string) bool {
+	for _, c := range calls {
+		if c == call {
+			return true
+		}
+	}
+	return false
+}
+
+func TestIsCPSEnabled(t *testing.T) {
+	_, client, done := newTestClient()
+	defer done()
+
+	cps, err := client.IsCPSEnabled(testAuthz, "cpsorg")
+	if err != nil || !cps {
+		t.Errorf("Expected cpsorg to have CPS, got %v, %v\n", cps, err)
+	}
+
+	cps, err = client.IsCPSEnabled(testAuthz, "classicorg")
+	if err != nil || cps {
+		t.Errorf("Expected classicorg not to have CPS, got %v, %v\n", cps, err)
+	}
+
+	//An unknown org has to be an error rather than silently not CPS
+	_, err = client.IsCPSEnabled(testAuthz, "missingorg")
+	if !apigee.IsNotFound(err) {
+		t.Errorf("Expected a not found error, got %v\n", err)
+	}
+}
+
+func TestSetKVMEntry(t *testing.T) {
+	for _, org := range []string{"cpsorg", "classicorg"} {
+		api, client, done := newTestClient()
+
+		err := client.SetKVMEntry(testAuthz, org, "test", "routing", apigee.KVMEntry{Name: "key", Value: "v1"})
+		if err != nil {
+			t.Errorf("%s: error creating KVM: %v\n", org, err)
+		}
+
+		//A second entry has to survive updates of the first one
+		err = client.SetKVMEntry(testAuthz, org, "test", "routing", apigee.KVMEntry{Name: "other", Value: "o1"})
+		if err != nil {
+			t.Errorf("%s: error adding entry: %v\n", org, err)
+		}
+
+		err = client.SetKVMEntry(testAuthz, org, "test", "routing", apigee.KVMEntry{Name: "key", Value: "v2"})
+		if err != nil {
+			t.Errorf("%s: error updating entry: %v\n", org, err)
+		}
+
+		kvm, ok := api.KVM(org, "test", "routing")
+		if !ok {
+			t.Fatalf("%s: KVM wasn't created\n", org)
+		}
+		if entry, ok := kvm.GetEntry("key"); !ok || entry.Value != "v2" {
+			t.Errorf("%s: expected key to be v2, got %v\n", org, kvm.Entry)
+		}
+		if entry, ok := kvm.GetEntry("other"); !ok || entry.Value != "o1" {
+			t.Errorf("%s: expected other to be kept, got %v\n", org, kvm.Entry)
+		}
+
+		//Only CPS orgs may use the entry endpoints
+		usedEntries := contains(api.Calls(), "POST /v1/organizations/"+org+"/environments/test/keyvaluemaps/routing/entries/key")
+		if usedEntries != (org == "cpsorg") {
+			t.Errorf("%s: unexpected endpoints used: %v\n", org, api.Calls())
+		}
+
+		done()
+	}
+}
+
+func TestGetKVMEntry(t *testing.T) {
+	_, client, done := newTestClient()
+	defer done()
+
+	_, err := client.GetKVMEntry(testAuthz, "cpsorg", "test", "routing", "key")
+	if !apigee.IsNotFound(err) {
+		t.Errorf("Expected a not found error for a missing KVM, got %v\n", err)
+	}
+
+	client.SetKVMEntry(testAuthz, "cpsorg", "test", "routing", apigee.KVMEntry{Name: "key", Value: "v1"})
+
+	entry, err := client.GetKVMEntry(testAuthz, "cpsorg", "test", "routing", "key")
+	if err != nil || entry.Value != "v1" {
+		t.Errorf("Expected v1, got %v, %v\n", entry, err)
+	}
+
+	_, err = client.GetKVMEntry(testAuthz, "cpsorg", "test", "routing", "missing")
+	if !apigee.IsNotFound(err) {
+		t.Errorf("Expected a not found error for a missing entry, got %v\n", err)
+	}
+}
+
+func TestRemoveKVMEntry(t *testing.T) {
+	for _, org := range []string{"cpsorg", "classicorg"} {
+		api, client, done := newTestClient()
+
+		//Removing from a missing KVM is a no-op
+		if err := client.RemoveKVMEntry(testAuthz, org, "test", "routing", "key"); err != nil {
+			t.Errorf("%s: error removing from a missing KVM: %v\n", org, err)
+		}
+
+		client.SetKVMEntry(testAuthz, org, "test", "routing", apigee.KVMEntry{Name: "key", Value: "v1"})
+		client.SetKVMEntry(testAuthz, org, "test", "routing", apigee.KVMEntry{Name: "other", Value: "o1"})
+
+		if err := client.RemoveKVMEntry(testAuthz, org, "test", "routing", "key"); err != nil {
+			t.Errorf("%s: error removing entry: %v\n", org, err)
+		}
+		kvm, ok := api.KVM(org, "test", "routing")
+		if !ok || len(kvm.Entry) != 1 || kvm.Entry[0].Name != "other" {
+			t.Errorf("%s: expected only other to be left, got %v\n", org, kvm.Entry)
+		}
+
+		//The KVM goes away with its last entry
+		if err := client.RemoveKVMEntry(testAuthz, org, "test", "routing", "other"); err != nil {
+			t.Errorf("%s: error removing last entry: %v\n", org, err)
+		}
+		if _, ok := api.KVM(org, "test", "routing"); ok {
+			t.Errorf("%s: expected the KVM to be deleted\n", org)
+		}
+
+		done()
+	}
+}
+
+func TestRetries(t *testing.T) {
+	api, client, done := newTestClient()
+	defer done()
+
+	//GETs are retried on server errors
+	api.FailNext(http.StatusServiceUnavailable, http.StatusInternalServerError)
+	if _, err := client.GetOrganization(testAuthz, "cpsorg"); err != nil {
+		t.Errorf("Expected GET to succeed after retrying, got %v\n", err)
+	}
+
+	//POSTs aren't retried on a 500 since the request may have been processed
+	api.FailNext(http.StatusInternalServerError)
+	err := client.CreateKVM(testAuthz, "cpsorg", "test", &apigee.KVM{Name: "routing"})
+	if apigeeErr, ok := err.(*apigee.Error); !ok || apigeeErr.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Expected a 500 error, got %v\n", err)
+	}
+
+	//Retries give up eventually
+	api.FailNext(http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	if _, err := client.GetOrganization(testAuthz, "cpsorg"); err == nil {
+		t.Errorf("Expected GET to fail once retries are exhausted\n")
+	}
+}
+
+func TestPing(t *testing.T) {
+	api, client, done := newTestClient()
+
+	//Without credentials the fake answers 401, which still means it can be reached
+	if err := client.Ping(); err != nil {
+		t.Errorf("Expected ping to succeed, got %v\n", err)
+	}
+
+	api.FailNext(http.StatusServiceUnavailable)
+	if err := client.Ping(); err == nil {
+		t.Errorf("Expected ping to fail on a 503\n")
+	}
+
+	done()
+	if err := client.Ping(); err == nil {
+		t.Errorf("Expected ping to fail once the server is gone\n")
+	}
+}
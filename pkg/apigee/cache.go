@@ -0,0 +1,126 @@
+package apigee
+
+import (
+	"sync"
+	"time"
+)
+
+//orgCache keeps organizations, and so their feature flags, for a limited time
+//Concurrent misses for the same organization share a single request
+type orgCache struct {
+	lock sync.Mutex
+	ttl  time.Duration
+
+	entries  map[string]*orgCacheEntry
+	inflight map[string]*orgFetch
+	//generation is bumped by every invalidation, requests started before one aren't cached
+	generation uint64
+}
+
+type orgCacheEntry struct {
+	org     *Organization
+	fetched time.Time
+}
+
+//orgFetch is a request for an organization that other callers can wait on
+type orgFetch struct {
+	done chan struct{}
+	org  *Organization
+	err  error
+}
+
+func newOrgCache(ttl time.Duration) *orgCache {
+	return &orgCache{
+		ttl:      ttl,
+		entries:  make(map[string]*orgCacheEntry),
+		inflight: make(map[string]*orgFetch),
+	}
+}
+
+//get returns the cached organization or calls fetch if it is missing or expired
+//If fetch fails with anything but a not found or auth error an expired entry is returned instead,
+//so a transient failure doesn't change what is known about the organization
+//Callers sharing a request made with credentials that were refused make their own
+func (c *orgCache) get(name string, fetch func() (*Organization, error)) (*Organization, error) {
+	c.lock.Lock()
+	entry, cached := c.entries[name]
+	if cached && time.Since(entry.fetched) < c.ttl {
+		c.lock.Unlock()
+		return entry.org, nil
+	}
+	if pending, ok := c.inflight[name]; ok {
+		c.lock.Unlock()
+		<-pending.done
+		if !isAuthError(pending.err) {
+			return pending.org, pending.err
+		}
+		return c.fetch(name, nil, fetch)
+	}
+	pending := &orgFetch{
+		done: make(chan struct{}),
+	}
+	c.inflight[name] = pending
+	c.lock.Unlock()
+
+	org, err := c.fetch(name, pending, fetch)
+
+	pending.org, pending.err = org, err
+	close(pending.done)
+	return org, err
+}
+
+//fetch calls fetch and keeps its result, pending is the shared request it is made for if any
+//Results are only kept if the cache wasn't invalidated in the meantime, they are still returned
+func (c *orgCache) fetch(name string, pending *orgFetch, fetch func() (*Organization, error)) (*Organization, error) {
+	c.lock.Lock()
+	generation := c.generation
+	c.lock.Unlock()
+
+	org, err := fetch()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if pending != nil && c.inflight[name] == pending {
+		delete(c.inflight, name)
+	}
+	if c.generation != generation {
+		return org, err
+	}
+
+	entry, cached := c.entries[name]
+	switch {
+	case err == nil:
+		c.entries[name] = &orgCacheEntry{
+			org:     org,
+			fetched: time.Now(),
+		}
+	case IsNotFound(err):
+		delete(c.entries, name)
+	case isAuthError(err):
+		//Says nothing about the organization, only about the credentials of the caller
+	case cached:
+		org, err = entry.org, nil
+	}
+	return org, err
+}
+
+//invalidate drops a single organization, callers no longer wait on a request for it that is in flight
+func (c *orgCache) invalidate(name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.generation++
+	delete(c.entries, name)
+	delete(c.inflight, name)
+}
+
+//invalidateAll drops every organization
+func (c *orgCache) invalidateAll() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.generation++
+	c.entries = make(map[string]*orgCacheEntry)
+	c.inflight = make(map[string]*orgFetch)
+}
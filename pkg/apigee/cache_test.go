@@ -0,0 +1,160 @@
+package apigee_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/30x/enrober/pkg/apigee"
+	"github.com/30x/enrober/pkg/fakeapigee"
+)
+
+func countCalls(calls []string, call string) int {
+	count := 0
+	for _, c := range calls {
+		if c == call {
+			count++
+		}
+	}
+	return count
+}
+
+func TestOrgCache(t *testing.T) {
+	api, client, done := newTestClient()
+	defer done()
+
+	//A burst of lookups only reaches Apigee once
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if cps, err := client.IsCPSEnabled(testAuthz, "cpsorg"); err != nil || !cps {
+				t.Errorf("Expected cpsorg to have CPS, got %v, %v\n", cps, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if count := countCalls(api.Calls(), "GET /v1/organizations/cpsorg"); count != 1 {
+		t.Errorf("Expected a single organization lookup, got %d\n", count)
+	}
+
+	client.InvalidateOrganization("cpsorg")
+	client.IsCPSEnabled(testAuthz, "cpsorg")
+
+	if count := countCalls(api.Calls(), "GET /v1/organizations/cpsorg"); count != 2 {
+		t.Errorf("Expected invalidation to cause a second lookup, got %d\n", count)
+	}
+}
+
+func TestOrgCacheTransientFailure(t *testing.T) {
+	api, server := fakeapigee.NewServer()
+	defer server.Close()
+	api.AddOrganization("cpsorg", true)
+
+	client := apigee.NewClient(apigee.Config{
+		BaseURL:     server.URL + "/v1",
+		RetryWait:   time.Millisecond,
+		OrgCacheTTL: time.Millisecond,
+	})
+
+	//Nothing is known yet so the failure has to surface instead of falling back to non CPS
+	api.FailNext(http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	if _, err := client.IsCPSEnabled(testAuthz, "cpsorg"); err == nil {
+		t.Errorf("Expected an error when the organization can't be looked up\n")
+	}
+
+	if cps, err := client.IsCPSEnabled(testAuthz, "cpsorg"); err != nil || !cps {
+		t.Errorf("Expected cpsorg to have CPS, got %v, %v\n", cps, err)
+	}
+
+	//Once expired, a failed refresh keeps the last known flags
+	time.Sleep(5 * time.Millisecond)
+	api.FailNext(http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	if cps, err := client.IsCPSEnabled(testAuthz, "cpsorg"); err != nil || !cps {
+		t.Errorf("Expected the expired flags to be kept, got %v, %v\n", cps, err)
+	}
+}
+
+//newGatedClient returns a client whose first request to the fake Apigee is answered only once release is closed
+//entered is closed when that request has been handled
+func newGatedClient() (api *fakeapigee.API, client *apigee.Client, entered chan struct{}, release chan struct{}, done func()) {
+	api = fakeapigee.NewAPI()
+	api.AddOrganization("cpsorg", true)
+	entered = make(chan struct{})
+	release = make(chan struct{})
+
+	var once sync.Once
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := httptest.NewRecorder()
+		api.ServeHTTP(recorder, r)
+		once.Do(func() {
+			close(entered)
+			<-release
+		})
+		for name, values := range recorder.Header() {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(recorder.Code)
+		w.Write(recorder.Body.Bytes())
+	}))
+
+	client = apigee.NewClient(apigee.Config{
+		BaseURL:   server.URL + "/v1",
+		RetryWait: time.Millisecond,
+	})
+	return api, client, entered, release, server.Close
+}
+
+func TestOrgCacheAuthErrorsNotShared(t *testing.T) {
+	_, client, entered, release, done := newGatedClient()
+	defer done()
+
+	//The first caller has no credentials, the one waiting on its request does
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, err := client.IsCPSEnabled("", "cpsorg"); err == nil {
+			t.Errorf("Expected an error without credentials\n")
+		}
+	}()
+	<-entered
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if cps, err := client.IsCPSEnabled(testAuthz, "cpsorg"); err != nil || !cps {
+			t.Errorf("Expected cpsorg to have CPS, got %v, %v\n", cps, err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+}
+
+func TestOrgCacheInvalidatedWhileFetching(t *testing.T) {
+	api, client, entered, release, done := newGatedClient()
+	defer done()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		client.IsCPSEnabled(testAuthz, "cpsorg")
+	}()
+	<-entered
+
+	//The organization is migrated and invalidated while the old flags are on their way
+	api.AddOrganization("cpsorg", false)
+	client.InvalidateOrganization("cpsorg")
+	close(release)
+	wg.Wait()
+
+	if cps, err := client.IsCPSEnabled(testAuthz, "cpsorg"); err != nil || cps {
+		t.Errorf("Expected the flags fetched before the invalidation to be dropped, got %v, %v\n", cps, err)
+	}
+}
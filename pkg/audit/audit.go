@@ -0,0 +1,160 @@
+//Package audit records who changed what through the enrober API.
+//A Record is written to a Sink for every mutating request, whether it succeeded or not.
+package audit
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+//Results of an audited request
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+//Record is one audited request
+type Record struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestId"`
+	//Actor is the authenticated caller, anonymous if they couldn't be identified
+	Actor string `json:"actor"`
+	//Action names the API operation, e.g. updateDeployment
+	Action string `json:"action"`
+	Target Target `json:"target"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Query  string `json:"query,omitempty"`
+	//Diff is the change that was requested, i.e. the request body with secrets redacted
+	Diff json.RawMessage `json:"diff,omitempty"`
+	//DiffTruncated is set when the body was over MaxDiffSize, the diff is left out then
+	DiffTruncated bool    `json:"diffTruncated,omitempty"`
+	Outcome       Outcome `json:"outcome"`
+}
+
+//Target is what a request acted on, Environment and Deployment are empty for organization wide requests
+type Target struct {
+	Organization string `json:"organization,omitempty"`
+	Environment  string `json:"environment,omitempty"`
+	Deployment   string `json:"deployment,omitempty"`
+}
+
+//Outcome is how a request ended
+type Outcome struct {
+	//Result is success or failure
+	Result    string `json:"result"`
+	Status    int    `json:"status"`
+	ErrorCode string `json:"errorCode,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+//Sink stores Records
+type Sink interface {
+	Write(record *Record) error
+}
+
+//Querier is implemented by Sinks whose Records can be read back
+type Querier interface {
+	//Query returns the Records matching q, the most recent first
+	Query(q Query) ([]Record, error)
+}
+
+//Query selects Records, empty fields match everything
+type Query struct {
+	Organization string
+	Environment  string
+	Deployment   string
+	Action       string
+	Actor        string
+	Since        time.Time
+	//Limit is the maximum number of Records returned, 0 for all of them
+	Limit int
+}
+
+//Matches returns true if the Record is selected by the Query
+func (q Query) Matches(record *Record) bool {
+	switch {
+	case q.Organization != "" && record.Target.Organization != q.Organization:
+		return false
+	case q.Environment != "" && record.Target.Environment != q.Environment:
+		return false
+	case q.Deployment != "" && record.Target.Deployment != q.Deployment:
+		return false
+	case q.Action != "" && record.Action != q.Action:
+		return false
+	case q.Actor != "" && record.Actor != q.Actor:
+		return false
+	case !q.Since.IsZero() && record.Time.Before(q.Since):
+		return false
+	}
+	return true
+}
+
+//MaxDiffSize is the largest request body kept as the diff of a Record
+const MaxDiffSize = 64 * 1024
+
+const redacted = "<redacted>"
+
+//Diff returns the request body to record as the diff of a Record
+//Values of secret looking keys and of environment variables are redacted, bodies that aren't JSON objects or are too large are left out
+func Diff(body []byte) json.RawMessage {
+	if len(body) == 0 || len(body) > MaxDiffSize {
+		return nil
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		return nil
+	}
+	diff, err := json.Marshal(redact(decoded, ""))
+	if err != nil {
+		return nil
+	}
+	return diff
+}
+
+//redact replaces secrets found in a decoded JSON value, parent is the key the value was found under
+func redact(value interface{}, parent string) interface{} {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		for key, child := range typed {
+			switch {
+			case secretKey(key):
+				typed[key] = redacted
+			//Environment variables are {name, value} objects whose values often hold credentials
+			case key == "value" && envKey(parent):
+				typed[key] = redacted
+			default:
+				//Maps of environment variables such as containerEnvVars keep their parent
+				childParent := key
+				if envKey(parent) {
+					childParent = parent
+				}
+				typed[key] = redact(child, childParent)
+			}
+		}
+		return typed
+	case []interface{}:
+		for i, child := range typed {
+			typed[i] = redact(child, parent)
+		}
+		return typed
+	default:
+		return value
+	}
+}
+
+func secretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, word := range []string{"secret", "password", "token", "privatekey"} {
+		if strings.Contains(key, word) {
+			return true
+		}
+	}
+	return false
+}
+
+func envKey(key string) bool {
+	key = strings.ToLower(key)
+	return key == "env" || strings.HasSuffix(key, "envvars")
+}
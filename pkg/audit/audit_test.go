@@ -0,0 +1,125 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiffRedactsSecrets(t *testing.T) {
+	body := `{
+		"deploymentName": "dep1",
+		"envVars": [{"name": "DB_PASSWORD", "value": "hunter2"}],
+		"containerEnvVars": {"app": [{"name": "API_KEY", "value": "s3cr3t"}]},
+		"pts": {"spec": {"containers": [{"name": "app", "image": "app:1", "env": [{"name": "TOKEN", "value": "t0ken"}]}]}},
+		"privateSecret": "cHJpdmF0ZQ=="
+	}`
+
+	diff := string(Diff([]byte(body)))
+	for _, secret := range []string{"hunter2", "s3cr3t", "t0ken", "cHJpdmF0ZQ=="} {
+		if strings.Contains(diff, secret) {
+			t.Errorf("diff leaked %s: %s", secret, diff)
+		}
+	}
+	for _, kept := range []string{`"deploymentName":"dep1"`, `"name":"DB_PASSWORD"`, `"image":"app:1"`} {
+		if !strings.Contains(diff, kept) {
+			t.Errorf("diff should keep %s: %s", kept, diff)
+		}
+	}
+}
+
+func TestDiffSkipsOtherBodies(t *testing.T) {
+	for _, body := range []string{"", "not json", `["a list"]`, `{"big": "` + strings.Repeat("x", MaxDiffSize) + `"}`} {
+		if diff := Diff([]byte(body)); diff != nil {
+			t.Errorf("Diff(%.20q) = %s, want nil", body, diff)
+		}
+	}
+}
+
+func TestQueryMatches(t *testing.T) {
+	now := time.Now()
+	record := &Record{
+		Time:   now,
+		Actor:  "admin",
+		Action: "updateDeployment",
+		Target: Target{Organization: "org1", Environment: "env1", Deployment: "dep1"},
+	}
+
+	tests := []struct {
+		query   Query
+		matches bool
+	}{
+		{Query{}, true},
+		{Query{Organization: "org1", Environment: "env1"}, true},
+		{Query{Organization: "org1", Environment: "env2"}, false},
+		{Query{Deployment: "dep2"}, false},
+		{Query{Action: "updateDeployment", Actor: "admin"}, true},
+		{Query{Actor: "ci"}, false},
+		{Query{Since: now.Add(-time.Minute)}, true},
+		{Query{Since: now.Add(time.Minute)}, false},
+	}
+	for _, test := range tests {
+		if test.query.Matches(record) != test.matches {
+			t.Errorf("%+v matches = %v, want %v", test.query, !test.matches, test.matches)
+		}
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	file, err := ioutil.TempFile("", "audit")
+	if err != nil {
+		t.Fatalf("TempFile: %v", err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	sink, err := NewFileSink(file.Name())
+	if err != nil {
+		t.Fatalf("NewFileSink: %v", err)
+	}
+	defer sink.Close()
+
+	start := time.Now().UTC()
+	for i, env := range []string{"env1", "env2", "env1", "env1"} {
+		err := sink.Write(&Record{
+			Time:   start.Add(time.Duration(i) * time.Second),
+			Action: "updateEnvironment",
+			Target: Target{Organization: "org1", Environment: env},
+		})
+		if err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	records, err := sink.Query(Query{Organization: "org1", Environment: "env1", Limit: 2})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2", len(records))
+	}
+	//The most recent first
+	if !records[0].Time.Equal(start.Add(3*time.Second)) || !records[1].Time.Equal(start.Add(2*time.Second)) {
+		t.Errorf("got records at %v and %v, want the last two of env1", records[0].Time, records[1].Time)
+	}
+}
+
+func TestWriterSink(t *testing.T) {
+	var out bytes.Buffer
+	sink := NewWriterSink(&out)
+	sink.Write(&Record{Actor: "admin", Action: "deleteEnvironment"})
+	sink.Write(&Record{Actor: "admin", Action: "createEnvironment"})
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2", len(lines))
+	}
+	var record Record
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil || record.Action != "deleteEnvironment" {
+		t.Errorf("first line = %s, %v", lines[0], err)
+	}
+}
@@ -0,0 +1,110 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+//WriterSink writes Records as JSON lines to a writer such as stdout, they can't be queried
+type WriterSink struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+//NewWriterSink creates a WriterSink writing to w
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{
+		w: w,
+	}
+}
+
+//Write implements Sink
+func (sink *WriterSink) Write(record *Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	_, err = sink.w.Write(append(line, '\n'))
+	return err
+}
+
+//FileSink appends Records as JSON lines to a file and reads them back for queries
+type FileSink struct {
+	mutex sync.Mutex
+	path  string
+	file  *os.File
+}
+
+//NewFileSink opens path for appending, creating it if needed
+func NewFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening audit file: %v", err)
+	}
+	return &FileSink{
+		path: path,
+		file: file,
+	}, nil
+}
+
+//Write implements Sink
+func (sink *FileSink) Write(record *Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	_, err = sink.file.Write(append(line, '\n'))
+	return err
+}
+
+//Query implements Querier by scanning the whole file
+func (sink *FileSink) Query(q Query) ([]Record, error) {
+	file, err := os.Open(sink.path)
+	if err != nil {
+		return nil, fmt.Errorf("opening audit file: %v", err)
+	}
+	defer file.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(file)
+	//A Record holds a diff of up to MaxDiffSize plus the rest of the request
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*MaxDiffSize)
+	for scanner.Scan() {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			//A line cut short by a crash shouldn't hide the rest of the file
+			continue
+		}
+		if !q.Matches(&record) {
+			continue
+		}
+		records = append(records, record)
+		if q.Limit > 0 && len(records) > q.Limit {
+			records = records[1:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading audit file: %v", err)
+	}
+
+	//The file is in chronological order
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	return records, nil
+}
+
+//Close closes the file
+func (sink *FileSink) Close() error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	return sink.file.Close()
+}
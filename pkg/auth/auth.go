@@ -0,0 +1,86 @@
+//Package auth decides whether a caller may perform an action on an organization or environment.
+package auth
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/30x/enrober/pkg/config"
+	"github.com/30x/enrober/pkg/helper"
+)
+
+//Action is what a request does to its target
+type Action string
+
+//Actions passed to an Authorizer
+const (
+	ActionRead   Action = "read"
+	ActionWrite  Action = "write"
+	ActionDelete Action = "delete"
+	ActionLogs   Action = "logs"
+	//ActionAdmin covers changes to the environment itself, such as its host names and routing keys
+	ActionAdmin Action = "admin"
+)
+
+//Authorizer checks if the caller of a request may perform an action
+type Authorizer interface {
+	//Authorize returns nil if the caller may perform action on the given org and env
+	//env is empty for organization wide requests, and org is empty for requests spanning organizations,
+	//in which case only the caller's credentials are checked
+	//The returned error is a 401 if the caller couldn't be authenticated and a 403 if it isn't allowed
+	Authorize(r *http.Request, org, env string, action Action) *helper.APIError
+}
+
+//Identifier is implemented by Authorizers that can name the caller of a request, e.g. for logs
+type Identifier interface {
+	//Identify returns the caller's subject, or an empty string if it can't be authenticated
+	Identify(r *http.Request) string
+}
+
+//AllowAll is an Authorizer that lets every request through, only meant for local development
+type AllowAll struct{}
+
+//Authorize always succeeds
+func (AllowAll) Authorize(r *http.Request, org, env string, action Action) *helper.APIError {
+	return nil
+}
+
+//New creates the Authorizer selected by the auth mode
+//authsdk identifies callers with their Apigee JWT, org admins being admins
+//jwks verifies JWTs against the key set in the JWKS file, optionally checking the issuer and audience,
+//and reads the organizations the caller administers from the orgs claim
+//Other callers get the role bound to them in the environment
+//none lets every request through
+func New(cfg config.Auth, bindings RoleBindings) (Authorizer, error) {
+	switch cfg.Mode {
+	case config.AuthModeAuthSDK:
+		return NewRoles(AuthSDK{}, bindings), nil
+	case config.AuthModeJWKS:
+		jwks, err := ioutil.ReadFile(cfg.JWKSFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading JWKS file: %v", err)
+		}
+		authenticator, err := NewJWKS(jwks, JWKSOptions{
+			Issuer:    cfg.Issuer,
+			Audience:  cfg.Audience,
+			OrgsClaim: cfg.OrgsClaim,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return NewRoles(authenticator, bindings), nil
+	case config.AuthModeNone:
+		return AllowAll{}, nil
+	default:
+		return nil, fmt.Errorf("unknown auth mode %s, expected %s, %s or %s", cfg.Mode, config.AuthModeAuthSDK, config.AuthModeJWKS, config.AuthModeNone)
+	}
+}
+
+func unauthorized(message string, err error) *helper.APIError {
+	return helper.NewAPIError(http.StatusUnauthorized, helper.ErrCodeUnauthorized, message, err)
+}
+
+func forbidden(message string, err error) *helper.APIError {
+	return helper.NewAPIError(http.StatusForbidden, helper.ErrCodeForbidden, message, err)
+}
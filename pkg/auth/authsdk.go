@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"net/http"
+
+	"github.com/30x/authsdk"
+	"github.com/30x/enrober/pkg/helper"
+)
+
+//AuthSDK identifies callers with their Apigee JWT
+//Used as an Authorizer it only lets Apigee org admins through, whatever the action
+type AuthSDK struct{}
+
+//sdkCaller is a caller identified by an Apigee JWT
+type sdkCaller struct {
+	token    authsdk.JWTToken
+	username string
+}
+
+func (caller sdkCaller) Subject() string {
+	return caller.username
+}
+
+func (caller sdkCaller) IsOrgAdmin(org string) (bool, error) {
+	return caller.token.IsOrgAdmin(org)
+}
+
+//Authenticate checks the caller's Apigee JWT
+func (AuthSDK) Authenticate(r *http.Request) (Caller, *helper.APIError) {
+	token, err := authsdk.NewJWTTokenFromRequest(r)
+	if err != nil {
+		return nil, unauthorized("Invalid Token", err) //401
+	}
+	username, err := token.GetUsername()
+	if err != nil {
+		return nil, unauthorized("Invalid Token", err) //401
+	}
+	return sdkCaller{
+		token:    token,
+		username: username,
+	}, nil
+}
+
+//Authorize checks the caller's Apigee JWT and that they are an admin of org
+func (sdk AuthSDK) Authorize(r *http.Request, org, env string, action Action) *helper.APIError {
+	return NewRoles(sdk, nil).Authorize(r, org, env, action)
+}
@@ -0,0 +1,236 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rsa"
+	_ "crypto/sha256" //Registers SHA-256 for RS256
+	_ "crypto/sha512" //Registers SHA-384 and SHA-512 for RS384 and RS512
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/30x/enrober/pkg/helper"
+)
+
+//Allowed clock difference when checking exp and nbf
+const jwtLeeway = 30 * time.Second
+
+//Supported JWT signing algorithms
+var jwtAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+}
+
+//JWKSOptions are the optional checks done by a JWKS Authorizer
+type JWKSOptions struct {
+	//Issuer is compared to the iss claim if set
+	Issuer string
+	//Audience has to be one of the aud claim values if set
+	Audience string
+	//OrgsClaim is the claim listing the organizations the caller administers, "orgs" if empty
+	//A "*" entry allows every organization
+	OrgsClaim string
+}
+
+//JWKS identifies callers with JWTs signed with one of a static set of RSA keys
+//Used as an Authorizer it only lets admins of the organization through
+type JWKS struct {
+	keys    map[string]*rsa.PublicKey
+	options JWKSOptions
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+//NewJWKS creates a JWKS Authorizer from a JSON Web Key Set document
+//Only RSA signing keys are used, others are ignored
+func NewJWKS(jwks []byte, options JWKSOptions) (*JWKS, error) {
+	var keySet struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err := json.Unmarshal(jwks, &keySet)
+	if err != nil {
+		return nil, fmt.Errorf("decoding JWKS: %v", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, key := range keySet.Keys {
+		if key.Kty != "RSA" || (key.Use != "" && key.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil {
+			return nil, fmt.Errorf("decoding modulus of key %s: %v", key.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		if err != nil {
+			return nil, fmt.Errorf("decoding exponent of key %s: %v", key.Kid, err)
+		}
+		keys[key.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS has no RSA signing keys")
+	}
+
+	if options.OrgsClaim == "" {
+		options.OrgsClaim = "orgs"
+	}
+
+	return &JWKS{
+		keys:    keys,
+		options: options,
+	}, nil
+}
+
+//jwtCaller is a caller identified by a verified JWT
+type jwtCaller struct {
+	subject string
+	orgs    []interface{}
+}
+
+func (caller jwtCaller) Subject() string {
+	return caller.subject
+}
+
+func (caller jwtCaller) IsOrgAdmin(org string) (bool, error) {
+	for _, allowed := range caller.orgs {
+		if allowed == org || allowed == "*" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+//Authenticate verifies the caller's bearer token
+//The sub claim identifies the caller and the organizations claim lists the orgs it administers
+func (j *JWKS) Authenticate(r *http.Request) (Caller, *helper.APIError) {
+	authz := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authz, "Bearer ") {
+		return nil, unauthorized("Invalid Token", errors.New("missing bearer token")) //401
+	}
+
+	claims, err := j.verify(strings.TrimPrefix(authz, "Bearer "))
+	if err != nil {
+		return nil, unauthorized("Invalid Token", err) //401
+	}
+
+	subject, _ := claims["sub"].(string)
+	orgs, _ := claims[j.options.OrgsClaim].([]interface{})
+	return jwtCaller{
+		subject: subject,
+		orgs:    orgs,
+	}, nil
+}
+
+//Authorize verifies the caller's bearer token and that org is one of the organizations it lists
+func (j *JWKS) Authorize(r *http.Request, org, env string, action Action) *helper.APIError {
+	return NewRoles(j, nil).Authorize(r, org, env, action)
+}
+
+//verify checks the signature and standard claims of a JWT and returns its claims
+func (j *JWKS) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed JWT")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("decoding JWT header: %v", err)
+	}
+
+	hash, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported JWT algorithm %s", header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("decoding JWT signature: %v", err)
+	}
+
+	hasher := hash.New()
+	hasher.Write([]byte(parts[0] + "." + parts[1]))
+	digest := hasher.Sum(nil)
+
+	//Without a kid every key is tried
+	verified := false
+	for kid, key := range j.keys {
+		if header.Kid != "" && kid != header.Kid {
+			continue
+		}
+		if rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("invalid JWT signature")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("decoding JWT claims: %v", err)
+	}
+
+	now := time.Now()
+	//Tokens that never expire can't be revoked
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, errors.New("JWT has no expiration time")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return nil, errors.New("JWT has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("JWT isn't valid yet")
+	}
+	if j.options.Issuer != "" && claims["iss"] != j.options.Issuer {
+		return nil, fmt.Errorf("unexpected JWT issuer %v", claims["iss"])
+	}
+	if j.options.Audience != "" && !hasAudience(claims["aud"], j.options.Audience) {
+		return nil, fmt.Errorf("JWT isn't meant for %s", j.options.Audience)
+	}
+
+	return claims, nil
+}
+
+//hasAudience checks an aud claim, which can be a single string or a list of them
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, value := range aud {
+			if value == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
@@ -0,0 +1,131 @@
+package auth_test
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/30x/enrober/pkg/auth"
+)
+
+//newTestKey generates a key pair and the JWKS document publishing its public half
+func newTestKey(t *testing.T, kid string) (*rsa.PrivateKey, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error generating key: %v\n", err)
+	}
+
+	jwks, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": kid,
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	})
+	return key, jwks
+}
+
+//sign creates an RS256 JWT with the given claims
+func sign(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid})
+	payload, _ := json.Marshal(claims)
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("Error signing token: %v\n", err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func requestWithToken(token string) *http.Request {
+	r, _ := http.NewRequest("GET", "/environments/org1:env1", nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+func TestJWKS(t *testing.T) {
+	key, jwks := newTestKey(t, "test")
+	otherKey, _ := newTestKey(t, "test")
+
+	authorizer, err := auth.NewJWKS(jwks, auth.JWKSOptions{
+		Issuer:   "https://issuer.example.com",
+		Audience: "enrober",
+	})
+	if err != nil {
+		t.Fatalf("Error creating authorizer: %v\n", err)
+	}
+
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		base := map[string]interface{}{
+			"iss":  "https://issuer.example.com",
+			"aud":  []string{"enrober"},
+			"exp":  time.Now().Add(time.Hour).Unix(),
+			"orgs": []string{"org1"},
+		}
+		for name, value := range overrides {
+			base[name] = value
+		}
+		return base
+	}
+
+	cases := []struct {
+		name   string
+		token  string
+		org    string
+		status int
+	}{
+		{"valid", sign(t, key, "test", claims(nil)), "org1", 0},
+		{"spanning organizations", sign(t, key, "test", claims(nil)), "", 0},
+		{"wildcard", sign(t, key, "test", claims(map[string]interface{}{"orgs": []string{"*"}})), "org2", 0},
+		{"other organization", sign(t, key, "test", claims(nil)), "org2", 403},
+		{"no orgs claim", sign(t, key, "test", claims(map[string]interface{}{"orgs": nil})), "org1", 403},
+		{"missing token", "", "org1", 401},
+		{"malformed token", "not.a.jwt", "org1", 401},
+		{"wrong key", sign(t, otherKey, "test", claims(nil)), "org1", 401},
+		{"unknown kid", sign(t, key, "other", claims(nil)), "org1", 401},
+		{"expired", sign(t, key, "test", claims(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()})), "org1", 401},
+		{"no expiration", sign(t, key, "test", claims(map[string]interface{}{"exp": nil})), "org1", 401},
+		{"not yet valid", sign(t, key, "test", claims(map[string]interface{}{"nbf": time.Now().Add(time.Hour).Unix()})), "org1", 401},
+		{"wrong issuer", sign(t, key, "test", claims(map[string]interface{}{"iss": "https://evil.example.com"})), "org1", 401},
+		{"wrong audience", sign(t, key, "test", claims(map[string]interface{}{"aud": "other"})), "org1", 401},
+	}
+
+	for _, c := range cases {
+		apiErr := authorizer.Authorize(requestWithToken(c.token), c.org, "env1", auth.ActionRead)
+		status := 0
+		if apiErr != nil {
+			status = apiErr.Status
+		}
+		if status != c.status {
+			t.Errorf("%s: expected status %d, got %d (%v)\n", c.name, c.status, status, apiErr)
+		}
+	}
+}
+
+func TestNewJWKSWithoutKeys(t *testing.T) {
+	_, err := auth.NewJWKS([]byte(`{"keys": [{"kty": "EC", "kid": "ec"}]}`), auth.JWKSOptions{})
+	if err == nil {
+		t.Error("Expected an error for a JWKS without RSA keys\n")
+	}
+}
+
+func TestAllowAll(t *testing.T) {
+	for _, action := range []auth.Action{auth.ActionRead, auth.ActionWrite, auth.ActionDelete, auth.ActionLogs} {
+		if apiErr := (auth.AllowAll{}).Authorize(requestWithToken(""), "org1", "env1", action); apiErr != nil {
+			t.Errorf("Expected %s to be allowed, got %v\n", action, apiErr)
+		}
+	}
+}
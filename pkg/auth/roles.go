@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/30x/enrober/pkg/helper"
+)
+
+//Role is a set of actions a subject may perform in an environment
+type Role string
+
+//Roles that can be bound to a subject
+const (
+	//RoleViewer may read environments and deployments and their logs
+	RoleViewer Role = "viewer"
+	//RoleDeployer may also create, update and delete deployments
+	RoleDeployer Role = "deployer"
+	//RoleAdmin may do everything, org admins are admins of every environment in the org
+	RoleAdmin Role = "admin"
+)
+
+var roleActions = map[Role][]Action{
+	RoleViewer:   {ActionRead, ActionLogs},
+	RoleDeployer: {ActionRead, ActionLogs, ActionWrite, ActionDelete},
+	RoleAdmin:    {ActionRead, ActionLogs, ActionWrite, ActionDelete, ActionAdmin},
+}
+
+//Valid returns true for the known roles
+func (role Role) Valid() bool {
+	_, ok := roleActions[role]
+	return ok
+}
+
+//Allows returns true if the role may perform action
+func (role Role) Allows(action Action) bool {
+	for _, allowed := range roleActions[role] {
+		if allowed == action {
+			return true
+		}
+	}
+	return false
+}
+
+//Caller is the authenticated identity behind a request
+type Caller interface {
+	//Subject identifies the caller in role bindings
+	Subject() string
+	//IsOrgAdmin returns true if the caller administers the organization
+	IsOrgAdmin(org string) (bool, error)
+}
+
+//Authenticator identifies the caller of a request
+type Authenticator interface {
+	//Authenticate returns a 401 error if the request has no valid credentials
+	Authenticate(r *http.Request) (Caller, *helper.APIError)
+}
+
+//RoleBindings looks up the role a subject has been given in an environment
+type RoleBindings interface {
+	//Role returns an empty role if nothing is bound to the subject
+	Role(org, env, subject string) (Role, error)
+}
+
+//Roles is an Authorizer giving org admins every permission and everybody else the role bound to them in an environment
+type Roles struct {
+	authenticator Authenticator
+	bindings      RoleBindings
+}
+
+//NewRoles creates a Roles authorizer, with nil bindings only org admins are let through
+func NewRoles(authenticator Authenticator, bindings RoleBindings) *Roles {
+	return &Roles{
+		authenticator: authenticator,
+		bindings:      bindings,
+	}
+}
+
+//Identify returns the subject of the caller, empty if it can't be authenticated
+func (roles *Roles) Identify(r *http.Request) string {
+	caller, apiErr := roles.authenticator.Authenticate(r)
+	if apiErr != nil {
+		return ""
+	}
+	return caller.Subject()
+}
+
+//Authorize checks the caller is an org admin or has been bound a role allowing action in env
+//Organization wide requests (an empty env) are reserved to org admins
+func (roles *Roles) Authorize(r *http.Request, org, env string, action Action) *helper.APIError {
+	session, apiErr := roles.NewSession(r)
+	if apiErr != nil {
+		return apiErr
+	}
+	return session.Authorize(org, env, action)
+}
+
+//NewSession authenticates the caller of r for checks of many environments
+func (roles *Roles) NewSession(r *http.Request) (*Session, *helper.APIError) {
+	caller, apiErr := roles.authenticator.Authenticate(r)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	return &Session{
+		caller:   caller,
+		bindings: roles.bindings,
+		orgAdmin: map[string]bool{},
+	}, nil
+}
+
+//SessionAuthorizer is implemented by Authorizers that can check many environments for the same request,
+//such as when listing environments, cheaper than calling Authorize for each of them
+type SessionAuthorizer interface {
+	//NewSession returns a 401 error if the request has no valid credentials
+	NewSession(r *http.Request) (*Session, *helper.APIError)
+}
+
+//Session checks the permissions of an authenticated caller, asking once per organization if they administer it
+//A Session belongs to a single request and isn't safe for concurrent use
+type Session struct {
+	caller   Caller
+	bindings RoleBindings
+	orgAdmin map[string]bool
+}
+
+//Authorize checks the caller is an org admin or has been bound a role allowing action in env
+//Organization wide requests (an empty env) are reserved to org admins
+func (session *Session) Authorize(org, env string, action Action) *helper.APIError {
+	return session.authorize(org, env, action, func() (Role, error) {
+		return session.bindings.Role(org, env, session.caller.Subject())
+	})
+}
+
+//AuthorizeWith is Authorize looking up the role of the caller in bindings, e.g. ones read from an environment just listed
+//bindings are only used if the Session has role bindings
+func (session *Session) AuthorizeWith(org, env string, bindings RoleBindings, action Action) *helper.APIError {
+	return session.authorize(org, env, action, func() (Role, error) {
+		return bindings.Role(org, env, session.caller.Subject())
+	})
+}
+
+func (session *Session) authorize(org, env string, action Action, role func() (Role, error)) *helper.APIError {
+	caller := session.caller
+	if org == "" {
+		return nil
+	}
+
+	isAdmin, ok := session.orgAdmin[org]
+	if !ok {
+		var err error
+		isAdmin, err = caller.IsOrgAdmin(org)
+		if err != nil {
+			return unauthorized("Error checking caller is an Org Admin", err) //401
+		}
+		session.orgAdmin[org] = isAdmin
+	}
+	if isAdmin {
+		return nil
+	}
+
+	if env != "" && session.bindings != nil {
+		role, err := role()
+		if err != nil {
+			return helper.NewAPIError(http.StatusInternalServerError, helper.ErrCodeInternal, "Error looking up role bindings", err)
+		}
+		if role.Allows(action) {
+			return nil
+		}
+		if role != "" {
+			return forbidden(fmt.Sprintf("The %s role doesn't allow %s", role, action), fmt.Errorf("%s is a %s of %s:%s", caller.Subject(), role, org, env)) //403
+		}
+	}
+
+	return forbidden("You aren't an Org Admin", fmt.Errorf("%s has no role in %s:%s", caller.Subject(), org, env)) //403
+}
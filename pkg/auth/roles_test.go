@@ -0,0 +1,145 @@
+package auth_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/30x/enrober/pkg/auth"
+	"github.com/30x/enrober/pkg/helper"
+)
+
+//headerCaller is identified by a header, "admin" administering every organization
+type headerCaller string
+
+func (caller headerCaller) Subject() string {
+	return string(caller)
+}
+
+func (caller headerCaller) IsOrgAdmin(org string) (bool, error) {
+	return caller == "admin", nil
+}
+
+type headerAuthenticator struct{}
+
+func (headerAuthenticator) Authenticate(r *http.Request) (auth.Caller, *helper.APIError) {
+	user := r.Header.Get("X-User")
+	if user == "" {
+		return nil, helper.NewAPIError(http.StatusUnauthorized, helper.ErrCodeUnauthorized, "Invalid Token", nil)
+	}
+	return headerCaller(user), nil
+}
+
+//staticBindings maps org:env to subject to role
+type staticBindings map[string]map[string]auth.Role
+
+func (b staticBindings) Role(org, env, subject string) (auth.Role, error) {
+	return b[org+":"+env][subject], nil
+}
+
+func TestRoles(t *testing.T) {
+	authorizer := auth.NewRoles(headerAuthenticator{}, staticBindings{
+		"org1:env1": {
+			"oncall": auth.RoleViewer,
+			"ci":     auth.RoleDeployer,
+			"lead":   auth.RoleAdmin,
+		},
+	})
+
+	cases := []struct {
+		user   string
+		env    string
+		action auth.Action
+		status int
+	}{
+		{"admin", "env1", auth.ActionAdmin, 0},
+		{"admin", "", auth.ActionAdmin, 0},
+		{"oncall", "env1", auth.ActionRead, 0},
+		{"oncall", "env1", auth.ActionLogs, 0},
+		{"oncall", "env1", auth.ActionWrite, 403},
+		{"ci", "env1", auth.ActionWrite, 0},
+		{"ci", "env1", auth.ActionDelete, 0},
+		{"ci", "env1", auth.ActionAdmin, 403},
+		{"lead", "env1", auth.ActionAdmin, 0},
+		{"lead", "env2", auth.ActionRead, 403},
+		{"lead", "", auth.ActionRead, 403},
+		{"stranger", "env1", auth.ActionRead, 403},
+		{"", "env1", auth.ActionRead, 401},
+	}
+
+	for _, c := range cases {
+		r, _ := http.NewRequest("GET", "/", nil)
+		if c.user != "" {
+			r.Header.Set("X-User", c.user)
+		}
+		apiErr := authorizer.Authorize(r, "org1", c.env, c.action)
+		status := 0
+		if apiErr != nil {
+			status = apiErr.Status
+		}
+		if status != c.status {
+			t.Errorf("%s %s on %s: expected status %d, got %d (%v)\n", c.user, c.action, c.env, c.status, status, apiErr)
+		}
+	}
+}
+
+func TestRoleAllows(t *testing.T) {
+	if auth.RoleViewer.Allows(auth.ActionWrite) {
+		t.Error("Viewers shouldn't be able to write\n")
+	}
+	if !auth.RoleDeployer.Allows(auth.ActionWrite) || auth.RoleDeployer.Allows(auth.ActionAdmin) {
+		t.Error("Deployers should only be able to write deployments\n")
+	}
+	if auth.Role("owner").Valid() {
+		t.Error("Unknown roles shouldn't be valid\n")
+	}
+}
+
+//countingCaller counts the org admin checks, which are remote calls for Apigee JWTs
+type countingCaller struct {
+	headerCaller
+	checks *int
+}
+
+func (caller countingCaller) IsOrgAdmin(org string) (bool, error) {
+	*caller.checks++
+	return caller.headerCaller.IsOrgAdmin(org)
+}
+
+type countingAuthenticator struct {
+	authentications *int
+	checks          *int
+}
+
+func (a countingAuthenticator) Authenticate(r *http.Request) (auth.Caller, *helper.APIError) {
+	*a.authentications++
+	return countingCaller{headerCaller(r.Header.Get("X-User")), a.checks}, nil
+}
+
+func TestSession(t *testing.T) {
+	authentications, checks := 0, 0
+	authorizer := auth.NewRoles(countingAuthenticator{&authentications, &checks}, staticBindings{})
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("X-User", "oncall")
+	session, apiErr := authorizer.NewSession(r)
+	if apiErr != nil {
+		t.Fatalf("Unexpected error creating session: %v\n", apiErr)
+	}
+
+	//The bindings given with each environment are used instead of the authorizer's
+	listed := staticBindings{"org1:env2": {"oncall": auth.RoleViewer}}
+	for _, env := range []string{"env1", "env2", "env3"} {
+		apiErr := session.AuthorizeWith("org1", env, listed, auth.ActionRead)
+		if (apiErr == nil) != (env == "env2") {
+			t.Errorf("Reading %s: unexpected result %v\n", env, apiErr)
+		}
+	}
+	session.AuthorizeWith("org2", "env1", listed, auth.ActionRead)
+
+	if authentications != 1 {
+		t.Errorf("Expected the caller to be authenticated once, got %d\n", authentications)
+	}
+	if checks != 2 {
+		t.Errorf("Expected one org admin check per organization, got %d\n", checks)
+	}
+}
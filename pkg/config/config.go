@@ -0,0 +1,494 @@
+//Package config loads the enrober configuration from defaults, an optional YAML file, environment variables and flags.
+//Later sources win, so a flag overrides an environment variable which overrides the YAML file.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/30x/enrober/pkg/logging"
+
+	"gopkg.in/yaml.v2"
+)
+
+//Deploy states, they only pick defaults and every setting can still be changed on its own
+const (
+	DeployStateProd         = "PROD"
+	DeployStateDevContainer = "DEV_CONTAINER"
+	DeployStateDev          = "DEV"
+)
+
+//Auth modes
+const (
+	AuthModeAuthSDK = "authsdk"
+	AuthModeJWKS    = "jwks"
+	AuthModeNone    = "none"
+)
+
+//Audit sinks
+const (
+	AuditSinkStdout = "stdout"
+	AuditSinkFile   = "file"
+	AuditSinkEvent  = "event"
+	AuditSinkNone   = "none"
+)
+
+//Config is the whole enrober configuration
+type Config struct {
+	//DeployState is PROD, DEV_CONTAINER, DEV or empty for a local setup
+	DeployState string `yaml:"deployState"`
+
+	HTTP       HTTP       `yaml:"http"`
+	Kubernetes Kubernetes `yaml:"kubernetes"`
+	Features   Features   `yaml:"features"`
+	Apigee     Apigee     `yaml:"apigee"`
+	Auth       Auth       `yaml:"auth"`
+	PTS        PTS        `yaml:"pts"`
+	Logging    Logging    `yaml:"logging"`
+	Audit      Audit      `yaml:"audit"`
+
+	//names of the settings given explicitly by any source
+	set map[string]bool
+}
+
+//HTTP is how enrober serves its API
+type HTTP struct {
+	//Address to listen on
+	Address string `yaml:"address"`
+	//TLSCertFile and TLSKeyFile enable HTTPS, they are reloaded when they change on disk
+	TLSCertFile string `yaml:"tlsCertFile"`
+	TLSKeyFile  string `yaml:"tlsKeyFile"`
+	//ReadTimeout limits reading a whole request, WriteTimeout writing its response and IdleTimeout how long keep-alive connections are kept
+	//WriteTimeout is off by default since followed logs and ?wait keep responses open
+	ReadTimeout  time.Duration `yaml:"readTimeout"`
+	WriteTimeout time.Duration `yaml:"writeTimeout"`
+	IdleTimeout  time.Duration `yaml:"idleTimeout"`
+	//ShutdownTimeout is how long in-flight requests get to finish on SIGTERM
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+}
+
+//Kubernetes is how to reach the cluster
+//With a Kubeconfig or Context the cluster and credentials come from the kubeconfig, the other settings overriding them,
+//otherwise Master is used with the given credentials, and without a Master enrober uses its in-cluster service account
+type Kubernetes struct {
+	//Kubeconfig is the kubeconfig file to use, with Context picking one of its contexts instead of the current one
+	Kubeconfig string `yaml:"kubeconfig"`
+	Context    string `yaml:"context"`
+	//Master is the address of the API server
+	//Defaults to 127.0.0.1:8080 (kubectl proxy) for local deploy states when no kubeconfig is given
+	Master string `yaml:"master"`
+	//CertificateAuthority is the CA file the API server certificate is checked against
+	CertificateAuthority string `yaml:"certificateAuthority"`
+	//ClientCertificate and ClientKey are the files of the client certificate enrober authenticates with
+	ClientCertificate string `yaml:"clientCertificate"`
+	ClientKey         string `yaml:"clientKey"`
+	//Token is the bearer token enrober authenticates with
+	Token string `yaml:"token"`
+	//InsecureSkipTLSVerify doesn't check the API server certificate, only for development
+	InsecureSkipTLSVerify bool `yaml:"insecureSkipTLSVerify"`
+}
+
+//Features are the optional behaviours of enrober
+type Features struct {
+	//IsolateNamespace adds a DefaultDeny network policy to new environments
+	IsolateNamespace bool `yaml:"isolateNamespace"`
+	//AllowPrivilegedContainers keeps the privileged flag of deployed containers
+	AllowPrivilegedContainers bool `yaml:"allowPrivilegedContainers"`
+	//ApigeeKVM stores each environment's public key in the Apigee shipyard-routing KVM
+	ApigeeKVM bool `yaml:"apigeeKVM"`
+	//RestrictPTSHost only accepts pod template spec URLs on the host enrober was called on, defaults to true for PROD
+	//The caller's Authorization header is sent with the fetch, inline pod template specs aren't affected
+	RestrictPTSHost bool `yaml:"restrictPTSHost"`
+}
+
+//Apigee is how to reach the Apigee management API
+type Apigee struct {
+	//APIHost is the management API host
+	APIHost string `yaml:"apiHost"`
+	//Timeout of a single call
+	Timeout time.Duration `yaml:"timeout"`
+	//Retries of a failed call, 0 or negative to disable
+	Retries int `yaml:"retries"`
+	//OrgCacheTTL is how long organization feature flags are cached for, 0 or negative to disable caching
+	OrgCacheTTL time.Duration `yaml:"orgCacheTTL"`
+}
+
+//Auth selects how callers are authenticated
+type Auth struct {
+	//Mode is authsdk, jwks or none
+	Mode string `yaml:"mode"`
+	//JWKSFile is the JSON Web Key Set used with the jwks mode
+	JWKSFile string `yaml:"jwksFile"`
+	//Issuer and Audience are checked against the iss and aud claims if set
+	Issuer   string `yaml:"issuer"`
+	Audience string `yaml:"audience"`
+	//OrgsClaim lists the organizations the caller administers
+	OrgsClaim string `yaml:"orgsClaim"`
+}
+
+//PTS is how pod template specs are fetched from ptsURL
+type PTS struct {
+	//ShipyardHost is the public host of shipyard, requests to it go through the internal router instead
+	ShipyardHost string `yaml:"shipyardHost"`
+	//InternalRouterHost is the host of the internal router
+	InternalRouterHost string `yaml:"internalRouterHost"`
+	//ShipyardPrivateSecret is the routing key sent to the internal router
+	ShipyardPrivateSecret string `yaml:"shipyardPrivateSecret"`
+	//APIRoutingKeyHeader is the header the routing key is sent in
+	APIRoutingKeyHeader string `yaml:"apiRoutingKeyHeader"`
+}
+
+//Logging is what enrober logs
+type Logging struct {
+	//Level is debug, info, warn or error
+	Level string `yaml:"level"`
+}
+
+//Audit is where the audit records of mutating requests go
+type Audit struct {
+	//Sink is stdout, file, event (a Kubernetes Event in the environment's namespace) or none
+	Sink string `yaml:"sink"`
+	//File is the JSON lines file used with the file sink
+	File string `yaml:"file"`
+}
+
+//setting describes one configuration value and where it can be set from
+type setting struct {
+	name   string
+	env    string
+	usage  string
+	value  interface{}
+	secret bool
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{name: "deploy-state", env: "DEPLOY_STATE", usage: "PROD, DEV_CONTAINER or DEV, picks defaults", value: &c.DeployState},
+		{name: "listen-address", env: "LISTEN_ADDRESS", usage: "address to serve the API on", value: &c.HTTP.Address},
+		{name: "tls-cert-file", env: "TLS_CERT_FILE", usage: "certificate file to serve HTTPS with, reloaded when it changes", value: &c.HTTP.TLSCertFile},
+		{name: "tls-key-file", env: "TLS_KEY_FILE", usage: "key file to serve HTTPS with, reloaded when it changes", value: &c.HTTP.TLSKeyFile},
+		{name: "read-timeout", env: "READ_TIMEOUT", usage: "maximum duration to read a request, 0 for none", value: &c.HTTP.ReadTimeout},
+		{name: "write-timeout", env: "WRITE_TIMEOUT", usage: "maximum duration to write a response, 0 for none", value: &c.HTTP.WriteTimeout},
+		{name: "idle-timeout", env: "IDLE_TIMEOUT", usage: "how long idle keep-alive connections are kept, 0 for none", value: &c.HTTP.IdleTimeout},
+		{name: "shutdown-timeout", env: "SHUTDOWN_TIMEOUT", usage: "how long in-flight requests get to finish on SIGTERM", value: &c.HTTP.ShutdownTimeout},
+		{name: "kubeconfig", env: "KUBECONFIG", usage: "kubeconfig file to connect to Kubernetes with", value: &c.Kubernetes.Kubeconfig},
+		{name: "context", env: "KUBE_CONTEXT", usage: "kubeconfig context to use instead of the current one", value: &c.Kubernetes.Context},
+		{name: "master", env: "KUBE_MASTER", usage: "Kubernetes API server address, in-cluster config is used if neither it nor a kubeconfig is given", value: &c.Kubernetes.Master},
+		{name: "certificate-authority", env: "KUBE_CERTIFICATE_AUTHORITY", usage: "CA file to check the API server certificate with", value: &c.Kubernetes.CertificateAuthority},
+		{name: "client-certificate", env: "KUBE_CLIENT_CERTIFICATE", usage: "client certificate file to authenticate to the API server with", value: &c.Kubernetes.ClientCertificate},
+		{name: "client-key", env: "KUBE_CLIENT_KEY", usage: "client key file to authenticate to the API server with", value: &c.Kubernetes.ClientKey},
+		{name: "token", env: "KUBE_TOKEN", usage: "bearer token to authenticate to the API server with", value: &c.Kubernetes.Token, secret: true},
+		{name: "insecure-skip-tls-verify", env: "KUBE_INSECURE_SKIP_TLS_VERIFY", usage: "don't check the API server certificate", value: &c.Kubernetes.InsecureSkipTLSVerify},
+		{name: "isolate-namespace", env: "ISOLATE_NAMESPACE", usage: "add a DefaultDeny network policy to new environments", value: &c.Features.IsolateNamespace},
+		{name: "allow-privileged-containers", env: "ALLOW_PRIV_CONTAINERS", usage: "allow privileged containers", value: &c.Features.AllowPrivilegedContainers},
+		{name: "apigee-kvm", env: "APIGEE_KVM", usage: "store environment public keys in the Apigee shipyard-routing KVM", value: &c.Features.ApigeeKVM},
+		{name: "restrict-pts-host", env: "RESTRICT_PTS_HOST", usage: "only accept ptsURLs on the host enrober is called on", value: &c.Features.RestrictPTSHost},
+		{name: "apigee-api-host", env: "AUTH_API_HOST", usage: "Apigee management API host", value: &c.Apigee.APIHost},
+		{name: "apigee-timeout", env: "APIGEE_TIMEOUT", usage: "timeout of Apigee management API calls", value: &c.Apigee.Timeout},
+		{name: "apigee-retries", env: "APIGEE_RETRIES", usage: "retries of failed Apigee management API calls, 0 to disable", value: &c.Apigee.Retries},
+		{name: "apigee-org-cache-ttl", env: "APIGEE_ORG_CACHE_TTL", usage: "how long Apigee organization feature flags are cached, 0 to disable caching", value: &c.Apigee.OrgCacheTTL},
+		{name: "auth-mode", env: "AUTH_MODE", usage: "authsdk, jwks or none", value: &c.Auth.Mode},
+		{name: "jwks-file", env: "JWKS_FILE", usage: "JSON Web Key Set file used with auth-mode jwks", value: &c.Auth.JWKSFile},
+		{name: "jwt-issuer", env: "JWT_ISSUER", usage: "expected iss claim", value: &c.Auth.Issuer},
+		{name: "jwt-audience", env: "JWT_AUDIENCE", usage: "expected aud claim", value: &c.Auth.Audience},
+		{name: "jwt-orgs-claim", env: "JWT_ORGS_CLAIM", usage: "claim listing the organizations the caller administers", value: &c.Auth.OrgsClaim},
+		{name: "shipyard-host", env: "SHIPYARD_HOST", usage: "public shipyard host, ptsURLs on it go through the internal router", value: &c.PTS.ShipyardHost},
+		{name: "internal-router-host", env: "INTERNAL_ROUTER_HOST", usage: "internal router host", value: &c.PTS.InternalRouterHost},
+		{name: "shipyard-private-secret", env: "SHIPYARD_PRIVATE_SECRET", usage: "routing key sent to the internal router", value: &c.PTS.ShipyardPrivateSecret, secret: true},
+		{name: "api-routing-key-header", env: "API_ROUTING_KEY_HEADER", usage: "header the routing key is sent in", value: &c.PTS.APIRoutingKeyHeader},
+		{name: "log-level", env: "LOG_LEVEL", usage: "debug, info, warn or error", value: &c.Logging.Level},
+		{name: "audit-sink", env: "AUDIT_SINK", usage: "where audit records go, stdout, file, event or none", value: &c.Audit.Sink},
+		{name: "audit-file", env: "AUDIT_FILE", usage: "JSON lines file audit records are appended to with audit-sink file", value: &c.Audit.File},
+	}
+}
+
+//Default returns the configuration used when nothing is set
+func Default() *Config {
+	return &Config{
+		HTTP: HTTP{
+			Address:         ":9000",
+			ReadTimeout:     30 * time.Second,
+			IdleTimeout:     2 * time.Minute,
+			ShutdownTimeout: 25 * time.Second,
+		},
+		Apigee: Apigee{
+			APIHost:     "api.enterprise.apigee.com",
+			Timeout:     30 * time.Second,
+			Retries:     2,
+			OrgCacheTTL: 10 * time.Minute,
+		},
+		Auth: Auth{
+			Mode:      AuthModeAuthSDK,
+			OrgsClaim: "orgs",
+		},
+		PTS: PTS{
+			APIRoutingKeyHeader: "X-ROUTING-API-KEY",
+		},
+		Logging: Logging{
+			Level: "info",
+		},
+		Audit: Audit{
+			Sink: AuditSinkStdout,
+		},
+		set: map[string]bool{},
+	}
+}
+
+//Load builds the configuration from the command line arguments (without the program name) and the environment
+//getenv is usually os.Getenv, the YAML file is given with -config or the ENROBER_CONFIG environment variable
+func Load(args []string, getenv func(string) string) (*Config, error) {
+	c := Default()
+
+	fs := flag.NewFlagSet("enrober", flag.ContinueOnError)
+	configFile := fs.String("config", getenv("ENROBER_CONFIG"), "optional YAML configuration file")
+	flagValues := map[string]*flagValue{}
+	for _, s := range c.settings() {
+		_, isBool := s.value.(*bool)
+		flagValues[s.name] = &flagValue{isBool: isBool}
+		fs.Var(flagValues[s.name], s.name, s.usage+" ($"+s.env+")")
+	}
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if *configFile != "" {
+		err = c.loadFile(*configFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range c.settings() {
+		if raw := getenv(s.env); raw != "" {
+			if err := setValue(s.value, raw); err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", s.env, err)
+			}
+			c.set[s.name] = true
+		}
+		if fv := flagValues[s.name]; fv.set {
+			if err := setValue(s.value, fv.raw); err != nil {
+				return nil, fmt.Errorf("invalid -%s: %v", s.name, err)
+			}
+			c.set[s.name] = true
+		}
+	}
+
+	c.applyDeployState()
+
+	err = c.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+//loadFile reads a YAML file, only the settings it contains are changed
+func (c *Config) loadFile(path string) error {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %v", err)
+	}
+
+	err = yaml.UnmarshalStrict(raw, c)
+	if err != nil {
+		return fmt.Errorf("decoding config file %s: %v", path, err)
+	}
+
+	//Decode again to tell the settings whose default depends on the deploy state apart from zero values
+	var present struct {
+		Kubernetes map[string]interface{} `yaml:"kubernetes"`
+		Features   map[string]interface{} `yaml:"features"`
+	}
+	yaml.Unmarshal(raw, &present)
+	if _, ok := present.Kubernetes["master"]; ok {
+		c.set["master"] = true
+	}
+	if _, ok := present.Features["restrictPTSHost"]; ok {
+		c.set["restrict-pts-host"] = true
+	}
+	return nil
+}
+
+//applyDeployState fills the defaults that depend on the deploy state, unless they were set explicitly
+func (c *Config) applyDeployState() {
+	inCluster := c.DeployState == DeployStateProd || c.DeployState == DeployStateDevContainer
+	kubeconfig := c.Kubernetes.Kubeconfig != "" || c.Kubernetes.Context != ""
+	if !inCluster && !kubeconfig && !c.set["master"] {
+		c.Kubernetes.Master = "127.0.0.1:8080"
+	}
+	if c.DeployState == DeployStateProd && !c.set["restrict-pts-host"] {
+		c.Features.RestrictPTSHost = true
+	}
+}
+
+//Validate checks the configuration is consistent
+func (c *Config) Validate() error {
+	var problems []string
+
+	switch c.DeployState {
+	case "", DeployStateProd, DeployStateDevContainer, DeployStateDev:
+	default:
+		problems = append(problems, fmt.Sprintf("unknown deploy state %s, expected %s, %s or %s", c.DeployState, DeployStateProd, DeployStateDevContainer, DeployStateDev))
+	}
+
+	if c.HTTP.Address == "" {
+		problems = append(problems, "listen-address can't be empty")
+	}
+	if (c.HTTP.TLSCertFile == "") != (c.HTTP.TLSKeyFile == "") {
+		problems = append(problems, "tls-cert-file and tls-key-file must be given together")
+	}
+	if c.HTTP.ReadTimeout < 0 || c.HTTP.WriteTimeout < 0 || c.HTTP.IdleTimeout < 0 || c.HTTP.ShutdownTimeout < 0 {
+		problems = append(problems, "HTTP timeouts can't be negative")
+	}
+
+	k := c.Kubernetes
+	if k.Master == "" && k.Kubeconfig == "" && k.Context == "" {
+		if k.CertificateAuthority != "" || k.ClientCertificate != "" || k.ClientKey != "" || k.Token != "" || k.InsecureSkipTLSVerify {
+			problems = append(problems, "Kubernetes TLS and credential settings need master or kubeconfig")
+		}
+	}
+	if (k.ClientCertificate == "") != (k.ClientKey == "") {
+		problems = append(problems, "client-certificate and client-key must be given together")
+	}
+	if k.InsecureSkipTLSVerify && k.CertificateAuthority != "" {
+		problems = append(problems, "insecure-skip-tls-verify can't be used with certificate-authority")
+	}
+
+	switch c.Auth.Mode {
+	case AuthModeAuthSDK, AuthModeNone:
+	case AuthModeJWKS:
+		if c.Auth.JWKSFile == "" {
+			problems = append(problems, "jwks-file is required with auth-mode jwks")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown auth mode %s, expected %s, %s or %s", c.Auth.Mode, AuthModeAuthSDK, AuthModeJWKS, AuthModeNone))
+	}
+	if c.Auth.Mode == AuthModeNone && c.DeployState == DeployStateProd {
+		problems = append(problems, "auth-mode none can't be used with deploy-state PROD")
+	}
+
+	if c.Features.ApigeeKVM && c.Apigee.APIHost == "" {
+		problems = append(problems, "apigee-api-host is required with apigee-kvm")
+	}
+	if c.Apigee.Timeout <= 0 {
+		problems = append(problems, "apigee-timeout must be positive")
+	}
+
+	if c.PTS.ShipyardHost != "" && c.PTS.InternalRouterHost == "" {
+		problems = append(problems, "internal-router-host is required with shipyard-host")
+	}
+	if c.PTS.APIRoutingKeyHeader == "" {
+		problems = append(problems, "api-routing-key-header can't be empty")
+	}
+
+	if _, err := logging.ParseLevel(c.Logging.Level); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	switch c.Audit.Sink {
+	case AuditSinkStdout, AuditSinkEvent, AuditSinkNone:
+	case AuditSinkFile:
+		if c.Audit.File == "" {
+			problems = append(problems, "audit-file is required with audit-sink file")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown audit sink %s, expected %s, %s, %s or %s", c.Audit.Sink, AuditSinkStdout, AuditSinkFile, AuditSinkEvent, AuditSinkNone))
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+//Dump writes every setting as name=value, secrets are redacted
+func (c *Config) Dump(w io.Writer) {
+	fields := c.Fields()
+	for i := 0; i+1 < len(fields); i += 2 {
+		fmt.Fprintf(w, "%s=%s\n", fields[i], fields[i+1])
+	}
+}
+
+//Fields returns every setting as name value pairs for logging.Logger.With, secrets are redacted
+func (c *Config) Fields() []interface{} {
+	var fields []interface{}
+	for _, s := range c.settings() {
+		value := formatValue(s.value)
+		if s.secret && value != "" {
+			value = "<redacted>"
+		}
+		fields = append(fields, s.name, value)
+	}
+	return fields
+}
+
+//flagValue records the raw value of a flag so it can be applied after the YAML file and environment
+type flagValue struct {
+	raw    string
+	set    bool
+	isBool bool
+}
+
+func (f *flagValue) String() string {
+	return f.raw
+}
+
+func (f *flagValue) Set(raw string) error {
+	f.raw = raw
+	f.set = true
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool {
+	return f.isBool
+}
+
+func setValue(value interface{}, raw string) error {
+	switch value := value.(type) {
+	case *string:
+		*value = raw
+	case *bool:
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		*value = parsed
+	case *int:
+		parsed, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+		*value = parsed
+	case *time.Duration:
+		parsed, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		*value = parsed
+	default:
+		return fmt.Errorf("unsupported setting type %T", value)
+	}
+	return nil
+}
+
+func formatValue(value interface{}) string {
+	switch value := value.(type) {
+	case *string:
+		return *value
+	case *bool:
+		return strconv.FormatBool(*value)
+	case *int:
+		return strconv.Itoa(*value)
+	case *time.Duration:
+		return value.String()
+	default:
+		return fmt.Sprintf("%v", value)
+	}
+}
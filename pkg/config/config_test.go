@@ -0,0 +1,216 @@
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func env(values map[string]string) func(string) string {
+	return func(name string) string {
+		return values[name]
+	}
+}
+
+//writeFile writes a YAML config file, the caller removes it
+func writeFile(t *testing.T, content string) string {
+	file, err := ioutil.TempFile("", "enrober-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	_, err = file.WriteString(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+func TestDefaults(t *testing.T) {
+	cfg, err := Load(nil, env(nil))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.Kubernetes.Master != "127.0.0.1:8080" {
+		t.Errorf("Kubernetes.Master = %q, want the local proxy", cfg.Kubernetes.Master)
+	}
+	if cfg.Features.RestrictPTSHost || cfg.Features.ApigeeKVM || cfg.Features.IsolateNamespace {
+		t.Errorf("Features = %+v, want everything off", cfg.Features)
+	}
+	if cfg.PTS.APIRoutingKeyHeader != "X-ROUTING-API-KEY" {
+		t.Errorf("PTS.APIRoutingKeyHeader = %q", cfg.PTS.APIRoutingKeyHeader)
+	}
+}
+
+func TestDeployStateDefaults(t *testing.T) {
+	cfg, err := Load(nil, env(map[string]string{"DEPLOY_STATE": "PROD"}))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.Kubernetes.Master != "" {
+		t.Errorf("Kubernetes.Master = %q, want in-cluster", cfg.Kubernetes.Master)
+	}
+	if !cfg.Features.RestrictPTSHost {
+		t.Error("RestrictPTSHost should default to true in PROD")
+	}
+
+	//Features are independent of the deploy state
+	cfg, err = Load([]string{"-restrict-pts-host=false", "-isolate-namespace"}, env(map[string]string{"DEPLOY_STATE": "PROD"}))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.Features.RestrictPTSHost {
+		t.Error("RestrictPTSHost should be disabled by the flag")
+	}
+	if !cfg.Features.IsolateNamespace {
+		t.Error("IsolateNamespace should be enabled by the flag")
+	}
+
+	cfg, err = Load(nil, env(map[string]string{"ISOLATE_NAMESPACE": "true"}))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !cfg.Features.IsolateNamespace {
+		t.Error("IsolateNamespace should be enabled outside PROD")
+	}
+}
+
+func TestKubeconfig(t *testing.T) {
+	//A kubeconfig replaces the kubectl proxy default
+	cfg, err := Load([]string{"-kubeconfig", "/home/dev/.kube/config", "-context", "staging"}, env(nil))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.Kubernetes.Master != "" {
+		t.Errorf("Kubernetes.Master = %q, want the kubeconfig's", cfg.Kubernetes.Master)
+	}
+
+	cfg, err = Load([]string{"-master", "https://kube:6443", "-token", "t0ken", "-certificate-authority", "ca.crt"}, env(map[string]string{"DEPLOY_STATE": "PROD"}))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.Kubernetes.Master != "https://kube:6443" || cfg.Kubernetes.Token != "t0ken" {
+		t.Errorf("Kubernetes = %+v", cfg.Kubernetes)
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	path := writeFile(t, `
+kubernetes:
+  master: file-host
+apigee:
+  apiHost: file-apigee
+  timeout: 5s
+pts:
+  shipyardHost: file-shipyard
+  internalRouterHost: file-router
+`)
+	defer os.Remove(path)
+
+	cfg, err := Load([]string{"-config", path, "-master", "flag-host"}, env(map[string]string{
+		"KUBE_MASTER":   "env-host",
+		"AUTH_API_HOST": "env-apigee",
+	}))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.Kubernetes.Master != "flag-host" {
+		t.Errorf("Kubernetes.Master = %q, flags should win", cfg.Kubernetes.Master)
+	}
+	if cfg.Apigee.APIHost != "env-apigee" {
+		t.Errorf("Apigee.APIHost = %q, env should win over the file", cfg.Apigee.APIHost)
+	}
+	if cfg.Apigee.Timeout != 5*time.Second {
+		t.Errorf("Apigee.Timeout = %v, want the file value", cfg.Apigee.Timeout)
+	}
+	if cfg.PTS.ShipyardHost != "file-shipyard" {
+		t.Errorf("PTS.ShipyardHost = %q, want the file value", cfg.PTS.ShipyardHost)
+	}
+	if cfg.Apigee.Retries != 2 {
+		t.Errorf("Apigee.Retries = %d, unset values should keep their default", cfg.Apigee.Retries)
+	}
+
+	//A master set in the file isn't replaced by the in-cluster default
+	path = writeFile(t, "deployState: PROD\nkubernetes:\n  master: file-host\n")
+	defer os.Remove(path)
+	cfg, err = Load([]string{"-config", path}, env(nil))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.Kubernetes.Master != "file-host" {
+		t.Errorf("Kubernetes.Master = %q, want the file value", cfg.Kubernetes.Master)
+	}
+}
+
+func TestApigeeZeroDisables(t *testing.T) {
+	//0 turns retries and the organization cache off so it has to survive loading rather than fall back to the default
+	cfg, err := Load([]string{"-apigee-org-cache-ttl", "0s"}, env(map[string]string{"APIGEE_RETRIES": "0"}))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.Apigee.Retries != 0 {
+		t.Errorf("Apigee.Retries = %d, want 0", cfg.Apigee.Retries)
+	}
+	if cfg.Apigee.OrgCacheTTL != 0 {
+		t.Errorf("Apigee.OrgCacheTTL = %v, want 0", cfg.Apigee.OrgCacheTTL)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		file string
+	}{
+		{name: "deploy state", env: map[string]string{"DEPLOY_STATE": "STAGING"}},
+		{name: "auth mode", args: []string{"-auth-mode", "basic"}},
+		{name: "jwks without file", args: []string{"-auth-mode", "jwks"}},
+		{name: "no auth in PROD", env: map[string]string{"DEPLOY_STATE": "PROD", "AUTH_MODE": "none"}},
+		{name: "shipyard without router", env: map[string]string{"SHIPYARD_HOST": "shipyard"}},
+		{name: "bad bool", env: map[string]string{"APIGEE_KVM": "yes please"}},
+		{name: "bad duration", args: []string{"-apigee-timeout", "soon"}},
+		{name: "unknown flag", args: []string{"-unknown"}},
+		{name: "credentials without master", env: map[string]string{"DEPLOY_STATE": "PROD", "KUBE_TOKEN": "token"}},
+		{name: "client certificate without key", args: []string{"-master", "https://kube", "-client-certificate", "client.crt"}},
+		{name: "insecure with a CA", args: []string{"-master", "https://kube", "-certificate-authority", "ca.crt", "-insecure-skip-tls-verify"}},
+		{name: "log level", env: map[string]string{"LOG_LEVEL": "verbose"}},
+		{name: "audit sink", args: []string{"-audit-sink", "syslog"}},
+		{name: "audit file sink without file", env: map[string]string{"AUDIT_SINK": "file"}},
+		{name: "unknown file key", file: "features:\n  isolate: true\n"},
+	}
+	for _, test := range tests {
+		args := test.args
+		if test.file != "" {
+			path := writeFile(t, test.file)
+			defer os.Remove(path)
+			args = append(args, "-config", path)
+		}
+		_, err := Load(args, env(test.env))
+		if err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestDumpRedactsSecrets(t *testing.T) {
+	cfg, err := Load([]string{"-shipyard-private-secret", "hunter2", "-master", "https://kube", "-token", "t0ken"}, env(nil))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	var out bytes.Buffer
+	cfg.Dump(&out)
+	if strings.Contains(out.String(), "hunter2") || strings.Contains(out.String(), "t0ken") {
+		t.Errorf("Dump leaked a secret:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "shipyard-private-secret=<redacted>\n") {
+		t.Errorf("Dump should show the secret is set:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "master=https://kube\n") {
+		t.Errorf("Dump should show other settings:\n%s", out.String())
+	}
+}
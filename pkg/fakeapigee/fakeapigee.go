@@ -0,0 +1,312 @@
+//Package fakeapigee is an in-memory fake of the Apigee management API endpoints enrober uses.
+//It is meant to be run as an httptest.Server so the KVM flows can be tested offline.
+package fakeapigee
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/30x/enrober/pkg/apigee"
+)
+
+//API holds the state of the fake Apigee and serves its management API under /v1
+type API struct {
+	lock sync.Mutex
+
+	//org name -> organization
+	orgs map[string]*apigee.Organization
+
+	//org/env/name -> key value map
+	kvms map[string]*apigee.KVM
+
+	//statuses returned, in order, instead of handling the next requests
+	failures []int
+
+	//every request handled as "METHOD path"
+	calls []string
+}
+
+//NewAPI returns a fake Apigee without any organizations
+func NewAPI() *API {
+	return &API{
+		orgs: make(map[string]*apigee.Organization),
+		kvms: make(map[string]*apigee.KVM),
+	}
+}
+
+//NewServer starts a fake Apigee behind an httptest.Server
+//Point an apigee.Client at the server URL followed by /v1
+//The caller is responsible for closing the returned server
+func NewServer() (*API, *httptest.Server) {
+	api := NewAPI()
+	return api, httptest.NewServer(api)
+}
+
+//AddOrganization adds an organization, cps sets its features.isCpsEnabled property
+func (a *API) AddOrganization(name string, cps bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	org := &apigee.Organization{Name: name}
+	org.Properties.Property = []apigee.Property{
+		{Name: apigee.CPSProperty, Value: fmt.Sprintf("%t", cps)},
+	}
+	a.orgs[name] = org
+}
+
+//KVM returns a copy of a key value map
+func (a *API) KVM(org, env, name string) (apigee.KVM, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	kvm, ok := a.kvms[kvmKey(org, env, name)]
+	if !ok {
+		return apigee.KVM{}, false
+	}
+	return copyKVM(kvm), true
+}
+
+//FailNext makes the next requests fail with the given statuses, one per request
+func (a *API) FailNext(statuses ...int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.failures = append(a.failures, statuses...)
+}
+
+//Calls returns every request handled so far as "METHOD path"
+func (a *API) Calls() []string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return append([]string(nil), a.calls...)
+}
+
+//request is a parsed management API path
+type request struct {
+	org   string
+	env   string
+	kvm   string
+	entry string
+	//entries is true for paths under /entries
+	entries bool
+	//kvms is true for paths under /keyvaluemaps
+	kvms bool
+}
+
+//parsePath splits a management API path into its parts
+func parsePath(path string) (request, bool) {
+	if !strings.HasPrefix(path, "/v1/organizations/") {
+		return request{}, false
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(path, "/v1/organizations/"), "/"), "/")
+
+	var req request
+	req.org = parts[0]
+	if len(parts) == 1 {
+		return req, true
+	}
+	if len(parts) < 4 || parts[1] != "environments" || parts[3] != "keyvaluemaps" {
+		return request{}, false
+	}
+	req.env, req.kvms = parts[2], true
+
+	switch len(parts) {
+	case 4:
+	case 5:
+		req.kvm = parts[4]
+	case 6, 7:
+		if parts[5] != "entries" {
+			return request{}, false
+		}
+		req.kvm, req.entries = parts[4], true
+		if len(parts) == 7 {
+			req.entry = parts[6]
+		}
+	default:
+		return request{}, false
+	}
+	return req, true
+}
+
+//ServeHTTP implements http.Handler
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.calls = append(a.calls, r.Method+" "+r.URL.Path)
+
+	if len(a.failures) > 0 {
+		status := a.failures[0]
+		a.failures = a.failures[1:]
+		writeError(w, status, "fake.Failure", "injected failure")
+		return
+	}
+
+	if r.Header.Get("Authorization") == "" {
+		writeError(w, http.StatusUnauthorized, "security.Unauthorized", "missing Authorization header")
+		return
+	}
+
+	req, ok := parsePath(r.URL.Path)
+	if !ok {
+		writeError(w, http.StatusNotFound, "NotFound", fmt.Sprintf("no resource at %s", r.URL.Path))
+		return
+	}
+
+	org, ok := a.orgs[req.org]
+	if !ok {
+		writeError(w, http.StatusNotFound, "organizations.OrganizationDoesNotExist", fmt.Sprintf("Organization : %s does not exist", req.org))
+		return
+	}
+
+	switch {
+	case !req.kvms && r.Method == "GET":
+		writeJSON(w, http.StatusOK, org)
+	case req.entries:
+		a.serveEntries(w, r, req, org.CPSEnabled())
+	case req.kvm == "" && r.Method == "POST":
+		a.createKVM(w, r, req)
+	case req.kvm != "" && r.Method == "GET":
+		kvm, ok := a.kvms[kvmKey(req.org, req.env, req.kvm)]
+		if !ok {
+			writeKVMNotFound(w, req.kvm)
+			return
+		}
+		writeJSON(w, http.StatusOK, kvm)
+	case req.kvm != "" && r.Method == "POST":
+		a.updateKVM(w, r, req, org.CPSEnabled())
+	case req.kvm != "" && r.Method == "DELETE":
+		kvm, ok := a.kvms[kvmKey(req.org, req.env, req.kvm)]
+		if !ok {
+			writeKVMNotFound(w, req.kvm)
+			return
+		}
+		delete(a.kvms, kvmKey(req.org, req.env, req.kvm))
+		writeJSON(w, http.StatusOK, kvm)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", fmt.Sprintf("%s is not supported on %s", r.Method, r.URL.Path))
+	}
+}
+
+func (a *API) createKVM(w http.ResponseWriter, r *http.Request, req request) {
+	var kvm apigee.KVM
+	if err := json.NewDecoder(r.Body).Decode(&kvm); err != nil || kvm.Name == "" {
+		writeError(w, http.StatusBadRequest, "messaging.adaptors.http.flow.ErrorResponseCode", "invalid key value map")
+		return
+	}
+	if _, ok := a.kvms[kvmKey(req.org, req.env, kvm.Name)]; ok {
+		writeError(w, http.StatusConflict, "keyvaluemap.service.KeyValueMapAlreadyExists", fmt.Sprintf("keyvaluemap %s already exists", kvm.Name))
+		return
+	}
+	a.kvms[kvmKey(req.org, req.env, kvm.Name)] = &kvm
+	writeJSON(w, http.StatusCreated, kvm)
+}
+
+//updateKVM replaces every entry of a map, like Apigee this only works on non CPS orgs
+func (a *API) updateKVM(w http.ResponseWriter, r *http.Request, req request, cps bool) {
+	if cps {
+		writeError(w, http.StatusBadRequest, "keyvaluemap.service.UpdateNotSupported", "updating a whole key value map is not supported with CPS")
+		return
+	}
+	existing, ok := a.kvms[kvmKey(req.org, req.env, req.kvm)]
+	if !ok {
+		writeKVMNotFound(w, req.kvm)
+		return
+	}
+	var kvm apigee.KVM
+	if err := json.NewDecoder(r.Body).Decode(&kvm); err != nil {
+		writeError(w, http.StatusBadRequest, "messaging.adaptors.http.flow.ErrorResponseCode", "invalid key value map")
+		return
+	}
+	existing.Entry = kvm.Entry
+	writeJSON(w, http.StatusOK, existing)
+}
+
+//serveEntries handles the entry endpoints which only exist on CPS orgs
+func (a *API) serveEntries(w http.ResponseWriter, r *http.Request, req request, cps bool) {
+	if !cps {
+		writeError(w, http.StatusNotFound, "NotFound", "key value map entries are only supported with CPS")
+		return
+	}
+	kvm, ok := a.kvms[kvmKey(req.org, req.env, req.kvm)]
+	if !ok {
+		writeKVMNotFound(w, req.kvm)
+		return
+	}
+
+	if req.entry == "" {
+		if r.Method != "POST" {
+			writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", fmt.Sprintf("%s is not supported on %s", r.Method, r.URL.Path))
+			return
+		}
+		var entry apigee.KVMEntry
+		if err := json.NewDecoder(r.Body).Decode(&entry); err != nil || entry.Name == "" {
+			writeError(w, http.StatusBadRequest, "messaging.adaptors.http.flow.ErrorResponseCode", "invalid entry")
+			return
+		}
+		if _, ok := kvm.GetEntry(entry.Name); ok {
+			writeError(w, http.StatusConflict, "keyvaluemap.service.EntryAlreadyExists", fmt.Sprintf("entry %s already exists", entry.Name))
+			return
+		}
+		kvm.SetEntry(entry)
+		writeJSON(w, http.StatusCreated, entry)
+		return
+	}
+
+	entry, ok := kvm.GetEntry(req.entry)
+	if !ok {
+		writeError(w, http.StatusNotFound, "keyvaluemap.service.EntryDoesNotExist", fmt.Sprintf("entry %s does not exist", req.entry))
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, entry)
+	case "POST":
+		var updated apigee.KVMEntry
+		if err := json.NewDecoder(r.Body).Decode(&updated); err != nil {
+			writeError(w, http.StatusBadRequest, "messaging.adaptors.http.flow.ErrorResponseCode", "invalid entry")
+			return
+		}
+		entry.Value = updated.Value
+		writeJSON(w, http.StatusOK, entry)
+	case "DELETE":
+		deleted := *entry
+		kvm.RemoveEntry(req.entry)
+		writeJSON(w, http.StatusOK, deleted)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", fmt.Sprintf("%s is not supported on %s", r.Method, r.URL.Path))
+	}
+}
+
+func kvmKey(org, env, name string) string {
+	return org + "/" + env + "/" + name
+}
+
+func copyKVM(kvm *apigee.KVM) apigee.KVM {
+	copied := *kvm
+	copied.Entry = append([]apigee.KVMEntry(nil), kvm.Entry...)
+	return copied
+}
+
+func writeKVMNotFound(w http.ResponseWriter, name string) {
+	writeError(w, http.StatusNotFound, "keyvaluemap.service.KeyValueMapDoesNotExist", fmt.Sprintf("keyvaluemap %s does not exist", name))
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, map[string]string{
+		"code":    code,
+		"message": message,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
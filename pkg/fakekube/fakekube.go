@@ -0,0 +1,775 @@
+//Package fakekube is an in-memory fake of the Kubernetes REST endpoints enrober uses.
+//It is meant to be run as an httptest.Server so the API can be tested without a cluster.
+package fakekube
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	coreGroupVersion       = "v1"
+	extensionsGroupVersion = "extensions/v1beta1"
+
+	revisionAnnotation = "deployment.kubernetes.io/revision"
+	podTemplateHashKey = "pod-template-hash"
+)
+
+//object is a decoded Kubernetes API object
+type object map[string]interface{}
+
+//resource describes one REST resource served by the fake
+type resource struct {
+	kind       string
+	apiVersion string
+	namespaced bool
+}
+
+var resources = map[string]resource{
+	"namespaces":  {kind: "Namespace", apiVersion: coreGroupVersion},
+	"secrets":     {kind: "Secret", apiVersion: coreGroupVersion, namespaced: true},
+	"pods":        {kind: "Pod", apiVersion: coreGroupVersion, namespaced: true},
+	"services":    {kind: "Service", apiVersion: coreGroupVersion, namespaced: true},
+	"deployments": {kind: "Deployment", apiVersion: extensionsGroupVersion, namespaced: true},
+	"replicasets": {kind: "ReplicaSet", apiVersion: extensionsGroupVersion, namespaced: true},
+	"events":      {kind: "Event", apiVersion: coreGroupVersion, namespaced: true},
+}
+
+//Cluster holds the state of the fake cluster and serves its REST API
+type Cluster struct {
+	lock sync.Mutex
+
+	//resource -> namespace/name -> object
+	store map[string]map[string]object
+
+	resourceVersion int
+
+	//last octet handed out as a service cluster IP
+	serviceIPs int
+
+	//recent changes, for watches started from an older resourceVersion
+	history []watchEvent
+	//resourceVersion of the last change dropped from the history
+	expiredVersion int
+	watchers       map[*watcher]bool
+
+	//"METHOD resource" -> statuses returned, in order, instead of handling the next matching requests
+	failures map[string][]int
+}
+
+//NewCluster returns a fake cluster holding only the default namespace, like a new cluster
+func NewCluster() *Cluster {
+	store := make(map[string]map[string]object)
+	for name := range resources {
+		store[name] = make(map[string]object)
+	}
+	cluster := &Cluster{
+		store:    store,
+		watchers: make(map[*watcher]bool),
+		failures: make(map[string][]int),
+	}
+	cluster.add("namespaces", "", object{
+		"metadata": object{
+			"name": "default",
+		},
+	})
+	return cluster
+}
+
+//NewServer starts a fake cluster behind an httptest.Server
+//The caller is responsible for closing the returned server
+func NewServer() (*Cluster, *httptest.Server) {
+	cluster := NewCluster()
+	return cluster, httptest.NewServer(cluster)
+}
+
+//FailNext makes the next requests with the given method on a resource fail with the given statuses, one per request
+func (c *Cluster) FailNext(method, resourceName string, statuses ...int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	operation := method + " " + resourceName
+	c.failures[operation] = append(c.failures[operation], statuses...)
+}
+
+//request is a parsed REST path
+type request struct {
+	resource    string
+	namespace   string
+	name        string
+	subresource string
+	watch       bool
+}
+
+//parsePath splits a REST path into resource, namespace, name and subresource
+func parsePath(path string) (request, bool) {
+	switch {
+	case strings.HasPrefix(path, "/api/"+coreGroupVersion+"/"):
+		path = strings.TrimPrefix(path, "/api/"+coreGroupVersion+"/")
+	case strings.HasPrefix(path, "/apis/"+extensionsGroupVersion+"/"):
+		path = strings.TrimPrefix(path, "/apis/"+extensionsGroupVersion+"/")
+	default:
+		return request{}, false
+	}
+
+	var req request
+	if strings.HasPrefix(path, "watch/") {
+		path = strings.TrimPrefix(path, "watch/")
+		req.watch = true
+	}
+
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+
+	switch {
+	case len(parts) == 1:
+		req.resource = parts[0]
+	case len(parts) == 2 && parts[0] == "namespaces":
+		req.resource, req.name = "namespaces", parts[1]
+	case len(parts) == 3 && parts[0] == "namespaces" && (parts[2] == "status" || parts[2] == "finalize"):
+		req.resource, req.name, req.subresource = "namespaces", parts[1], parts[2]
+	case len(parts) >= 3 && parts[0] == "namespaces":
+		req.namespace, req.resource = parts[1], parts[2]
+		if len(parts) > 3 {
+			req.name = parts[3]
+		}
+		if len(parts) > 4 {
+			req.subresource = parts[4]
+		}
+	default:
+		return request{}, false
+	}
+
+	if _, ok := resources[req.resource]; !ok {
+		return request{}, false
+	}
+	return req, true
+}
+
+//ServeHTTP implements http.Handler
+func (c *Cluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req, ok := parsePath(r.URL.Path)
+	if !ok {
+		writeStatus(w, http.StatusNotFound, "NotFound", fmt.Sprintf("the server could not find the requested resource (%s)", r.URL.Path))
+		return
+	}
+
+	//Watches stream for a long time so they take the lock only when needed
+	if req.name == "" && r.Method == "GET" && (req.watch || r.URL.Query().Get("watch") == "true") {
+		c.watch(w, r, req)
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	operation := r.Method + " " + req.resource
+	if statuses := c.failures[operation]; len(statuses) > 0 {
+		c.failures[operation] = statuses[1:]
+		writeStatus(w, statuses[0], "InternalError", "injected failure")
+		return
+	}
+
+	switch {
+	case req.resource == "pods" && req.subresource == "log" && r.Method == "GET":
+		c.podLogs(w, r, req)
+	case req.name == "" && r.Method == "GET":
+		c.list(w, r, req)
+	case req.name == "" && r.Method == "POST":
+		c.create(w, r, req)
+	case req.name != "" && r.Method == "GET":
+		c.get(w, req)
+	case req.name != "" && r.Method == "PUT":
+		c.update(w, r, req)
+	case req.name != "" && r.Method == "DELETE":
+		c.delete(w, req)
+	default:
+		writeStatus(w, http.StatusMethodNotAllowed, "MethodNotAllowed", fmt.Sprintf("%s is not supported on %s", r.Method, r.URL.Path))
+	}
+}
+
+func (c *Cluster) list(w http.ResponseWriter, r *http.Request, req request) {
+	selector, err := parseSelector(r.URL.Query().Get("labelSelector"))
+	if err != nil {
+		writeStatus(w, http.StatusBadRequest, "BadRequest", err.Error())
+		return
+	}
+
+	items := []object{}
+	for _, obj := range c.store[req.resource] {
+		if req.namespace != "" && namespaceOf(obj) != req.namespace {
+			continue
+		}
+		if selector.matches(labelsOf(obj)) {
+			items = append(items, obj)
+		}
+	}
+	sort.Sort(byName(items))
+
+	res := resources[req.resource]
+	writeJSON(w, http.StatusOK, object{
+		"kind":       res.kind + "List",
+		"apiVersion": res.apiVersion,
+		"metadata": object{
+			"resourceVersion": strconv.Itoa(c.resourceVersion),
+		},
+		"items": items,
+	})
+}
+
+func (c *Cluster) get(w http.ResponseWriter, req request) {
+	obj, ok := c.store[req.resource][key(req.namespace, req.name)]
+	if !ok {
+		writeNotFound(w, req.resource, req.name)
+		return
+	}
+	writeJSON(w, http.StatusOK, obj)
+}
+
+func (c *Cluster) create(w http.ResponseWriter, r *http.Request, req request) {
+	obj, err := decode(r)
+	if err != nil {
+		writeStatus(w, http.StatusBadRequest, "BadRequest", err.Error())
+		return
+	}
+
+	if resources[req.resource].namespaced {
+		if _, ok := c.store["namespaces"][key("", req.namespace)]; !ok {
+			writeNotFound(w, "namespaces", req.namespace)
+			return
+		}
+	}
+
+	name := nameOf(obj)
+	if name == "" {
+		writeStatus(w, http.StatusUnprocessableEntity, "Invalid", fmt.Sprintf("%s: metadata.name is required", req.resource))
+		return
+	}
+	if _, ok := c.store[req.resource][key(req.namespace, name)]; ok {
+		writeStatus(w, http.StatusConflict, "AlreadyExists", fmt.Sprintf("%s \"%s\" already exists", req.resource, name))
+		return
+	}
+
+	//Services get a cluster IP allocated like the real API server does
+	if req.resource == "services" {
+		if spec := specOf(obj); spec["clusterIP"] == nil || spec["clusterIP"] == "" {
+			c.serviceIPs++
+			spec["clusterIP"] = fmt.Sprintf("10.0.%d.%d", c.serviceIPs/256, c.serviceIPs%256)
+		}
+	}
+
+	created := c.add(req.resource, req.namespace, obj)
+
+	c.notify(eventAdded, req.resource, created)
+
+	if req.resource == "deployments" {
+		created = c.syncDeployment(created)
+	}
+
+	writeJSON(w, http.StatusCreated, created)
+}
+
+func (c *Cluster) update(w http.ResponseWriter, r *http.Request, req request) {
+	obj, err := decode(r)
+	if err != nil {
+		writeStatus(w, http.StatusBadRequest, "BadRequest", err.Error())
+		return
+	}
+
+	old, ok := c.store[req.resource][key(req.namespace, req.name)]
+	if !ok {
+		writeNotFound(w, req.resource, req.name)
+		return
+	}
+
+	//Optimistic concurrency just like the real API server
+	if rv := metadataOf(obj)["resourceVersion"]; rv != nil && rv != "" && rv != metadataOf(old)["resourceVersion"] {
+		writeStatus(w, http.StatusConflict, "Conflict", fmt.Sprintf("Operation cannot be fulfilled on %s \"%s\": the object has been modified; please apply your changes to the latest version and try again", req.resource, req.name))
+		return
+	}
+
+	meta := metadataOf(obj)
+	oldMeta := metadataOf(old)
+	for _, field := range []string{"uid", "creationTimestamp", "namespace", "generation"} {
+		if value, ok := oldMeta[field]; ok {
+			meta[field] = value
+		}
+	}
+
+	//Spec changes bump the generation
+	if specChanged(old, obj) {
+		meta["generation"] = generationOf(old) + 1
+	}
+
+	c.stamp(req.resource, obj)
+	c.store[req.resource][key(req.namespace, req.name)] = obj
+	c.notify(eventModified, req.resource, obj)
+
+	if req.resource == "deployments" {
+		obj = c.syncDeployment(obj)
+	}
+
+	writeJSON(w, http.StatusOK, obj)
+}
+
+func (c *Cluster) delete(w http.ResponseWriter, req request) {
+	obj, ok := c.store[req.resource][key(req.namespace, req.name)]
+	if !ok {
+		writeNotFound(w, req.resource, req.name)
+		return
+	}
+	c.remove(req.resource, req.namespace, obj)
+
+	//Namespace deletion removes everything inside of it
+	if req.resource == "namespaces" {
+		for name, res := range resources {
+			if !res.namespaced {
+				continue
+			}
+			for _, obj := range c.store[name] {
+				if namespaceOf(obj) == req.name {
+					c.remove(name, req.name, obj)
+				}
+			}
+		}
+	}
+
+	writeJSON(w, http.StatusOK, object{
+		"kind":       "Status",
+		"apiVersion": coreGroupVersion,
+		"metadata":   object{},
+		"status":     "Success",
+		"code":       http.StatusOK,
+	})
+}
+
+func (c *Cluster) podLogs(w http.ResponseWriter, r *http.Request, req request) {
+	pod, ok := c.store["pods"][key(req.namespace, req.name)]
+	if !ok {
+		writeNotFound(w, "pods", req.name)
+		return
+	}
+
+	//Like the real API server the container has to be named when the pod has several
+	containers := containersOf(pod)
+	if container := r.URL.Query().Get("container"); container != "" {
+		containers = []string{container}
+	} else if len(containers) > 1 {
+		writeStatus(w, http.StatusBadRequest, "BadRequest", fmt.Sprintf("a container name must be specified for pod %s, choose one of: %v", req.name, containers))
+		return
+	}
+
+	var lines []string
+	for _, container := range containers {
+		lines = append(lines, fmt.Sprintf("%s/%s started", req.name, container))
+	}
+
+	if tail := r.URL.Query().Get("tailLines"); tail != "" {
+		n, err := strconv.Atoi(tail)
+		if err == nil && n < len(lines) {
+			lines = lines[len(lines)-n:]
+		}
+	}
+
+	if r.URL.Query().Get("timestamps") == "true" {
+		created, _ := metadataOf(pod)["creationTimestamp"].(string)
+		for i, line := range lines {
+			lines[i] = created + " " + line
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+}
+
+//add stores a new object after filling in the server populated metadata
+func (c *Cluster) add(resourceName, namespace string, obj object) object {
+	res := resources[resourceName]
+
+	meta := metadataOf(obj)
+	if res.namespaced {
+		meta["namespace"] = namespace
+	}
+	meta["uid"] = fmt.Sprintf("fake-uid-%d", c.resourceVersion+1)
+	meta["creationTimestamp"] = time.Now().UTC().Format(time.RFC3339)
+	meta["generation"] = 1
+
+	//Deployments default their labels to the template labels
+	if resourceName == "deployments" && meta["labels"] == nil {
+		if template, ok := specOf(obj)["template"].(map[string]interface{}); ok {
+			if templateMeta, ok := template["metadata"].(map[string]interface{}); ok {
+				meta["labels"] = templateMeta["labels"]
+			}
+		}
+	}
+
+	c.stamp(resourceName, obj)
+	c.store[resourceName][key(namespace, nameOf(obj))] = obj
+	return obj
+}
+
+//remove deletes an object, the deletion gets a resourceVersion of its own like with the real API server
+func (c *Cluster) remove(resourceName, namespace string, obj object) {
+	delete(c.store[resourceName], key(namespace, nameOf(obj)))
+	c.stamp(resourceName, obj)
+	c.notify(eventDeleted, resourceName, obj)
+}
+
+//stamp sets the type information and a new resourceVersion on an object
+func (c *Cluster) stamp(resourceName string, obj object) {
+	res := resources[resourceName]
+	c.resourceVersion++
+	obj["kind"] = res.kind
+	obj["apiVersion"] = res.apiVersion
+	metadataOf(obj)["resourceVersion"] = strconv.Itoa(c.resourceVersion)
+}
+
+//syncDeployment plays the part of the deployment controller
+//It makes sure a replica set and pods exist for the current template and records the rollout in the status
+func (c *Cluster) syncDeployment(dep object) object {
+	namespace := namespaceOf(dep)
+	depName := nameOf(dep)
+	spec := specOf(dep)
+
+	replicas := 1
+	if value, ok := spec["replicas"].(float64); ok {
+		replicas = int(value)
+	} else if value, ok := spec["replicas"].(int); ok {
+		replicas = value
+	}
+
+	template, _ := spec["template"].(map[string]interface{})
+	templateJSON, _ := json.Marshal(template)
+	hasher := fnv.New32a()
+	hasher.Write(templateJSON)
+	hash := strconv.FormatUint(uint64(hasher.Sum32()), 10)
+	rsName := depName + "-" + hash
+
+	//Find the replica sets owned by this deployment and the highest revision
+	maxRevision := 0
+	var owned []object
+	for _, rs := range c.store["replicasets"] {
+		if namespaceOf(rs) != namespace || !ownedBy(nameOf(rs), depName, 1) {
+			continue
+		}
+		owned = append(owned, rs)
+		if revision, err := strconv.Atoi(annotationsOf(rs)[revisionAnnotation]); err == nil && revision > maxRevision {
+			maxRevision = revision
+		}
+	}
+
+	podLabels := make(map[string]interface{})
+	if templateMeta, ok := template["metadata"].(map[string]interface{}); ok {
+		if templateLabels, ok := templateMeta["labels"].(map[string]interface{}); ok {
+			for k, v := range templateLabels {
+				podLabels[k] = v
+			}
+		}
+	}
+	podLabels[podTemplateHashKey] = hash
+
+	revision := maxRevision
+	current, ok := c.store["replicasets"][key(namespace, rsName)]
+	if !ok || annotationsOf(current)[revisionAnnotation] != strconv.Itoa(maxRevision) {
+		revision = maxRevision + 1
+	}
+
+	if !ok {
+		current = c.add("replicasets", namespace, object{
+			"metadata": object{
+				"name":   rsName,
+				"labels": podLabels,
+			},
+			"spec": object{
+				"replicas": replicas,
+				"selector": object{
+					"matchLabels": podLabels,
+				},
+				"template": template,
+			},
+		})
+	}
+	metadataOf(current)["annotations"] = map[string]interface{}{
+		revisionAnnotation: strconv.Itoa(revision),
+	}
+	specOf(current)["replicas"] = replicas
+	current["status"] = object{
+		"replicas":           replicas,
+		"observedGeneration": 1,
+	}
+	c.stamp("replicasets", current)
+
+	//Scale the old replica sets down
+	for _, rs := range owned {
+		if nameOf(rs) == rsName {
+			continue
+		}
+		specOf(rs)["replicas"] = 0
+		rs["status"] = object{
+			"replicas": 0,
+		}
+		c.stamp("replicasets", rs)
+	}
+
+	//Replace the pods so only the current template is running
+	running := 0
+	for k, pod := range c.store["pods"] {
+		if namespaceOf(pod) != namespace || !ownedBy(nameOf(pod), depName, 2) {
+			continue
+		}
+		if labelsOf(pod)[podTemplateHashKey] != hash || running >= replicas {
+			delete(c.store["pods"], k)
+			continue
+		}
+		running++
+	}
+	for i := 0; running < replicas; i++ {
+		podName := fmt.Sprintf("%s-%d", rsName, c.resourceVersion+i)
+		if _, ok := c.store["pods"][key(namespace, podName)]; ok {
+			continue
+		}
+		c.add("pods", namespace, object{
+			"metadata": object{
+				"name":   podName,
+				"labels": podLabels,
+			},
+			"spec": template["spec"],
+			"status": object{
+				"phase": "Running",
+				"conditions": []interface{}{
+					object{"type": "Ready", "status": "True"},
+				},
+			},
+		})
+		running++
+	}
+
+	annotations := annotationsOf(dep)
+	annotations[revisionAnnotation] = strconv.Itoa(revision)
+	metadataOf(dep)["annotations"] = annotations
+	dep["status"] = object{
+		"observedGeneration":  generationOf(dep),
+		"replicas":            replicas,
+		"updatedReplicas":     replicas,
+		"availableReplicas":   replicas,
+		"unavailableReplicas": 0,
+	}
+	c.stamp("deployments", dep)
+	return dep
+}
+
+//selector is a parsed equality based label selector
+type selector []requirement
+
+type requirement struct {
+	key    string
+	value  string
+	negate bool
+	exists bool
+}
+
+//parseSelector parses the subset of label selector syntax the client sends
+func parseSelector(raw string) (selector, error) {
+	var sel selector
+	if raw == "" {
+		return sel, nil
+	}
+	for _, term := range strings.Split(raw, ",") {
+		term = strings.TrimSpace(term)
+		switch {
+		case strings.Contains(term, "!="):
+			parts := strings.SplitN(term, "!=", 2)
+			sel = append(sel, requirement{key: parts[0], value: parts[1], negate: true})
+		case strings.Contains(term, "=="):
+			parts := strings.SplitN(term, "==", 2)
+			sel = append(sel, requirement{key: parts[0], value: parts[1]})
+		case strings.Contains(term, "="):
+			parts := strings.SplitN(term, "=", 2)
+			sel = append(sel, requirement{key: parts[0], value: parts[1]})
+		case term != "" && !strings.ContainsAny(term, " ()"):
+			sel = append(sel, requirement{key: term, exists: true})
+		default:
+			return nil, fmt.Errorf("unsupported label selector: %s", raw)
+		}
+	}
+	return sel, nil
+}
+
+func (sel selector) matches(objLabels map[string]string) bool {
+	for _, req := range sel {
+		value, ok := objLabels[req.key]
+		switch {
+		case req.exists && !ok:
+			return false
+		case req.exists:
+			continue
+		case req.negate && ok && value == req.value:
+			return false
+		case !req.negate && (!ok || value != req.value):
+			return false
+		}
+	}
+	return true
+}
+
+//Helpers for digging through decoded objects
+
+func key(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+func metadataOf(obj object) map[string]interface{} {
+	meta, ok := obj["metadata"].(map[string]interface{})
+	if !ok {
+		if typed, ok := obj["metadata"].(object); ok {
+			meta = typed
+		} else {
+			meta = make(map[string]interface{})
+		}
+		obj["metadata"] = meta
+	}
+	return meta
+}
+
+func specOf(obj object) map[string]interface{} {
+	spec, ok := obj["spec"].(map[string]interface{})
+	if !ok {
+		if typed, ok := obj["spec"].(object); ok {
+			spec = typed
+		} else {
+			spec = make(map[string]interface{})
+		}
+		obj["spec"] = spec
+	}
+	return spec
+}
+
+func nameOf(obj object) string {
+	name, _ := metadataOf(obj)["name"].(string)
+	return name
+}
+
+func namespaceOf(obj object) string {
+	namespace, _ := metadataOf(obj)["namespace"].(string)
+	return namespace
+}
+
+func generationOf(obj object) int {
+	switch generation := metadataOf(obj)["generation"].(type) {
+	case float64:
+		return int(generation)
+	case int:
+		return generation
+	}
+	return 0
+}
+
+func stringMap(raw interface{}) map[string]string {
+	result := make(map[string]string)
+	switch typed := raw.(type) {
+	case map[string]interface{}:
+		for k, v := range typed {
+			if s, ok := v.(string); ok {
+				result[k] = s
+			}
+		}
+	case map[string]string:
+		for k, v := range typed {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+func labelsOf(obj object) map[string]string {
+	return stringMap(metadataOf(obj)["labels"])
+}
+
+func annotationsOf(obj object) map[string]string {
+	return stringMap(metadataOf(obj)["annotations"])
+}
+
+func containersOf(pod object) []string {
+	var names []string
+	containers, _ := specOf(pod)["containers"].([]interface{})
+	for _, raw := range containers {
+		if container, ok := raw.(map[string]interface{}); ok {
+			if name, ok := container["name"].(string); ok {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+//ownedBy reports whether name was generated for depName
+//Replica sets are named <deployment>-<hash> and pods <deployment>-<hash>-<n>
+func ownedBy(name, depName string, suffixes int) bool {
+	if !strings.HasPrefix(name, depName+"-") {
+		return false
+	}
+	parts := strings.Split(strings.TrimPrefix(name, depName+"-"), "-")
+	if len(parts) != suffixes {
+		return false
+	}
+	for _, part := range parts {
+		if _, err := strconv.Atoi(part); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func specChanged(old, updated object) bool {
+	oldSpec, _ := json.Marshal(old["spec"])
+	newSpec, _ := json.Marshal(updated["spec"])
+	return string(oldSpec) != string(newSpec)
+}
+
+type byName []object
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byName) Less(i, j int) bool { return nameOf(s[i]) < nameOf(s[j]) }
+
+func decode(r *http.Request) (object, error) {
+	obj := object{}
+	err := json.NewDecoder(r.Body).Decode(&obj)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding request body: %v", err)
+	}
+	return obj, nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(obj)
+}
+
+//writeStatus writes a Kubernetes Status so the client surfaces a typed StatusError
+func writeStatus(w http.ResponseWriter, code int, reason, message string) {
+	writeJSON(w, code, object{
+		"kind":       "Status",
+		"apiVersion": coreGroupVersion,
+		"metadata":   object{},
+		"status":     "Failure",
+		"message":    message,
+		"reason":     reason,
+		"code":       code,
+	})
+}
+
+func writeNotFound(w http.ResponseWriter, resourceName, name string) {
+	writeStatus(w, http.StatusNotFound, "NotFound", fmt.Sprintf("%s \"%s\" not found", resourceName, name))
+}
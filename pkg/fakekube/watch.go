@@ -0,0 +1,186 @@
+package fakekube
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	eventAdded    = "ADDED"
+	eventModified = "MODIFIED"
+	eventDeleted  = "DELETED"
+
+	//maxWatchHistory is how many events are kept for watches started from an older resourceVersion
+	maxWatchHistory = 1000
+	//watchBuffer is how many events a watch can fall behind before it is closed
+	watchBuffer = 100
+)
+
+//watchEvent is a change made through the API, encoded when it happens since stored objects are modified in place
+//Changes made by the fake controllers, like the status of a deployment, aren't watched
+type watchEvent struct {
+	resourceVersion int
+	resource        string
+	namespace       string
+	labels          map[string]string
+	line            []byte
+}
+
+//watcher is an open watch request
+type watcher struct {
+	resource  string
+	namespace string
+	selector  selector
+	events    chan watchEvent
+}
+
+func (wt *watcher) wants(event watchEvent) bool {
+	if event.resource != wt.resource {
+		return false
+	}
+	if wt.namespace != "" && event.namespace != wt.namespace {
+		return false
+	}
+	return wt.selector.matches(event.labels)
+}
+
+//notify records a change and sends it to the watches interested in it
+//The Cluster lock must be held
+func (c *Cluster) notify(eventType, resourceName string, obj object) {
+	line, _ := json.Marshal(object{
+		"type":   eventType,
+		"object": obj,
+	})
+	event := watchEvent{
+		resourceVersion: c.resourceVersion,
+		resource:        resourceName,
+		namespace:       namespaceOf(obj),
+		labels:          labelsOf(obj),
+		line:            append(line, '\n'),
+	}
+
+	c.history = append(c.history, event)
+	if len(c.history) > maxWatchHistory {
+		c.expiredVersion = c.history[0].resourceVersion
+		c.history = c.history[1:]
+	}
+
+	for wt := range c.watchers {
+		if !wt.wants(event) {
+			continue
+		}
+		select {
+		case wt.events <- event:
+		default:
+			//Too far behind, the client starts over with a list like it would against the real API server
+			close(wt.events)
+			delete(c.watchers, wt)
+		}
+	}
+}
+
+//watch streams the changes after the requested resourceVersion until the client goes away or timeoutSeconds pass
+func (c *Cluster) watch(w http.ResponseWriter, r *http.Request, req request) {
+	sel, err := parseSelector(r.URL.Query().Get("labelSelector"))
+	if err != nil {
+		writeStatus(w, http.StatusBadRequest, "BadRequest", err.Error())
+		return
+	}
+
+	//Without a resourceVersion only changes from now on are sent
+	since := -1
+	if rv := r.URL.Query().Get("resourceVersion"); rv != "" {
+		since, err = strconv.Atoi(rv)
+		if err != nil {
+			writeStatus(w, http.StatusBadRequest, "BadRequest", fmt.Sprintf("invalid resourceVersion: %s", rv))
+			return
+		}
+	}
+
+	var timeout <-chan time.Time
+	if seconds := r.URL.Query().Get("timeoutSeconds"); seconds != "" {
+		n, err := strconv.Atoi(seconds)
+		if err != nil {
+			writeStatus(w, http.StatusBadRequest, "BadRequest", fmt.Sprintf("invalid timeoutSeconds: %s", seconds))
+			return
+		}
+		timer := time.NewTimer(time.Duration(n) * time.Second)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeStatus(w, http.StatusInternalServerError, "InternalError", "streaming is not supported")
+		return
+	}
+
+	wt := &watcher{
+		resource:  req.resource,
+		namespace: req.namespace,
+		selector:  sel,
+		events:    make(chan watchEvent, watchBuffer),
+	}
+
+	c.lock.Lock()
+	expiredVersion := c.expiredVersion
+	expired := since >= 0 && since < expiredVersion
+	var replay []watchEvent
+	if !expired {
+		for _, event := range c.history {
+			if since >= 0 && event.resourceVersion > since && wt.wants(event) {
+				replay = append(replay, event)
+			}
+		}
+		c.watchers[wt] = true
+	}
+	c.lock.Unlock()
+
+	defer func() {
+		c.lock.Lock()
+		delete(c.watchers, wt)
+		c.lock.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if expired {
+		json.NewEncoder(w).Encode(object{
+			"type": "ERROR",
+			"object": object{
+				"kind":       "Status",
+				"apiVersion": coreGroupVersion,
+				"metadata":   object{},
+				"status":     "Failure",
+				"message":    fmt.Sprintf("too old resource version: %d (%d)", since, expiredVersion),
+				"reason":     "Gone",
+				"code":       http.StatusGone,
+			},
+		})
+		return
+	}
+
+	for _, event := range replay {
+		w.Write(event.line)
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case event, ok := <-wt.events:
+			if !ok {
+				return
+			}
+			w.Write(event.line)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-timeout:
+			return
+		}
+	}
+}
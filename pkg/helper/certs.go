@@ -0,0 +1,68 @@
+package helper
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/30x/enrober/pkg/logging"
+)
+
+//CertReloader serves a TLS certificate from disk, reloading it when the files change
+//so a renewed certificate (e.g. an updated Kubernetes secret) is picked up without a restart
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mutex    sync.Mutex
+	cert     *tls.Certificate
+	certTime time.Time
+	keyTime  time.Time
+}
+
+//NewCertReloader loads the certificate and key, failing if they can't be used
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	reloader := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	_, err := reloader.GetCertificate(nil)
+	if err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+//GetCertificate returns the current certificate, to be used as tls.Config.GetCertificate
+//If the files changed but can't be loaded the previous certificate is kept
+func (reloader *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+
+	certInfo, certErr := os.Stat(reloader.certFile)
+	keyInfo, keyErr := os.Stat(reloader.keyFile)
+	if certErr == nil && keyErr == nil && reloader.cert != nil &&
+		certInfo.ModTime().Equal(reloader.certTime) && keyInfo.ModTime().Equal(reloader.keyTime) {
+		return reloader.cert, nil
+	}
+
+	//Remember the modification times either way so a broken renewal is only tried once
+	if certErr == nil && keyErr == nil {
+		reloader.certTime = certInfo.ModTime()
+		reloader.keyTime = keyInfo.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		if reloader.cert != nil {
+			logging.Default().With("error", err).Errorf("Error reloading TLS certificate, keeping the previous one")
+			return reloader.cert, nil
+		}
+		return nil, fmt.Errorf("loading TLS certificate: %v", err)
+	}
+
+	reloader.cert = &cert
+	return reloader.cert, nil
+}
@@ -1,6 +1,8 @@
 package helper
 
 import (
+	"fmt"
+
 	"k8s.io/kubernetes/pkg/api"
 )
 
@@ -28,3 +30,26 @@ func CacheEnvVars(currentEnvVars []api.EnvVar, newEnvVars []api.EnvVar) []api.En
 	}
 	return finalEnvVar
 }
+
+//InjectEnvVars merges envVars into every container and then applies the per container overrides keyed by container name
+//An error is returned if an override names a container that isn't in the pod template spec
+func InjectEnvVars(containers []api.Container, envVars []api.EnvVar, containerEnvVars map[string][]api.EnvVar) error {
+	for name := range containerEnvVars {
+		found := false
+		for _, container := range containers {
+			if container.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("containerEnvVars references unknown container %s", name)
+		}
+	}
+
+	for i := range containers {
+		containers[i].Env = CacheEnvVars(containers[i].Env, envVars)
+		containers[i].Env = CacheEnvVars(containers[i].Env, containerEnvVars[containers[i].Name])
+	}
+	return nil
+}
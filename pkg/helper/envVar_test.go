@@ -0,0 +1,56 @@
+package helper
+
+import (
+	"testing"
+
+	"k8s.io/kubernetes/pkg/api"
+)
+
+func TestInjectEnvVars(t *testing.T) {
+	containers := []api.Container{
+		{
+			Name: "web",
+			Env:  []api.EnvVar{{Name: "PORT", Value: "80"}},
+		},
+		{
+			Name: "sidecar",
+		},
+	}
+
+	envVars := []api.EnvVar{{Name: "PORT", Value: "8080"}, {Name: "MODE", Value: "prod"}}
+	containerEnvVars := map[string][]api.EnvVar{
+		"sidecar": {{Name: "MODE", Value: "proxy"}},
+	}
+
+	err := InjectEnvVars(containers, envVars, containerEnvVars)
+	if err != nil {
+		t.Fatalf("Error from InjectEnvVars: %v\n", err)
+	}
+
+	expected := map[string]map[string]string{
+		"web":     {"PORT": "8080", "MODE": "prod"},
+		"sidecar": {"PORT": "8080", "MODE": "proxy"},
+	}
+	for _, container := range containers {
+		if len(container.Env) != len(expected[container.Name]) {
+			t.Errorf("Expected %d env vars on %s, got %v\n", len(expected[container.Name]), container.Name, container.Env)
+		}
+		for _, env := range container.Env {
+			if expected[container.Name][env.Name] != env.Value {
+				t.Errorf("Expected %s=%s on %s, got %s\n", env.Name, expected[container.Name][env.Name], container.Name, env.Value)
+			}
+		}
+	}
+}
+
+func TestInjectEnvVarsUnknownContainer(t *testing.T) {
+	containers := []api.Container{{Name: "web"}}
+	containerEnvVars := map[string][]api.EnvVar{
+		"missing": {{Name: "MODE", Value: "proxy"}},
+	}
+
+	err := InjectEnvVars(containers, nil, containerEnvVars)
+	if err == nil {
+		t.Error("Expected an error for an unknown container\n")
+	}
+}
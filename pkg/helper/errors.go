@@ -0,0 +1,120 @@
+package helper
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/30x/enrober/pkg/logging"
+)
+
+//Error codes returned in the code field of an ErrorResponse
+//These are part of the API contract so existing values should never change
+const (
+	//400
+	ErrCodeInvalidJSON            = "InvalidJSON"
+	ErrCodeInvalidEnvironmentName = "InvalidEnvironmentName"
+	ErrCodeInvalidHostName        = "InvalidHostName"
+	ErrCodeInvalidDeployment      = "InvalidDeployment"
+	ErrCodeInvalidPTSURL          = "InvalidPTSURL"
+	ErrCodeInvalidQueryParameter  = "InvalidQueryParameter"
+	ErrCodeInvalidKeyRotation     = "InvalidKeyRotation"
+	ErrCodeInvalidRole            = "InvalidRole"
+
+	//401 and 403
+	ErrCodeUnauthorized = "Unauthorized"
+	ErrCodeForbidden    = "Forbidden"
+
+	//404
+	ErrCodeEnvironmentNotFound = "EnvironmentNotFound"
+	ErrCodeDeploymentNotFound  = "DeploymentNotFound"
+	ErrCodeRevisionNotFound    = "RevisionNotFound"
+
+	//409
+	ErrCodeDuplicateHostName   = "DuplicateHostName"
+	ErrCodeLabelSelectorExists = "LabelSelectorExists"
+	ErrCodeAlreadyExists       = "AlreadyExists"
+	ErrCodeConflict            = "Conflict"
+
+	//422
+	ErrCodeRolloutFailed = "RolloutFailed"
+
+	//500
+	ErrCodeInternal   = "InternalError"
+	ErrCodeKubernetes = "KubernetesError"
+
+	//501
+	ErrCodeAuditUnavailable = "AuditUnavailable"
+
+	//502
+	ErrCodePTSUnavailable = "PTSUnavailable"
+	ErrCodeApigee         = "ApigeeError"
+
+	//503
+	ErrCodeNotReady = "NotReady"
+
+	//504
+	ErrCodeRolloutTimeout = "RolloutTimeout"
+)
+
+//ErrorResponse is the JSON body written for every failed request
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Details string `json:"details,omitempty"`
+	//Steps is set when a multi step operation failed part way through
+	Steps []StepResult `json:"steps,omitempty"`
+}
+
+//APIError is an ErrorResponse along with the HTTP status it should be written with
+type APIError struct {
+	Status int
+	ErrorResponse
+}
+
+//NewAPIError creates an APIError, the details are taken from err if it isn't nil
+func NewAPIError(status int, code string, message string, err error) *APIError {
+	apiErr := &APIError{
+		Status: status,
+		ErrorResponse: ErrorResponse{
+			Code:    code,
+			Message: message,
+		},
+	}
+	if err != nil {
+		apiErr.Details = err.Error()
+	}
+	return apiErr
+}
+
+func (e *APIError) Error() string {
+	if e.Details == "" {
+		return fmt.Sprintf("%s: %s", e.Code, e.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", e.Code, e.Message, e.Details)
+}
+
+//ErrorRecorder is implemented by response writers that log the error of a request along with the request
+type ErrorRecorder interface {
+	RecordError(err *APIError)
+}
+
+//WriteError logs the given error and writes it as a JSON error response
+//The error is handed to w if it is an ErrorRecorder and logged on its own otherwise
+func WriteError(w http.ResponseWriter, err *APIError) {
+	if recorder, ok := w.(ErrorRecorder); ok {
+		recorder.RecordError(err)
+	} else {
+		logging.Default().Errorf("%s", err)
+	}
+
+	js, marshalErr := json.Marshal(err.ErrorResponse)
+	if marshalErr != nil {
+		http.Error(w, err.Message, err.Status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(err.Status)
+	w.Write(js)
+}
@@ -1,29 +1,125 @@
 package helper
 
 import (
+	"sort"
 	"strings"
-
-	"k8s.io/kubernetes/pkg/api"
-	k8sClient "k8s.io/kubernetes/pkg/client/unversioned"
+	"sync"
 )
 
-//UniqueHostNames checks if the desired hostNames are unique among existing namespaces
-func UniqueHostNames(hostNames []string, client k8sClient.Client) (bool, error) {
-	for _, value := range hostNames {
-		//Get list of all namespace and loop through each of their "validHosts" annotation looking for strings matching our value
-		nsList, err := client.Namespaces().List(api.ListOptions{})
-		if err != nil {
-			return false, err
+//HostIndex maps host names to the environment namespaces using them so uniqueness can be checked without listing namespaces
+//Host names are matched whole and case insensitively, like DNS does
+//Besides the hosts observed in the cluster it holds the claims of in-flight requests, so two requests can't both get the same host
+type HostIndex struct {
+	mutex sync.Mutex
+
+	//namespace -> hosts, as last observed in the cluster
+	namespaces map[string][]string
+	//host -> namespaces observed with it, normally a single one
+	observed map[string]map[string]bool
+	//host -> namespace of the in-flight request claiming it
+	claimed map[string]string
+}
+
+//NewHostIndex creates an empty HostIndex
+func NewHostIndex() *HostIndex {
+	return &HostIndex{
+		namespaces: make(map[string][]string),
+		observed:   make(map[string]map[string]bool),
+		claimed:    make(map[string]string),
+	}
+}
+
+//Set records the hosts namespace was observed with, replacing the ones it had
+func (index *HostIndex) Set(namespace string, hosts []string) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	index.remove(namespace)
+	if len(hosts) == 0 {
+		return
+	}
+
+	normalized := make([]string, len(hosts))
+	for i, host := range hosts {
+		host = strings.ToLower(host)
+		normalized[i] = host
+		if index.observed[host] == nil {
+			index.observed[host] = make(map[string]bool)
+		}
+		index.observed[host][namespace] = true
+	}
+	index.namespaces[namespace] = normalized
+}
+
+//Delete forgets the hosts of a namespace that no longer exists
+func (index *HostIndex) Delete(namespace string) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	index.remove(namespace)
+}
+
+func (index *HostIndex) remove(namespace string) {
+	for _, host := range index.namespaces[namespace] {
+		delete(index.observed[host], namespace)
+		if len(index.observed[host]) == 0 {
+			delete(index.observed, host)
 		}
-		for _, ns := range nsList.Items {
-			//Make sure validHosts annotation exists
-			if val, ok := ns.Annotations["hostNames"]; ok {
-				//Get the hostsList annotation
-				if strings.Contains(val, value) {
-					return false, nil
-				}
-			}
+	}
+	delete(index.namespaces, namespace)
+}
+
+//Claim reserves hosts for namespace while a request creates or updates it
+//Hosts namespace already has are not conflicts, so an environment can keep its hosts when updated
+//It returns the hosts used or claimed by other namespaces, in which case nothing is claimed,
+//otherwise release must be called once the request is done, after Set if it succeeded
+func (index *HostIndex) Claim(namespace string, hosts []string) (conflicts []string, release func()) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	claims := make(map[string]bool)
+	for _, host := range hosts {
+		host = strings.ToLower(host)
+		if claims[host] {
+			continue
+		}
+		claims[host] = true
+		if index.usedByOther(host, namespace) {
+			conflicts = append(conflicts, host)
+		}
+	}
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return conflicts, nil
+	}
+
+	//Hosts claimed by an earlier request of the same namespace are left to it
+	var own []string
+	for host := range claims {
+		if _, ok := index.claimed[host]; !ok {
+			index.claimed[host] = namespace
+			own = append(own, host)
+		}
+	}
+
+	return nil, func() {
+		index.mutex.Lock()
+		defer index.mutex.Unlock()
+		for _, host := range own {
+			delete(index.claimed, host)
+		}
+	}
+}
+
+//usedByOther tells whether host is used or claimed by a namespace other than namespace
+func (index *HostIndex) usedByOther(host, namespace string) bool {
+	if owner, ok := index.claimed[host]; ok && owner != namespace {
+		return true
+	}
+	for owner := range index.observed[host] {
+		if owner != namespace {
+			return true
 		}
 	}
-	return true, nil
+	return false
 }
@@ -0,0 +1,79 @@
+package helper
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHostIndexExactMatch(t *testing.T) {
+	index := NewHostIndex()
+	index.Set("org1-env1", []string{"api.foo.com"})
+
+	//Substrings and superstrings of a host are other hosts
+	conflicts, release := index.Claim("org2-env1", []string{"myapi.foo.com", "foo.com", "api.foo.co"})
+	if conflicts != nil {
+		t.Fatalf("got conflicts %v, want none", conflicts)
+	}
+	release()
+
+	conflicts, _ = index.Claim("org2-env1", []string{"myapi.foo.com", "API.foo.com"})
+	if !reflect.DeepEqual(conflicts, []string{"api.foo.com"}) {
+		t.Errorf("got conflicts %v, want [api.foo.com]", conflicts)
+	}
+}
+
+func TestHostIndexExcludesOwnNamespace(t *testing.T) {
+	index := NewHostIndex()
+	index.Set("org1-env1", []string{"host1", "host2"})
+
+	conflicts, release := index.Claim("org1-env1", []string{"host2", "host3"})
+	if conflicts != nil {
+		t.Fatalf("got conflicts %v, want none", conflicts)
+	}
+	index.Set("org1-env1", []string{"host2", "host3"})
+	release()
+
+	//host1 was given up by the update
+	conflicts, release = index.Claim("org2-env1", []string{"host1"})
+	if conflicts != nil {
+		t.Errorf("got conflicts %v, want none", conflicts)
+	}
+	release()
+
+	index.Delete("org1-env1")
+	conflicts, release = index.Claim("org2-env1", []string{"host2", "host3"})
+	if conflicts != nil {
+		t.Errorf("got conflicts %v after delete, want none", conflicts)
+	}
+	release()
+}
+
+func TestHostIndexClaims(t *testing.T) {
+	index := NewHostIndex()
+
+	conflicts, release := index.Claim("org1-env1", []string{"host1"})
+	if conflicts != nil {
+		t.Fatalf("got conflicts %v, want none", conflicts)
+	}
+
+	//A concurrent request can't take a host claimed by an in-flight one
+	conflicts, _ = index.Claim("org2-env1", []string{"host1", "host2"})
+	if !reflect.DeepEqual(conflicts, []string{"host1"}) {
+		t.Errorf("got conflicts %v, want [host1]", conflicts)
+	}
+
+	//Nothing is claimed by a request with conflicts so host2 is still free
+	conflicts, release2 := index.Claim("org3-env1", []string{"host2"})
+	if conflicts != nil {
+		t.Errorf("got conflicts %v, want none", conflicts)
+	}
+	release2()
+
+	//A failed request gives its hosts back
+	release()
+	conflicts, release = index.Claim("org2-env1", []string{"host1"})
+	if conflicts != nil {
+		t.Errorf("got conflicts %v after release, want none", conflicts)
+	}
+	release()
+}
@@ -0,0 +1,84 @@
+package helper
+
+import (
+	"fmt"
+
+	"github.com/30x/enrober/pkg/logging"
+)
+
+//Statuses reported for each step by RunSteps
+const (
+	StepDone               = "done"
+	StepFailed             = "failed"
+	StepSkipped            = "skipped"
+	StepNotRun             = "notRun"
+	StepCompensated        = "compensated"
+	StepCompensationFailed = "compensationFailed"
+)
+
+//Step is one action of a multi step operation along with the compensating action that undoes it
+type Step struct {
+	Name string
+	//Do performs the step
+	Do func() error
+	//Undo reverts a successful Do, nil if there is nothing to undo
+	Undo func() error
+	//Skip marks a step that doesn't apply, it is reported but never run
+	Skip bool
+}
+
+//StepResult reports what happened to a single step
+type StepResult struct {
+	Step   string `json:"step"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+//RunSteps runs the steps in order, if one fails every step that already ran is undone in reverse order
+//The returned error is the one from the step that failed, compensation errors are only reported in the results
+//Failures and compensations are logged to logger
+func RunSteps(logger *logging.Logger, steps []Step) ([]StepResult, error) {
+	results := make([]StepResult, len(steps))
+	for i, step := range steps {
+		results[i] = StepResult{
+			Step:   step.Name,
+			Status: StepNotRun,
+		}
+	}
+
+	for i, step := range steps {
+		if step.Skip {
+			results[i].Status = StepSkipped
+			continue
+		}
+
+		err := step.Do()
+		if err == nil {
+			results[i].Status = StepDone
+			continue
+		}
+
+		results[i].Status = StepFailed
+		results[i].Error = err.Error()
+		logger.With("step", step.Name, "error", err).Errorf("Step %s failed", step.Name)
+
+		//Unwind the steps that ran
+		for j := i - 1; j >= 0; j-- {
+			if results[j].Status != StepDone || steps[j].Undo == nil {
+				continue
+			}
+			undoErr := steps[j].Undo()
+			if undoErr != nil {
+				results[j].Status = StepCompensationFailed
+				results[j].Error = fmt.Sprintf("compensation failed: %v", undoErr)
+				logger.With("step", steps[j].Name, "error", undoErr).Errorf("Compensating step %s failed", steps[j].Name)
+				continue
+			}
+			results[j].Status = StepCompensated
+			logger.With("step", steps[j].Name).Infof("Compensated step %s", steps[j].Name)
+		}
+		return results, err
+	}
+
+	return results, nil
+}
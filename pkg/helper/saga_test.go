@@ -0,0 +1,91 @@
+package helper
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/30x/enrober/pkg/logging"
+)
+
+func TestRunSteps(t *testing.T) {
+	var ran []string
+	steps := []Step{
+		{
+			Name: "first",
+			Do:   func() error { ran = append(ran, "do first"); return nil },
+			Undo: func() error { ran = append(ran, "undo first"); return nil },
+		},
+		{
+			Name: "skipped",
+			Do:   func() error { ran = append(ran, "do skipped"); return nil },
+			Skip: true,
+		},
+		{
+			Name: "second",
+			Do:   func() error { ran = append(ran, "do second"); return nil },
+		},
+	}
+
+	results, err := RunSteps(logging.Default(), steps)
+	if err != nil {
+		t.Fatalf("Error from RunSteps: %v\n", err)
+	}
+
+	expected := []string{StepDone, StepSkipped, StepDone}
+	for i, result := range results {
+		if result.Status != expected[i] {
+			t.Errorf("Expected step %s to be %s, got %s\n", result.Step, expected[i], result.Status)
+		}
+	}
+	if len(ran) != 2 {
+		t.Errorf("Expected 2 actions to run, got %v\n", ran)
+	}
+}
+
+func TestRunStepsCompensation(t *testing.T) {
+	var ran []string
+	steps := []Step{
+		{
+			Name: "first",
+			Do:   func() error { ran = append(ran, "do first"); return nil },
+			Undo: func() error { ran = append(ran, "undo first"); return nil },
+		},
+		{
+			Name: "second",
+			Do:   func() error { ran = append(ran, "do second"); return nil },
+			Undo: func() error { ran = append(ran, "undo second"); return errors.New("undo failed") },
+		},
+		{
+			Name: "third",
+			Do:   func() error { ran = append(ran, "do third"); return errors.New("third failed") },
+			Undo: func() error { ran = append(ran, "undo third"); return nil },
+		},
+		{
+			Name: "fourth",
+			Do:   func() error { ran = append(ran, "do fourth"); return nil },
+		},
+	}
+
+	results, err := RunSteps(logging.Default(), steps)
+	if err == nil || err.Error() != "third failed" {
+		t.Fatalf("Expected the error from the third step, got %v\n", err)
+	}
+
+	expected := []string{StepCompensated, StepCompensationFailed, StepFailed, StepNotRun}
+	for i, result := range results {
+		if result.Status != expected[i] {
+			t.Errorf("Expected step %s to be %s, got %s\n", result.Step, expected[i], result.Status)
+		}
+	}
+
+	expectedRan := []string{"do first", "do second", "do third", "undo second", "undo first"}
+	if len(ran) != len(expectedRan) {
+		t.Fatalf("Expected %v to run, got %v\n", expectedRan, ran)
+	}
+	for i := range ran {
+		if ran[i] != expectedRan[i] {
+			t.Errorf("Expected %v to run, got %v\n", expectedRan, ran)
+			break
+		}
+	}
+}
@@ -0,0 +1,252 @@
+//Package logging writes leveled JSON log lines, one object per line.
+//Handlers get a request scoped Logger from the request context carrying the request ID, org, env, deployment and caller.
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Level is the severity of a log line
+type Level int
+
+//Levels from the most to the least verbose
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (level Level) String() string {
+	if level < LevelDebug || level > LevelError {
+		return fmt.Sprintf("Level(%d)", int(level))
+	}
+	return levelNames[level]
+}
+
+//ParseLevel parses debug, info, warn or error
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %s, expected one of %s", name, strings.Join(levelNames, ", "))
+}
+
+//output is shared by a Logger and every Logger derived from it
+type output struct {
+	mutex sync.Mutex
+	w     io.Writer
+	level Level
+}
+
+//field is a key and value added to every line of a Logger
+type field struct {
+	key   string
+	value interface{}
+}
+
+//Logger writes JSON lines with its fields, a Logger is safe for concurrent use
+type Logger struct {
+	out    *output
+	fields []field
+}
+
+//New creates a Logger writing lines at level or above to w
+func New(w io.Writer, level Level) *Logger {
+	return &Logger{
+		out: &output{
+			w:     w,
+			level: level,
+		},
+	}
+}
+
+var std = New(os.Stdout, LevelInfo)
+
+//Default returns the process wide Logger, used outside of requests
+func Default() *Logger {
+	return std
+}
+
+//SetLevel changes the level of the process wide Logger and every Logger derived from it
+func SetLevel(level Level) {
+	std.SetLevel(level)
+}
+
+//SetLevel changes the level of the Logger and every Logger derived from the same one
+func (l *Logger) SetLevel(level Level) {
+	l.out.mutex.Lock()
+	defer l.out.mutex.Unlock()
+	l.out.level = level
+}
+
+//Enabled returns true if lines at level are written
+func (l *Logger) Enabled(level Level) bool {
+	l.out.mutex.Lock()
+	defer l.out.mutex.Unlock()
+	return level >= l.out.level
+}
+
+//With returns a Logger adding the given key value pairs to every line, a later value replaces an earlier one with the same key
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]field, 0, len(l.fields)+len(keyvals)/2)
+	fields = append(fields, l.fields...)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		key := fmt.Sprint(keyvals[i])
+		replaced := false
+		for j := range fields {
+			if fields[j].key == key {
+				fields[j].value = keyvals[i+1]
+				replaced = true
+			}
+		}
+		if !replaced {
+			fields = append(fields, field{key: key, value: keyvals[i+1]})
+		}
+	}
+	return &Logger{
+		out:    l.out,
+		fields: fields,
+	}
+}
+
+//Debugf logs at debug level
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.log(LevelDebug, format, args...)
+}
+
+//Infof logs at info level
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.log(LevelInfo, format, args...)
+}
+
+//Warnf logs at warn level
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.log(LevelWarn, format, args...)
+}
+
+//Errorf logs at error level
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.log(LevelError, format, args...)
+}
+
+//Log logs at the given level
+func (l *Logger) Log(level Level, format string, args ...interface{}) {
+	l.log(level, format, args...)
+}
+
+//log writes a line, it must be called directly by the exported methods so the source line is found
+func (l *Logger) log(level Level, format string, args ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	source := "unknown"
+	if _, file, line, ok := runtime.Caller(2); ok {
+		source = fmt.Sprintf("%s/%s:%d", filepath.Base(filepath.Dir(file)), filepath.Base(file), line)
+	}
+
+	var line bytes.Buffer
+	line.WriteString("{")
+	writeField(&line, "time", time.Now().UTC().Format(time.RFC3339Nano), true)
+	writeField(&line, "level", level.String(), false)
+	writeField(&line, "msg", strings.TrimRight(fmt.Sprintf(format, args...), "\n"), false)
+	writeField(&line, "source", source, false)
+	for _, f := range l.fields {
+		value := f.value
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		writeField(&line, f.key, value, false)
+	}
+	line.WriteString("}\n")
+
+	l.out.mutex.Lock()
+	defer l.out.mutex.Unlock()
+	l.out.w.Write(line.Bytes())
+}
+
+func writeField(line *bytes.Buffer, key string, value interface{}, first bool) {
+	if !first {
+		line.WriteString(",")
+	}
+	encodedKey, _ := json.Marshal(key)
+	encodedValue, err := json.Marshal(value)
+	if err != nil {
+		encodedValue, _ = json.Marshal(fmt.Sprint(value))
+	}
+	line.Write(encodedKey)
+	line.WriteString(":")
+	line.Write(encodedValue)
+}
+
+//Package level functions log with the process wide Logger
+
+//Debugf logs at debug level with the process wide Logger
+func Debugf(format string, args ...interface{}) {
+	std.log(LevelDebug, format, args...)
+}
+
+//Infof logs at info level with the process wide Logger
+func Infof(format string, args ...interface{}) {
+	std.log(LevelInfo, format, args...)
+}
+
+//Warnf logs at warn level with the process wide Logger
+func Warnf(format string, args ...interface{}) {
+	std.log(LevelWarn, format, args...)
+}
+
+//Errorf logs at error level with the process wide Logger
+func Errorf(format string, args ...interface{}) {
+	std.log(LevelError, format, args...)
+}
+
+type contextKey struct{}
+
+//scope holds the Logger of a request, fields can be added to it once the request has been routed or authenticated
+type scope struct {
+	mutex  sync.Mutex
+	logger *Logger
+}
+
+//NewContext returns a context carrying logger
+func NewContext(ctx context.Context, logger *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, &scope{logger: logger})
+}
+
+//FromContext returns the Logger of the context, the process wide Logger if there is none
+func FromContext(ctx context.Context) *Logger {
+	s, ok := ctx.Value(contextKey{}).(*scope)
+	if !ok {
+		return std
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.logger
+}
+
+//AddFields adds key value pairs to the Logger of the context, for every later line of the request
+func AddFields(ctx context.Context, keyvals ...interface{}) {
+	s, ok := ctx.Value(contextKey{}).(*scope)
+	if !ok {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.logger = s.logger.With(keyvals...)
+}
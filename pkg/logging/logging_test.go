@@ -0,0 +1,126 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func decodeLines(t *testing.T, out *bytes.Buffer) []map[string]interface{} {
+	var lines []map[string]interface{}
+	for _, raw := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if raw == "" {
+			continue
+		}
+		line := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(raw), &line); err != nil {
+			t.Fatalf("line isn't JSON: %s: %v", raw, err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestJSONLines(t *testing.T) {
+	var out bytes.Buffer
+	logger := New(&out, LevelInfo).With("requestId", "abc", "status", 201, "error", errors.New("boom"))
+	logger.Infof("Created Namespace: %s\n", "org-env")
+
+	lines := decodeLines(t, &out)
+	if len(lines) != 1 {
+		t.Fatalf("got %d lines, want 1", len(lines))
+	}
+	line := lines[0]
+	expected := map[string]interface{}{
+		"level":     "info",
+		"msg":       "Created Namespace: org-env",
+		"requestId": "abc",
+		"status":    float64(201),
+		"error":     "boom",
+	}
+	for key, value := range expected {
+		if line[key] != value {
+			t.Errorf("%s = %v, want %v", key, line[key], value)
+		}
+	}
+	if source, _ := line["source"].(string); !strings.HasPrefix(source, "logging/logging_test.go:") {
+		t.Errorf("source = %v, want this file", line["source"])
+	}
+	if _, ok := line["time"]; !ok {
+		t.Errorf("time is missing")
+	}
+}
+
+func TestLevels(t *testing.T) {
+	var out bytes.Buffer
+	logger := New(&out, LevelWarn)
+	logger.Debugf("debug")
+	logger.Infof("info")
+	logger.Warnf("warn")
+	logger.Errorf("error")
+
+	lines := decodeLines(t, &out)
+	if len(lines) != 2 || lines[0]["level"] != "warn" || lines[1]["level"] != "error" {
+		t.Fatalf("got %v, want the warn and error lines", lines)
+	}
+
+	//Derived Loggers share the level
+	out.Reset()
+	derived := logger.With("key", "value")
+	logger.SetLevel(LevelDebug)
+	derived.Debugf("debug")
+	if len(decodeLines(t, &out)) != 1 {
+		t.Errorf("derived Logger should follow the level change")
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, name := range []string{"debug", "INFO", "Warn", "error"} {
+		level, err := ParseLevel(name)
+		if err != nil || !strings.EqualFold(level.String(), name) {
+			t.Errorf("ParseLevel(%s) = %v, %v", name, level, err)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Errorf("ParseLevel(verbose) should fail")
+	}
+}
+
+func TestWithReplacesFields(t *testing.T) {
+	var out bytes.Buffer
+	logger := New(&out, LevelInfo).With("env", "env1")
+	logger.With("env", "env2").Infof("replaced")
+	logger.Infof("original")
+
+	lines := decodeLines(t, &out)
+	if lines[0]["env"] != "env2" || lines[1]["env"] != "env1" {
+		t.Errorf("got %v, want env2 then env1", lines)
+	}
+	if strings.Count(strings.SplitN(out.String(), "\n", 2)[0], `"env"`) != 1 {
+		t.Errorf("a replaced field shouldn't be repeated: %s", out.String())
+	}
+}
+
+func TestContext(t *testing.T) {
+	if FromContext(context.Background()) != Default() {
+		t.Errorf("FromContext should return the default Logger without one in the context")
+	}
+	//Adding fields without a Logger in the context is a no-op
+	AddFields(context.Background(), "org", "org1")
+
+	var out bytes.Buffer
+	ctx := NewContext(context.Background(), New(&out, LevelInfo).With("requestId", "abc"))
+	AddFields(ctx, "org", "org1", "env", "env1")
+	AddFields(ctx, "caller", "user@example.com")
+	FromContext(ctx).Infof("handled")
+
+	line := decodeLines(t, &out)[0]
+	for key, value := range map[string]string{"requestId": "abc", "org": "org1", "env": "env1", "caller": "user@example.com"} {
+		if line[key] != value {
+			t.Errorf("%s = %v, want %s", key, line[key], value)
+		}
+	}
+}
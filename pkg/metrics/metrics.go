@@ -0,0 +1,185 @@
+//Package metrics holds the Prometheus metrics enrober exports on /metrics.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "enrober"
+
+//Registry holds every enrober metric along with the Go runtime and process metrics
+var Registry = prometheus.NewRegistry()
+
+var (
+	//Requests counts API requests by route template, method and status code
+	Requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "API requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	//RequestDuration is the latency of API requests by route template, method and status code
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of API requests by route, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+
+	//KubernetesRequests counts calls to the Kubernetes API by operation and status code
+	KubernetesRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "kubernetes_requests_total",
+		Help:      "Kubernetes API calls by operation and status code, error if no response was received.",
+	}, []string{"operation", "code"})
+
+	//KubernetesRequestDuration is the latency of calls to the Kubernetes API by operation
+	KubernetesRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "kubernetes_request_duration_seconds",
+		Help:      "Latency of Kubernetes API calls by operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	//ApigeeRequests counts calls to the Apigee management API by operation and status code, retries included
+	ApigeeRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "apigee_requests_total",
+		Help:      "Apigee management API calls by operation and status code, error if no response was received. Each retry is counted.",
+	}, []string{"operation", "code"})
+
+	//ApigeeRequestDuration is the latency of calls to the Apigee management API by operation
+	ApigeeRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "apigee_request_duration_seconds",
+		Help:      "Latency of Apigee management API calls by operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	//PTSFetches counts pod template spec fetches from a ptsURL by result, success or the error code
+	PTSFetches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pts_fetches_total",
+		Help:      "Pod template spec fetches from a ptsURL by result, success or the error code.",
+	}, []string{"result"})
+
+	//PTSFetchDuration is the latency of pod template spec fetches
+	PTSFetchDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "pts_fetch_duration_seconds",
+		Help:      "Latency of pod template spec fetches from a ptsURL.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	//EnvironmentSteps counts the steps run while provisioning or deleting environments by their status
+	//A failed or compensationFailed step is what to alert on
+	EnvironmentSteps = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "environment_steps_total",
+		Help:      "Steps run while creating or deleting environments by operation, step and status.",
+	}, []string{"operation", "step", "status"})
+)
+
+func init() {
+	Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		Requests,
+		RequestDuration,
+		KubernetesRequests,
+		KubernetesRequestDuration,
+		ApigeeRequests,
+		ApigeeRequestDuration,
+		PTSFetches,
+		PTSFetchDuration,
+		EnvironmentSteps,
+	)
+}
+
+//Handler serves the metrics of Registry and of the given gatherers in the Prometheus exposition format
+//A collector failing doesn't prevent the other metrics from being served
+func Handler(gatherers ...prometheus.Gatherer) http.Handler {
+	return promhttp.HandlerFor(append(prometheus.Gatherers{Registry}, gatherers...), promhttp.HandlerOpts{
+		ErrorHandling: promhttp.ContinueOnError,
+	})
+}
+
+//Transport is an http.RoundTripper counting and timing the calls it sends by operation
+type Transport struct {
+	//Next sends the requests, http.DefaultTransport if nil
+	Next http.RoundTripper
+	//Operation names the operation of a request
+	Operation func(r *http.Request) string
+	Requests  *prometheus.CounterVec
+	Duration  *prometheus.HistogramVec
+}
+
+//RoundTrip sends the request with Next and records it
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	next := t.Next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	operation := t.Operation(r)
+
+	start := time.Now()
+	resp, err := next.RoundTrip(r)
+	t.Duration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	t.Requests.WithLabelValues(operation, code).Inc()
+	return resp, err
+}
+
+//subresources are the Kubernetes subresources enrober uses, named after their parent rather than as a collection
+var subresources = map[string]bool{
+	"log":      true,
+	"status":   true,
+	"scale":    true,
+	"rollback": true,
+}
+
+//RESTOperation names the operation of a call to a REST API whose path alternates collections and names,
+//such as namespaces/{namespace}/deployments/{deployment}, e.g. "list deployments", "get deployments" or "get pods/log"
+//Only the last collection is kept so the label values stay bounded
+func RESTOperation(method string, segments []string) string {
+	resource := "root"
+	named := false
+
+	n := len(segments)
+	switch {
+	case n >= 3 && n%2 == 1 && subresources[segments[n-1]]:
+		resource = segments[n-3] + "/" + segments[n-1]
+		named = true
+	case n > 0 && n%2 == 1:
+		resource = segments[n-1]
+	case n > 0:
+		resource = segments[n-2]
+		named = true
+	}
+
+	var verb string
+	switch method {
+	case "GET":
+		verb = "list"
+		if named {
+			verb = "get"
+		}
+	case "POST":
+		verb = "create"
+	case "PUT":
+		verb = "update"
+	default:
+		verb = strings.ToLower(method)
+	}
+	return verb + " " + resource
+}
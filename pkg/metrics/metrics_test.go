@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRESTOperation(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{"GET", "namespaces", "list namespaces"},
+		{"GET", "namespaces/org-env", "get namespaces"},
+		{"DELETE", "namespaces/org-env", "delete namespaces"},
+		{"POST", "namespaces/org-env/secrets", "create secrets"},
+		{"PUT", "namespaces/org-env/deployments/web", "update deployments"},
+		{"GET", "namespaces/org-env/pods/web-1/log", "get pods/log"},
+		{"GET", "organizations/org1", "get organizations"},
+		{"POST", "organizations/org1/environments/env1/keyvaluemaps/shipyard-routing/entries", "create entries"},
+		{"GET", "", "list root"},
+	}
+	for _, test := range tests {
+		var segments []string
+		if test.path != "" {
+			segments = strings.Split(test.path, "/")
+		}
+		if got := RESTOperation(test.method, segments); got != test.want {
+			t.Errorf("RESTOperation(%s, %s) = %q, want %q", test.method, test.path, got, test.want)
+		}
+	}
+}
+
+type failingTransport struct{}
+
+func (failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestTransport(t *testing.T) {
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "requests"}, []string{"operation", "code"})
+	duration := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "duration"}, []string{"operation"})
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+	}))
+	defer ts.Close()
+
+	transport := &Transport{
+		Operation: func(r *http.Request) string { return r.Method },
+		Requests:  requests,
+		Duration:  duration,
+	}
+	client := &http.Client{Transport: transport}
+	resp, err := client.Post(ts.URL, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	transport.Next = failingTransport{}
+	_, err = client.Get(ts.URL)
+	if err == nil {
+		t.Fatal("Expected an error from the failing transport")
+	}
+
+	if got := testutil.ToFloat64(requests.WithLabelValues("POST", "409")); got != 1 {
+		t.Errorf("POST 409 count = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(requests.WithLabelValues("GET", "error")); got != 1 {
+		t.Errorf("GET error count = %v, want 1", got)
+	}
+	if got := testutil.CollectAndCount(duration); got != 2 {
+		t.Errorf("duration series = %v, want 2", got)
+	}
+}
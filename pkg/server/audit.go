@@ -0,0 +1,292 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/30x/enrober/pkg/audit"
+	"github.com/30x/enrober/pkg/config"
+	"github.com/30x/enrober/pkg/helper"
+	"github.com/30x/enrober/pkg/logging"
+
+	"github.com/gorilla/mux"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	"k8s.io/kubernetes/pkg/labels"
+)
+
+const (
+	//auditEventReason is the reason of the Events written by the event sink
+	auditEventReason = "Audit"
+	//auditAnnotation holds the JSON audit record on an Event
+	auditAnnotation = "audit"
+
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+//NewAuditSink creates the audit sink selected in cfg, nil for none
+func NewAuditSink(cfg config.Audit, client KubeClient) (audit.Sink, error) {
+	switch cfg.Sink {
+	case config.AuditSinkStdout:
+		return audit.NewWriterSink(os.Stdout), nil
+	case config.AuditSinkFile:
+		return audit.NewFileSink(cfg.File)
+	case config.AuditSinkEvent:
+		return &eventSink{client: client}, nil
+	case config.AuditSinkNone:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown audit sink %s", cfg.Sink)
+	}
+}
+
+//audited wraps a handler so an audit record of the request is written once it is handled, whether it succeeded or not
+//It must wrap authorized so denied requests are recorded too
+func (server *Server) audited(action string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		state := stateOf(r)
+		if server.audit == nil || state == nil {
+			handler(w, r)
+			return
+		}
+
+		//Keep the start of the body for the diff, the handler reads it from memory and the rest from the request
+		var body []byte
+		if r.Body != nil {
+			body, _ = ioutil.ReadAll(io.LimitReader(r.Body, audit.MaxDiffSize+1))
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		}
+		truncated := len(body) > audit.MaxDiffSize
+
+		start := time.Now()
+		handler(w, r)
+
+		//Requests failing before authorization still get their caller
+		server.identify(r)
+
+		state.mutex.Lock()
+		record := &audit.Record{
+			Time:          start.UTC(),
+			RequestID:     state.id,
+			Actor:         state.caller,
+			Action:        action,
+			Target:        state.target,
+			Method:        r.Method,
+			Path:          r.URL.Path,
+			Query:         r.URL.RawQuery,
+			Diff:          audit.Diff(body),
+			DiffTruncated: truncated,
+			Outcome: audit.Outcome{
+				Result: audit.ResultSuccess,
+				Status: state.response.status,
+			},
+		}
+		state.mutex.Unlock()
+
+		if record.Actor == "" {
+			record.Actor = "anonymous"
+		}
+		if state.response.status >= 400 {
+			record.Outcome.Result = audit.ResultFailure
+			if apiErr := state.response.err; apiErr != nil {
+				record.Outcome.ErrorCode = apiErr.Code
+				record.Outcome.Error = apiErr.Message
+			}
+		}
+
+		err := server.audit.Write(record)
+		if err != nil {
+			logging.FromContext(r.Context()).With("error", err).Errorf("Error writing audit record of %s", action)
+		}
+	}
+}
+
+//getAuditRecords returns the audit records of an environment, the most recent first
+func (server *Server) getAuditRecords(w http.ResponseWriter, r *http.Request) {
+	pathVars := mux.Vars(r)
+
+	querier, ok := server.audit.(audit.Querier)
+	if !ok {
+		errorMessage := fmt.Sprintf("Audit sink %s can't be queried", server.config.Audit.Sink)
+		helper.WriteError(w, helper.NewAPIError(http.StatusNotImplemented, helper.ErrCodeAuditUnavailable, errorMessage, nil))
+		return
+	}
+
+	query := audit.Query{
+		Organization: pathVars["org"],
+		Environment:  pathVars["env"],
+		Deployment:   r.URL.Query().Get("deployment"),
+		Action:       r.URL.Query().Get("action"),
+		Actor:        r.URL.Query().Get("actor"),
+		Limit:        defaultAuditLimit,
+	}
+
+	if since := r.URL.Query().Get("since"); since != "" {
+		sinceTime, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			helper.WriteError(w, helper.NewAPIError(http.StatusBadRequest, helper.ErrCodeInvalidQueryParameter, "since must be an RFC3339 time", err))
+			return
+		}
+		query.Since = sinceTime
+	}
+
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxAuditLimit {
+			errorMessage := fmt.Sprintf("limit must be between 1 and %d", maxAuditLimit)
+			helper.WriteError(w, helper.NewAPIError(http.StatusBadRequest, helper.ErrCodeInvalidQueryParameter, errorMessage, err))
+			return
+		}
+		query.Limit = n
+	}
+
+	records, err := querier.Query(query)
+	if err != nil {
+		helper.WriteError(w, helper.NewAPIError(http.StatusInternalServerError, helper.ErrCodeInternal, "Error querying audit records", err))
+		return
+	}
+	if records == nil {
+		records = []audit.Record{}
+	}
+
+	js, err := json.Marshal(records)
+	if err != nil {
+		helper.WriteError(w, helper.NewAPIError(http.StatusInternalServerError, helper.ErrCodeInternal, "Error marshalling response JSON", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(js)
+}
+
+//eventSink writes audit records as Events in the namespace of the environment they target
+//Records of organization wide requests, of environment deletions, and of environments whose namespace is gone,
+//are written to the default namespace
+type eventSink struct {
+	client KubeClient
+}
+
+//Write implements audit.Sink
+func (sink *eventSink) Write(record *audit.Record) error {
+	js, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	target := record.Target
+	eventLabels := map[string]string{
+		"audit":        "true",
+		"organization": target.Organization,
+	}
+	involvedObject := api.ObjectReference{
+		Kind: "Namespace",
+		Name: api.NamespaceDefault,
+	}
+	namespace := api.NamespaceDefault
+	if target.Environment != "" {
+		namespace = target.Organization + "-" + target.Environment
+		eventLabels["environment"] = target.Environment
+		involvedObject.Name = namespace
+	}
+	if target.Deployment != "" {
+		involvedObject = api.ObjectReference{
+			Kind:       "Deployment",
+			APIVersion: "extensions/v1beta1",
+			Namespace:  namespace,
+			Name:       target.Deployment,
+		}
+	}
+
+	eventType := api.EventTypeNormal
+	if record.Outcome.Result == audit.ResultFailure {
+		eventType = api.EventTypeWarning
+	}
+
+	event := &api.Event{
+		ObjectMeta: api.ObjectMeta{
+			Name:   fmt.Sprintf("audit.%x", record.Time.UnixNano()),
+			Labels: eventLabels,
+			Annotations: map[string]string{
+				auditAnnotation: string(js),
+			},
+		},
+		InvolvedObject: involvedObject,
+		Reason:         auditEventReason,
+		Message:        fmt.Sprintf("%s %s: %d", record.Actor, record.Action, record.Outcome.Status),
+		Source: api.EventSource{
+			Component: "enrober",
+		},
+		FirstTimestamp: unversioned.NewTime(record.Time),
+		LastTimestamp:  unversioned.NewTime(record.Time),
+		Count:          1,
+		Type:           eventType,
+	}
+
+	//The namespace of a deleted environment takes its events with it
+	if record.Action == "deleteEnvironment" {
+		namespace = api.NamespaceDefault
+	}
+
+	_, err = sink.client.CreateEvent(namespace, event)
+	if err != nil && namespace != api.NamespaceDefault {
+		//The namespace may not exist yet or anymore, e.g. for a failed creation or a deletion of the environment
+		_, err = sink.client.CreateEvent(api.NamespaceDefault, event)
+	}
+	return err
+}
+
+//Query implements audit.Querier, reading the namespace of the environment and the default namespace
+//The Query must have an organization and environment
+func (sink *eventSink) Query(q audit.Query) ([]audit.Record, error) {
+	selector := map[string]string{
+		"audit":        "true",
+		"organization": q.Organization,
+		"environment":  q.Environment,
+	}
+
+	var records []audit.Record
+	for _, namespace := range []string{q.Organization + "-" + q.Environment, api.NamespaceDefault} {
+		eventList, err := sink.client.ListEvents(namespace, api.ListOptions{
+			LabelSelector: labels.SelectorFromSet(labels.Set(selector)),
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, event := range eventList.Items {
+			var record audit.Record
+			if err := json.Unmarshal([]byte(event.Annotations[auditAnnotation]), &record); err != nil {
+				continue
+			}
+			if q.Matches(&record) {
+				records = append(records, record)
+			}
+		}
+	}
+
+	sort.Sort(byRecordTime(records))
+	if q.Limit > 0 && len(records) > q.Limit {
+		records = records[:q.Limit]
+	}
+	return records, nil
+}
+
+//byRecordTime sorts audit records the most recent first
+type byRecordTime []audit.Record
+
+func (s byRecordTime) Len() int           { return len(s) }
+func (s byRecordTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byRecordTime) Less(i, j int) bool { return s[i].Time.After(s[j].Time) }
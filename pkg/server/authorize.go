@@ -0,0 +1,55 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/30x/enrober/pkg/auth"
+	"github.com/30x/enrober/pkg/helper"
+
+	"github.com/gorilla/mux"
+
+	"k8s.io/kubernetes/pkg/api"
+)
+
+//authorized wraps a handler so it only runs if the caller may perform action on the org and env of the route
+func (server *Server) authorized(action auth.Action, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pathVars := mux.Vars(r)
+		if !server.authorize(w, r, pathVars["org"], pathVars["env"], action) {
+			return
+		}
+		handler(w, r)
+	}
+}
+
+//authorize checks the caller may perform action on the given org and env
+//If not the error is written to w and false is returned
+func (server *Server) authorize(w http.ResponseWriter, r *http.Request, org, env string, action auth.Action) bool {
+	server.identify(r)
+	apiErr := server.authorizer.Authorize(r, org, env, action)
+	if apiErr != nil {
+		helper.WriteError(w, apiErr)
+		return false
+	}
+	return true
+}
+
+//environmentReader returns a func checking the caller may read the environment of a listed namespace
+//Authorizers supporting sessions authenticate the caller once, ask once per organization if they administer it
+//and read the role bindings from the listed namespace rather than getting it again
+func (server *Server) environmentReader(r *http.Request) (func(ns *api.Namespace) *helper.APIError, *helper.APIError) {
+	sessions, ok := server.authorizer.(auth.SessionAuthorizer)
+	if !ok {
+		return func(ns *api.Namespace) *helper.APIError {
+			return server.authorizer.Authorize(r, ns.Labels["organization"], ns.Labels["environment"], auth.ActionRead)
+		}, nil
+	}
+
+	session, apiErr := sessions.NewSession(r)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	return func(ns *api.Namespace) *helper.APIError {
+		return session.AuthorizeWith(ns.Labels["organization"], ns.Labels["environment"], listedRoleBindings{ns}, auth.ActionRead)
+	}, nil
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/30x/enrober/pkg/helper"
+
+	k8sErrors "k8s.io/kubernetes/pkg/api/errors"
+)
+
+//kubeError maps an error returned by the Kubernetes API onto an APIError
+//notFoundCode is the error code used when the target resource doesn't exist
+func kubeError(err error, notFoundCode string, message string) *helper.APIError {
+	switch {
+	case k8sErrors.IsNotFound(err):
+		return helper.NewAPIError(http.StatusNotFound, notFoundCode, message, err)
+	case k8sErrors.IsAlreadyExists(err):
+		return helper.NewAPIError(http.StatusConflict, helper.ErrCodeAlreadyExists, message, err)
+	case k8sErrors.IsConflict(err):
+		return helper.NewAPIError(http.StatusConflict, helper.ErrCodeConflict, message, err)
+	default:
+		return helper.NewAPIError(http.StatusInternalServerError, helper.ErrCodeKubernetes, message, err)
+	}
+}
+
+//ptsError converts an error from helper.GetPTSFromURL into an APIError
+func ptsError(err error) *helper.APIError {
+	if apiErr, ok := err.(*helper.APIError); ok {
+		return apiErr
+	}
+	return helper.NewAPIError(http.StatusBadGateway, helper.ErrCodePTSUnavailable, "Error retrieving pod template spec", err)
+}
+
+//apigeeError converts an error from the Apigee client into an APIError
+func apigeeError(err error, message string) *helper.APIError {
+	return helper.NewAPIError(http.StatusBadGateway, helper.ErrCodeApigee, message, err)
+}
@@ -0,0 +1,244 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/30x/enrober/pkg/helper"
+
+	"k8s.io/kubernetes/pkg/api"
+	k8sErrors "k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/labels"
+)
+
+const (
+	checkOK     = "ok"
+	checkFailed = "failed"
+
+	//checkTimeout bounds each readiness check so a hung dependency fails the probe instead of blocking it
+	checkTimeout = 5 * time.Second
+	//readinessCacheTTL keeps probes from several kubelets or load balancers from hammering the dependencies
+	readinessCacheTTL = 5 * time.Second
+)
+
+//healthCheck is one dependency probed for readiness
+type healthCheck struct {
+	name string
+	run  func() error
+}
+
+type checkResult struct {
+	Name       string  `json:"name"`
+	Status     string  `json:"status"`
+	Error      string  `json:"error,omitempty"`
+	DurationMs float64 `json:"durationMs"`
+}
+
+type healthResponse struct {
+	Status string        `json:"status"`
+	Checks []checkResult `json:"checks,omitempty"`
+}
+
+//readiness runs the readiness checks and caches their results for a little while
+type readiness struct {
+	checks []healthCheck
+
+	mutex     sync.Mutex
+	checkedAt time.Time
+	results   []checkResult
+}
+
+//readinessChecks lists what enrober needs to serve requests: the Kubernetes API with the rights to list namespaces
+//and manage secrets, the index of host names, and the Apigee management API when environment keys are kept in its KVM
+//The secret rights are only checked until they have been seen once, so probes don't keep writing to etcd
+func (server *Server) readinessChecks() []healthCheck {
+	checks := []healthCheck{
+		{name: "kubernetes", run: server.checkListNamespaces},
+		{name: "kubernetesSecrets", run: untilPassed(server.checkCreateSecrets)},
+		{name: "hostIndex", run: server.checkHostIndex},
+	}
+	if server.config.Features.ApigeeKVM {
+		checks = append(checks, healthCheck{name: "apigee", run: server.apigee.Ping})
+	}
+	return checks
+}
+
+//untilPassed runs check until it passes once and then reports it passing without running it again
+func untilPassed(check func() error) func() error {
+	var mutex sync.Mutex
+	passed := false
+	return func() error {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if passed {
+			return nil
+		}
+		err := check()
+		passed = err == nil
+		return err
+	}
+}
+
+//checkListNamespaces lists namespaces with a selector matching none of them, which needs connectivity and the list right but is cheap
+func (server *Server) checkListNamespaces() error {
+	_, err := server.client.ListNamespaces(api.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{"enrober-readiness": "probe"}),
+	})
+	if err != nil {
+		return fmt.Errorf("listing namespaces: %v", err)
+	}
+	return nil
+}
+
+//checkCreateSecrets creates and deletes a secret in the default namespace
+//Kubernetes has no dry run yet so actually doing it is the only way to know the rights are there
+//Probe secrets left behind by a failed delete, a timed out check or a crash are deleted by the next run
+func (server *Server) checkCreateSecrets() error {
+	err := server.deleteProbeSecrets()
+	if err != nil {
+		return err
+	}
+
+	suffix, err := helper.GenerateRandomBytes(4)
+	if err != nil {
+		return err
+	}
+	name := "enrober-readiness-" + hex.EncodeToString(suffix)
+
+	_, err = server.client.CreateSecret(api.NamespaceDefault, &api.Secret{
+		ObjectMeta: api.ObjectMeta{
+			Name:   name,
+			Labels: probeSecretLabels,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("creating secret: %v", err)
+	}
+
+	err = server.client.DeleteSecret(api.NamespaceDefault, name)
+	if err != nil && !k8sErrors.IsNotFound(err) {
+		return fmt.Errorf("deleting secret %s: %v", name, err)
+	}
+	return nil
+}
+
+//probeSecretLabels mark the secrets created by checkCreateSecrets
+var probeSecretLabels = map[string]string{
+	"enrober-readiness": "probe",
+}
+
+//deleteProbeSecrets deletes the probe secrets left behind by earlier checks, of any replica
+//Secrets younger than checkTimeout may belong to a check still running and are left to it
+func (server *Server) deleteProbeSecrets() error {
+	secrets, err := server.client.ListSecrets(api.NamespaceDefault, api.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set(probeSecretLabels)),
+	})
+	if err != nil {
+		return fmt.Errorf("listing probe secrets: %v", err)
+	}
+
+	for _, secret := range secrets.Items {
+		if time.Since(secret.CreationTimestamp.Time) < checkTimeout {
+			continue
+		}
+		err = server.client.DeleteSecret(api.NamespaceDefault, secret.Name)
+		if err != nil && !k8sErrors.IsNotFound(err) {
+			return fmt.Errorf("deleting leftover secret %s: %v", secret.Name, err)
+		}
+	}
+	return nil
+}
+
+//run returns the results of every check, running them concurrently unless the last results are recent enough
+func (rd *readiness) run() []checkResult {
+	rd.mutex.Lock()
+	defer rd.mutex.Unlock()
+
+	if rd.results != nil && time.Since(rd.checkedAt) < readinessCacheTTL {
+		return rd.results
+	}
+
+	results := make([]checkResult, len(rd.checks))
+	var wg sync.WaitGroup
+	for i, check := range rd.checks {
+		wg.Add(1)
+		go func(i int, check healthCheck) {
+			defer wg.Done()
+			results[i] = runCheck(check)
+		}(i, check)
+	}
+	wg.Wait()
+
+	rd.checkedAt = time.Now()
+	rd.results = results
+	return results
+}
+
+//runCheck runs a single check, giving up on it after checkTimeout
+func runCheck(check healthCheck) checkResult {
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- check.run()
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(checkTimeout):
+		err = fmt.Errorf("timed out after %v", checkTimeout)
+	}
+
+	result := checkResult{
+		Name:       check.name,
+		Status:     checkOK,
+		DurationMs: float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	if err != nil {
+		result.Status = checkFailed
+		result.Error = err.Error()
+	}
+	return result
+}
+
+//getHealth is the liveness probe, it only tells the process is serving requests
+//Dependencies are left to readiness so an unreachable Kubernetes API doesn't get enrober restarted
+func getHealth(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, healthResponse{Status: checkOK})
+}
+
+//getReadiness is the readiness probe, it fails with a 503 if any dependency check fails
+func (server *Server) getReadiness(w http.ResponseWriter, r *http.Request) {
+	results := server.readiness.run()
+
+	response := healthResponse{
+		Status: checkOK,
+		Checks: results,
+	}
+	status := http.StatusOK
+	for _, result := range results {
+		if result.Status != checkOK {
+			response.Status = checkFailed
+			status = http.StatusServiceUnavailable
+		}
+	}
+	writeHealth(w, status, response)
+}
+
+func writeHealth(w http.ResponseWriter, status int, response healthResponse) {
+	js, err := json.Marshal(response)
+	if err != nil {
+		helper.WriteError(w, helper.NewAPIError(http.StatusInternalServerError, helper.ErrCodeInternal, "Error marshalling response JSON", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	w.Write(js)
+}
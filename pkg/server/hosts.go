@@ -0,0 +1,112 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/30x/enrober/pkg/helper"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/client/cache"
+	"k8s.io/kubernetes/pkg/controller/framework"
+	"k8s.io/kubernetes/pkg/labels"
+	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/util/wait"
+	"k8s.io/kubernetes/pkg/watch"
+)
+
+const (
+	//hostIndexResync replays every environment namespace to the index now and then, in case an event was missed
+	hostIndexResync = 10 * time.Minute
+	//hostIndexSyncTimeout is how long a request arriving at startup waits for the namespaces to be listed
+	hostIndexSyncTimeout = 5 * time.Second
+)
+
+//hostIndex keeps the hostNames of the environment namespaces in a helper.HostIndex, fed by a namespace informer
+type hostIndex struct {
+	*helper.HostIndex
+	controller *framework.Controller
+}
+
+//newHostIndex starts the namespace informer feeding the index, it runs for the life of the process
+func newHostIndex(client KubeClient) *hostIndex {
+	selector := labels.SelectorFromSet(labels.Set{"runtime": "shipyard"})
+	index := &hostIndex{
+		HostIndex: helper.NewHostIndex(),
+	}
+
+	_, index.controller = framework.NewInformer(
+		&cache.ListWatch{
+			ListFunc: func(options api.ListOptions) (runtime.Object, error) {
+				options.LabelSelector = selector
+				return client.ListNamespaces(options)
+			},
+			WatchFunc: func(options api.ListOptions) (watch.Interface, error) {
+				options.LabelSelector = selector
+				return client.WatchNamespaces(options)
+			},
+		},
+		&api.Namespace{},
+		hostIndexResync,
+		framework.ResourceEventHandlerFuncs{
+			AddFunc: index.observe,
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				index.observe(newObj)
+			},
+			DeleteFunc: index.forget,
+		},
+	)
+	go index.controller.Run(wait.NeverStop)
+
+	return index
+}
+
+func (index *hostIndex) observe(obj interface{}) {
+	ns, ok := obj.(*api.Namespace)
+	if !ok {
+		return
+	}
+	index.Set(ns.Name, strings.Fields(ns.Annotations["hostNames"]))
+}
+
+func (index *hostIndex) forget(obj interface{}) {
+	//The namespace may have been deleted while the watch was down
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	ns, ok := obj.(*api.Namespace)
+	if !ok {
+		return
+	}
+	index.Delete(ns.Name)
+}
+
+//checkHostIndex fails readiness until the informer has listed the namespaces, host names can't be checked before
+func (server *Server) checkHostIndex() error {
+	if !server.hosts.controller.HasSynced() {
+		return fmt.Errorf("namespaces not listed yet")
+	}
+	return nil
+}
+
+//claimHostNames claims hostNames for namespace, writing the error and returning false if they can't be
+//On success release must be called once the namespace is written, after recording its hosts with Set if it was
+func (server *Server) claimHostNames(w http.ResponseWriter, namespace string, hostNames []string) (release func(), ok bool) {
+	err := wait.PollImmediate(100*time.Millisecond, hostIndexSyncTimeout, func() (bool, error) {
+		return server.hosts.controller.HasSynced(), nil
+	})
+	if err != nil {
+		helper.WriteError(w, helper.NewAPIError(http.StatusServiceUnavailable, helper.ErrCodeNotReady, "Host names can't be checked until the namespaces are listed", err))
+		return nil, false
+	}
+
+	conflicts, release := server.hosts.Claim(namespace, hostNames)
+	if conflicts != nil {
+		errorMessage := fmt.Sprintf("Duplicate HostNames: %s", strings.Join(conflicts, " "))
+		helper.WriteError(w, helper.NewAPIError(http.StatusConflict, helper.ErrCodeDuplicateHostName, errorMessage, nil))
+		return nil, false
+	}
+	return release, true
+}
@@ -1,53 +1,113 @@
 package server
 
 import (
-	"os"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/30x/enrober/pkg/config"
+	"github.com/30x/enrober/pkg/metrics"
 
 	"k8s.io/kubernetes/pkg/client/restclient"
+	"k8s.io/kubernetes/pkg/client/unversioned/clientcmd"
+	clientcmdapi "k8s.io/kubernetes/pkg/client/unversioned/clientcmd/api"
 
 	k8sClient "k8s.io/kubernetes/pkg/client/unversioned"
 )
 
-//Init runs once
-func Init(clientConfig restclient.Config) error {
-	var tempClient *k8sClient.Client
+//Init runs once and returns the Kubernetes client to hand to NewServer
+func Init(cfg *config.Config) (KubeClient, error) {
+	clientConfig, err := KubeClientConfig(cfg.Kubernetes)
+	if err != nil {
+		return nil, err
+	}
 
-	//In Cluster Config
-	if clientConfig.Host == "" {
-		tempConfig, err := restclient.InClusterConfig()
-		if err != nil {
-			return err
+	//Count and time every Kubernetes API call
+	wrapTransport := clientConfig.WrapTransport
+	clientConfig.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+		if wrapTransport != nil {
+			rt = wrapTransport(rt)
 		}
-		tempClient, err = k8sClient.New(tempConfig)
-
-		client = *tempClient
-
-		//Local Config
-	} else {
-		tempClient, err := k8sClient.New(&clientConfig)
-		if err != nil {
-			return err
+		return &metrics.Transport{
+			Next:      rt,
+			Operation: kubeOperation,
+			Requests:  metrics.KubernetesRequests,
+			Duration:  metrics.KubernetesRequestDuration,
 		}
-		client = *tempClient
 	}
 
-	//Several features should be disabled for local testing
-	if os.Getenv("DEPLOY_STATE") == "PROD" {
+	tempClient, err := k8sClient.New(clientConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewKubeClient(tempClient), nil
+}
 
-		if os.Getenv("ISOLATE_NAMESPACE") == "true" {
-			isolateNamespace = true
+//KubeClientConfig returns the client config to connect to Kubernetes with
+//A kubeconfig (or context of the default kubeconfig) comes first, with the other settings overriding it,
+//then the master with the given TLS settings and credentials, and finally the in-cluster service account
+func KubeClientConfig(cfg config.Kubernetes) (*restclient.Config, error) {
+	switch {
+	case cfg.Kubeconfig != "" || cfg.Context != "":
+		loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+		//KUBECONFIG may hold a list of files like it does for kubectl
+		if paths := filepath.SplitList(cfg.Kubeconfig); len(paths) > 1 {
+			loadingRules.Precedence = paths
+		} else {
+			loadingRules.ExplicitPath = cfg.Kubeconfig
 		}
 
-		//Set privileged container flag
-		if os.Getenv("ALLOW_PRIV_CONTAINERS") == "true" {
-			allowPrivilegedContainers = true
+		overrides := &clientcmd.ConfigOverrides{
+			CurrentContext: cfg.Context,
+			ClusterInfo: clientcmdapi.Cluster{
+				Server:                cfg.Master,
+				CertificateAuthority:  cfg.CertificateAuthority,
+				InsecureSkipTLSVerify: cfg.InsecureSkipTLSVerify,
+			},
+			AuthInfo: clientcmdapi.AuthInfo{
+				ClientCertificate: cfg.ClientCertificate,
+				ClientKey:         cfg.ClientKey,
+				Token:             cfg.Token,
+			},
 		}
 
-		//Set apigeeKVM flag
-		if os.Getenv("APIGEE_KVM") == "true" {
-			apigeeKVM = true
+		clientConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides).ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("loading kubeconfig %s: %v", describeKubeconfig(cfg), err)
+		}
+		return clientConfig, nil
+
+	case cfg.Master != "":
+		return &restclient.Config{
+			Host:        cfg.Master,
+			BearerToken: cfg.Token,
+			Insecure:    cfg.InsecureSkipTLSVerify,
+			TLSClientConfig: restclient.TLSClientConfig{
+				CAFile:   cfg.CertificateAuthority,
+				CertFile: cfg.ClientCertificate,
+				KeyFile:  cfg.ClientKey,
+			},
+		}, nil
+
+	default:
+		clientConfig, err := restclient.InClusterConfig()
+		if err != nil {
+			return nil, fmt.Errorf("no master or kubeconfig given and in-cluster config unavailable: %v", err)
 		}
+		return clientConfig, nil
 	}
+}
 
-	return nil
+//describeKubeconfig names the kubeconfig and context in errors
+func describeKubeconfig(cfg config.Kubernetes) string {
+	var parts []string
+	if cfg.Kubeconfig != "" {
+		parts = append(parts, cfg.Kubeconfig)
+	}
+	if cfg.Context != "" {
+		parts = append(parts, "context "+cfg.Context)
+	}
+	return strings.Join(parts, " ")
 }
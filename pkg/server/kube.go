@@ -0,0 +1,175 @@
+package server
+
+import (
+	"io"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/apis/extensions"
+	"k8s.io/kubernetes/pkg/watch"
+
+	k8sClient "k8s.io/kubernetes/pkg/client/unversioned"
+)
+
+//KubeClient is the narrow set of Kubernetes calls the server handlers make
+type KubeClient interface {
+	//Namespaces
+	CreateNamespace(namespace *api.Namespace) (*api.Namespace, error)
+	GetNamespace(name string) (*api.Namespace, error)
+	ListNamespaces(opts api.ListOptions) (*api.NamespaceList, error)
+	WatchNamespaces(opts api.ListOptions) (watch.Interface, error)
+	UpdateNamespace(namespace *api.Namespace) (*api.Namespace, error)
+	DeleteNamespace(name string) error
+
+	//Secrets
+	CreateSecret(namespace string, secret *api.Secret) (*api.Secret, error)
+	GetSecret(namespace, name string) (*api.Secret, error)
+	ListSecrets(namespace string, opts api.ListOptions) (*api.SecretList, error)
+	UpdateSecret(namespace string, secret *api.Secret) (*api.Secret, error)
+	DeleteSecret(namespace, name string) error
+
+	//Services
+	CreateService(namespace string, service *api.Service) (*api.Service, error)
+	GetService(namespace, name string) (*api.Service, error)
+	UpdateService(namespace string, service *api.Service) (*api.Service, error)
+	DeleteService(namespace, name string) error
+
+	//Deployments
+	CreateDeployment(namespace string, deployment *extensions.Deployment) (*extensions.Deployment, error)
+	GetDeployment(namespace, name string) (*extensions.Deployment, error)
+	ListDeployments(namespace string, opts api.ListOptions) (*extensions.DeploymentList, error)
+	UpdateDeployment(namespace string, deployment *extensions.Deployment) (*extensions.Deployment, error)
+	DeleteDeployment(namespace, name string) error
+
+	//Replica Sets
+	ListReplicaSets(namespace string, opts api.ListOptions) (*extensions.ReplicaSetList, error)
+	DeleteReplicaSet(namespace, name string) error
+
+	//Pods
+	ListPods(namespace string, opts api.ListOptions) (*api.PodList, error)
+	DeletePod(namespace, name string) error
+	GetPodLogs(namespace, name string, opts *api.PodLogOptions) (io.ReadCloser, error)
+
+	//Events
+	CreateEvent(namespace string, event *api.Event) (*api.Event, error)
+	ListEvents(namespace string, opts api.ListOptions) (*api.EventList, error)
+}
+
+//kubeClient implements KubeClient on top of a real Kubernetes client
+type kubeClient struct {
+	client *k8sClient.Client
+}
+
+//NewKubeClient wraps a Kubernetes client so it can be passed to NewServer
+func NewKubeClient(client *k8sClient.Client) KubeClient {
+	return &kubeClient{
+		client: client,
+	}
+}
+
+func (k *kubeClient) CreateNamespace(namespace *api.Namespace) (*api.Namespace, error) {
+	return k.client.Namespaces().Create(namespace)
+}
+
+func (k *kubeClient) GetNamespace(name string) (*api.Namespace, error) {
+	return k.client.Namespaces().Get(name)
+}
+
+func (k *kubeClient) ListNamespaces(opts api.ListOptions) (*api.NamespaceList, error) {
+	return k.client.Namespaces().List(opts)
+}
+
+func (k *kubeClient) WatchNamespaces(opts api.ListOptions) (watch.Interface, error) {
+	return k.client.Namespaces().Watch(opts)
+}
+
+func (k *kubeClient) UpdateNamespace(namespace *api.Namespace) (*api.Namespace, error) {
+	return k.client.Namespaces().Update(namespace)
+}
+
+func (k *kubeClient) DeleteNamespace(name string) error {
+	return k.client.Namespaces().Delete(name)
+}
+
+func (k *kubeClient) CreateSecret(namespace string, secret *api.Secret) (*api.Secret, error) {
+	return k.client.Secrets(namespace).Create(secret)
+}
+
+func (k *kubeClient) GetSecret(namespace, name string) (*api.Secret, error) {
+	return k.client.Secrets(namespace).Get(name)
+}
+
+func (k *kubeClient) ListSecrets(namespace string, opts api.ListOptions) (*api.SecretList, error) {
+	return k.client.Secrets(namespace).List(opts)
+}
+
+func (k *kubeClient) UpdateSecret(namespace string, secret *api.Secret) (*api.Secret, error) {
+	return k.client.Secrets(namespace).Update(secret)
+}
+
+func (k *kubeClient) DeleteSecret(namespace, name string) error {
+	return k.client.Secrets(namespace).Delete(name)
+}
+
+func (k *kubeClient) CreateService(namespace string, service *api.Service) (*api.Service, error) {
+	return k.client.Services(namespace).Create(service)
+}
+
+func (k *kubeClient) GetService(namespace, name string) (*api.Service, error) {
+	return k.client.Services(namespace).Get(name)
+}
+
+func (k *kubeClient) UpdateService(namespace string, service *api.Service) (*api.Service, error) {
+	return k.client.Services(namespace).Update(service)
+}
+
+func (k *kubeClient) DeleteService(namespace, name string) error {
+	return k.client.Services(namespace).Delete(name)
+}
+
+func (k *kubeClient) CreateDeployment(namespace string, deployment *extensions.Deployment) (*extensions.Deployment, error) {
+	return k.client.Deployments(namespace).Create(deployment)
+}
+
+func (k *kubeClient) GetDeployment(namespace, name string) (*extensions.Deployment, error) {
+	return k.client.Deployments(namespace).Get(name)
+}
+
+func (k *kubeClient) ListDeployments(namespace string, opts api.ListOptions) (*extensions.DeploymentList, error) {
+	return k.client.Deployments(namespace).List(opts)
+}
+
+func (k *kubeClient) UpdateDeployment(namespace string, deployment *extensions.Deployment) (*extensions.Deployment, error) {
+	return k.client.Deployments(namespace).Update(deployment)
+}
+
+func (k *kubeClient) DeleteDeployment(namespace, name string) error {
+	return k.client.Deployments(namespace).Delete(name, &api.DeleteOptions{})
+}
+
+func (k *kubeClient) ListReplicaSets(namespace string, opts api.ListOptions) (*extensions.ReplicaSetList, error) {
+	return k.client.ReplicaSets(namespace).List(opts)
+}
+
+func (k *kubeClient) DeleteReplicaSet(namespace, name string) error {
+	return k.client.ReplicaSets(namespace).Delete(name, &api.DeleteOptions{})
+}
+
+func (k *kubeClient) ListPods(namespace string, opts api.ListOptions) (*api.PodList, error) {
+	return k.client.Pods(namespace).List(opts)
+}
+
+func (k *kubeClient) DeletePod(namespace, name string) error {
+	return k.client.Pods(namespace).Delete(name, &api.DeleteOptions{})
+}
+
+func (k *kubeClient) GetPodLogs(namespace, name string, opts *api.PodLogOptions) (io.ReadCloser, error) {
+	return k.client.Pods(namespace).GetLogs(name, opts).Stream()
+}
+
+func (k *kubeClient) CreateEvent(namespace string, event *api.Event) (*api.Event, error) {
+	return k.client.Events(namespace).Create(event)
+}
+
+func (k *kubeClient) ListEvents(namespace string, opts api.ListOptions) (*api.EventList, error) {
+	return k.client.Events(namespace).List(opts)
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/30x/enrober/pkg/helper"
+	"github.com/30x/enrober/pkg/logging"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+)
+
+//podLogStream is an open log stream of a single pod
+type podLogStream struct {
+	pod    string
+	stream io.ReadCloser
+}
+
+//logLine is a single line read from a followed pod log
+type logLine struct {
+	pod  string
+	line string
+}
+
+//parseLogOptions reads the log query parameters into pod log options
+//It also returns whether the logs should be followed
+func parseLogOptions(r *http.Request) (*api.PodLogOptions, bool, *helper.APIError) {
+	queries := r.URL.Query()
+	podLogOpts := &api.PodLogOptions{
+		Container: queries.Get("container"),
+	}
+
+	if tailString := queries.Get("tail"); tailString != "" {
+		tail, err := strconv.ParseInt(tailString, 10, 64)
+		if err != nil || tail < 0 {
+			return nil, false, helper.NewAPIError(http.StatusBadRequest, helper.ErrCodeInvalidQueryParameter, "Invalid tail value", err)
+		}
+		podLogOpts.TailLines = &tail
+	}
+
+	boolParams := map[string]*bool{
+		"previous":   &podLogOpts.Previous,
+		"timestamps": &podLogOpts.Timestamps,
+		"follow":     &podLogOpts.Follow,
+	}
+	for name, value := range boolParams {
+		if queries.Get(name) == "" {
+			continue
+		}
+		parsed, err := strconv.ParseBool(queries.Get(name))
+		if err != nil {
+			return nil, false, helper.NewAPIError(http.StatusBadRequest, helper.ErrCodeInvalidQueryParameter, fmt.Sprintf("Invalid %s value", name), err)
+		}
+		*value = parsed
+	}
+
+	sinceSecondsString := queries.Get("sinceSeconds")
+	sinceTimeString := queries.Get("sinceTime")
+	if sinceSecondsString != "" && sinceTimeString != "" {
+		return nil, false, helper.NewAPIError(http.StatusBadRequest, helper.ErrCodeInvalidQueryParameter, "Only one of sinceSeconds or sinceTime may be given", nil)
+	}
+
+	if sinceSecondsString != "" {
+		sinceSeconds, err := strconv.ParseInt(sinceSecondsString, 10, 64)
+		if err != nil || sinceSeconds <= 0 {
+			return nil, false, helper.NewAPIError(http.StatusBadRequest, helper.ErrCodeInvalidQueryParameter, "Invalid sinceSeconds value", err)
+		}
+		podLogOpts.SinceSeconds = &sinceSeconds
+	}
+
+	if sinceTimeString != "" {
+		sinceTime, err := time.Parse(time.RFC3339, sinceTimeString)
+		if err != nil {
+			return nil, false, helper.NewAPIError(http.StatusBadRequest, helper.ErrCodeInvalidQueryParameter, "Invalid sinceTime value, expected RFC3339", err)
+		}
+		since := unversioned.NewTime(sinceTime)
+		podLogOpts.SinceTime = &since
+	}
+
+	return podLogOpts, podLogOpts.Follow, nil
+}
+
+//closeLogStreams closes every stream, used when the response can't be written
+func closeLogStreams(streams []podLogStream) {
+	for _, stream := range streams {
+		stream.stream.Close()
+	}
+}
+
+//flush sends whatever has been written so far to the client
+func flush(w http.ResponseWriter) {
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+//writeLogs copies each pod's log to the response one after the other without buffering
+func writeLogs(logger *logging.Logger, w http.ResponseWriter, streams []podLogStream) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(200)
+
+	for _, stream := range streams {
+		fmt.Fprintf(w, "Logs for pod: %v\n", stream.pod)
+		_, err := io.Copy(w, stream.stream)
+		stream.stream.Close()
+		if err != nil {
+			logger.Errorf("Error copying log stream of pod %s: %v", stream.pod, err)
+		}
+		flush(w)
+	}
+}
+
+//followLogs interleaves the lines of every pod's log as they arrive, prefixing each with the pod name
+//Lines are written as server sent events when the client accepts them and as chunked plain text otherwise
+func followLogs(w http.ResponseWriter, r *http.Request, streams []podLogStream) {
+	sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "text/plain")
+	}
+	w.WriteHeader(200)
+	flush(w)
+
+	lines := make(chan logLine)
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+
+	for _, stream := range streams {
+		readers.Add(1)
+		go func(stream podLogStream) {
+			defer readers.Done()
+			reader := bufio.NewReader(stream.stream)
+			for {
+				line, err := reader.ReadString('\n')
+				if line != "" {
+					select {
+					case lines <- logLine{pod: stream.pod, line: strings.TrimRight(line, "\n")}:
+					case <-done:
+						return
+					}
+				}
+				if err != nil {
+					if err != io.EOF {
+						logging.FromContext(r.Context()).Errorf("Error reading log stream of pod %s: %v", stream.pod, err)
+					}
+					return
+				}
+			}
+		}(stream)
+	}
+
+	//Close lines once every pod's log has ended
+	go func() {
+		readers.Wait()
+		close(lines)
+	}()
+
+	//Closing the streams unblocks the readers when the client goes away
+	defer func() {
+		close(done)
+		closeLogStreams(streams)
+	}()
+
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return
+			}
+			var err error
+			if sse {
+				_, err = fmt.Fprintf(w, "data: [%s] %s\n\n", line.pod, line.line)
+			} else {
+				_, err = fmt.Fprintf(w, "[%s] %s\n", line.pod, line.line)
+			}
+			if err != nil {
+				return
+			}
+			flush(w)
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
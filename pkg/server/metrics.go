@@ -0,0 +1,113 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/30x/enrober/pkg/helper"
+	"github.com/30x/enrober/pkg/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/labels"
+)
+
+//kubeOperation names a Kubernetes API call from its path, e.g. /apis/extensions/v1beta1/namespaces/x/deployments is "list deployments"
+func kubeOperation(r *http.Request) string {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(segments) >= 2 && segments[0] == "api":
+		segments = segments[2:]
+	case len(segments) >= 3 && segments[0] == "apis":
+		segments = segments[3:]
+	}
+
+	if len(segments) > 0 && segments[0] == "watch" {
+		return "watch " + strings.TrimPrefix(metrics.RESTOperation("GET", segments[1:]), "list ")
+	}
+	if r.URL.Query().Get("watch") == "true" {
+		return "watch " + strings.TrimPrefix(metrics.RESTOperation("GET", segments), "list ")
+	}
+	return metrics.RESTOperation(r.Method, segments)
+}
+
+//apigeeOperation names an Apigee management API call from its path, e.g. "update entries"
+func apigeeOperation(r *http.Request) string {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(segments) > 0 && segments[0] == "v1" {
+		segments = segments[1:]
+	}
+	return metrics.RESTOperation(r.Method, segments)
+}
+
+//observeSteps counts the steps of an environment operation by their status
+func observeSteps(operation string, results []helper.StepResult) {
+	for _, result := range results {
+		metrics.EnvironmentSteps.WithLabelValues(operation, result.Step, result.Status).Inc()
+	}
+}
+
+//inventoryCollector reports the environments and deployments enrober manages, listed from Kubernetes on each scrape
+type inventoryCollector struct {
+	client       KubeClient
+	environments *prometheus.Desc
+	deployments  *prometheus.Desc
+}
+
+func newInventoryCollector(client KubeClient) *inventoryCollector {
+	return &inventoryCollector{
+		client:       client,
+		environments: prometheus.NewDesc("enrober_environments", "Environments managed by enrober by organization.", []string{"organization"}, nil),
+		deployments:  prometheus.NewDesc("enrober_deployments", "Deployments in environments managed by enrober by organization.", []string{"organization"}, nil),
+	}
+}
+
+func (c *inventoryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.environments
+	ch <- c.deployments
+}
+
+func (c *inventoryCollector) Collect(ch chan<- prometheus.Metric) {
+	selector, err := labels.Parse("runtime=shipyard")
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.environments, err)
+		return
+	}
+	nsList, err := c.client.ListNamespaces(api.ListOptions{
+		LabelSelector: selector,
+	})
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.environments, err)
+		return
+	}
+
+	environments := map[string]float64{}
+	deployments := map[string]float64{}
+	orgs := map[string]string{}
+	for _, ns := range nsList.Items {
+		org := ns.Labels["organization"]
+		orgs[ns.Name] = org
+		environments[org]++
+		deployments[org] += 0
+	}
+	for org, count := range environments {
+		ch <- prometheus.MustNewConstMetric(c.environments, prometheus.GaugeValue, count, org)
+	}
+
+	depList, err := c.client.ListDeployments(api.NamespaceAll, api.ListOptions{
+		LabelSelector: labels.Everything(),
+	})
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.deployments, err)
+		return
+	}
+	for _, dep := range depList.Items {
+		if org, ok := orgs[dep.Namespace]; ok {
+			deployments[org]++
+		}
+	}
+	for org, count := range deployments {
+		ch <- prometheus.MustNewConstMetric(c.deployments, prometheus.GaugeValue, count, org)
+	}
+}
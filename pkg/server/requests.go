@@ -0,0 +1,215 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/30x/enrober/pkg/audit"
+	"github.com/30x/enrober/pkg/auth"
+	"github.com/30x/enrober/pkg/helper"
+	"github.com/30x/enrober/pkg/logging"
+	"github.com/30x/enrober/pkg/metrics"
+
+	"github.com/gorilla/mux"
+)
+
+//requestIDHeader carries the ID of a request, it is echoed on every response
+const requestIDHeader = "X-Request-Id"
+
+//Request IDs given by callers are kept if they look like one
+var validRequestIDRegex = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+//quietRoutes are polled by probes and scrapers, they are only logged at debug level unless they fail
+var quietRoutes = map[string]bool{
+	"/healthz":             true,
+	"/readyz":              true,
+	"/metrics":             true,
+	"/environments/status": true,
+}
+
+//requestState is what is learned about a request while it is handled
+type requestState struct {
+	id       string
+	response *responseRecorder
+
+	mutex      sync.Mutex
+	route      string
+	target     audit.Target
+	caller     string
+	identified bool
+}
+
+type requestStateKey struct{}
+
+func stateOf(r *http.Request) *requestState {
+	state, _ := r.Context().Value(requestStateKey{}).(*requestState)
+	return state
+}
+
+//responseRecorder remembers the status, size and error of a response
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+	err    *helper.APIError
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+//Flush keeps followed logs streaming through the recorder
+func (rec *responseRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+//RecordError keeps the error written by helper.WriteError for the request log line
+func (rec *responseRecorder) RecordError(err *helper.APIError) {
+	rec.err = err
+}
+
+//observe gives every request an ID and a logger, and logs and measures it once handled
+func observe(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if !validRequestIDRegex.MatchString(requestID) {
+			requestID = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		state := &requestState{
+			id:       requestID,
+			response: rec,
+			route:    "unknown",
+		}
+		ctx := context.WithValue(r.Context(), requestStateKey{}, state)
+		ctx = logging.NewContext(ctx, logging.Default().With("requestId", requestID))
+		r = r.WithContext(ctx)
+
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+		duration := time.Since(start)
+
+		state.mutex.Lock()
+		route := state.route
+		state.mutex.Unlock()
+
+		code := strconv.Itoa(rec.status)
+		metrics.Requests.WithLabelValues(route, r.Method, code).Inc()
+		metrics.RequestDuration.WithLabelValues(route, r.Method, code).Observe(duration.Seconds())
+
+		logger := logging.FromContext(ctx).With(
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"durationMs", float64(duration)/float64(time.Millisecond),
+			"remoteAddr", r.RemoteAddr,
+		)
+		level := logging.LevelInfo
+		if quietRoutes[route] {
+			level = logging.LevelDebug
+		}
+		if rec.err != nil {
+			logger = logger.With("errorCode", rec.err.Code, "error", rec.err.Error())
+			if rec.status >= 400 && rec.status < 500 {
+				level = logging.LevelWarn
+			}
+		}
+		if rec.status >= 500 {
+			level = logging.LevelError
+		}
+		logger.Log(level, "%s %s %d", r.Method, r.URL.Path, rec.status)
+	})
+}
+
+//routed records the matched route and its org, env and deployment
+//It is router middleware since they are only known once the request is routed
+func routed(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if state := stateOf(r); state != nil {
+			if template, err := mux.CurrentRoute(r).GetPathTemplate(); err == nil {
+				state.mutex.Lock()
+				state.route = template
+				state.mutex.Unlock()
+			}
+		}
+
+		pathVars := mux.Vars(r)
+		setTarget(r, audit.Target{
+			Organization: pathVars["org"],
+			Environment:  pathVars["env"],
+			Deployment:   pathVars["deployment"],
+		})
+		next.ServeHTTP(w, r)
+	})
+}
+
+//setTarget records what the request acts on for the request logger and the audit record
+func setTarget(r *http.Request, target audit.Target) {
+	if state := stateOf(r); state != nil {
+		state.mutex.Lock()
+		state.target = target
+		state.mutex.Unlock()
+	}
+
+	var fields []interface{}
+	for _, field := range []struct{ name, value string }{
+		{"org", target.Organization},
+		{"env", target.Environment},
+		{"deployment", target.Deployment},
+	} {
+		if field.value != "" {
+			fields = append(fields, field.name, field.value)
+		}
+	}
+	logging.AddFields(r.Context(), fields...)
+}
+
+//identify records the caller for the request logger and the audit record the first time the request is authorized
+func (server *Server) identify(r *http.Request) {
+	identifier, ok := server.authorizer.(auth.Identifier)
+	state := stateOf(r)
+	if !ok || state == nil {
+		return
+	}
+
+	state.mutex.Lock()
+	identified := state.identified
+	state.identified = true
+	state.mutex.Unlock()
+	if identified {
+		return
+	}
+
+	if caller := identifier.Identify(r); caller != "" {
+		state.mutex.Lock()
+		state.caller = caller
+		state.mutex.Unlock()
+		logging.AddFields(r.Context(), "caller", caller)
+	}
+}
+
+//newRequestID returns a random 128 bit hex ID
+func newRequestID() string {
+	b, err := helper.GenerateRandomBytes(16)
+	if err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"sort"
+	"strconv"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/apis/extensions"
+	"k8s.io/kubernetes/pkg/labels"
+)
+
+const (
+	//Annotation the deployment controller puts on deployments and replica sets
+	revisionAnnotation = "deployment.kubernetes.io/revision"
+
+	//Label the deployment controller adds to the pod template of each replica set
+	podTemplateHashLabel = "pod-template-hash"
+)
+
+//revisionOf returns the deployment revision recorded on an object, 0 if it has none
+func revisionOf(meta api.ObjectMeta) int64 {
+	revision, err := strconv.ParseInt(meta.Annotations[revisionAnnotation], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return revision
+}
+
+//byRevision sorts replica sets newest revision first
+type byRevision []extensions.ReplicaSet
+
+func (s byRevision) Len() int      { return len(s) }
+func (s byRevision) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byRevision) Less(i, j int) bool {
+	return revisionOf(s[i].ObjectMeta) > revisionOf(s[j].ObjectMeta)
+}
+
+//revisionReplicaSets returns the replica sets kept for a deployment, newest revision first
+func (server *Server) revisionReplicaSets(namespace string, dep *extensions.Deployment) ([]extensions.ReplicaSet, error) {
+	var selector labels.Selector
+	if dep.Spec.Selector != nil {
+		selector = labels.SelectorFromSet(labels.Set(dep.Spec.Selector.MatchLabels))
+	} else {
+		selector = labels.SelectorFromSet(labels.Set(dep.Spec.Template.Labels))
+	}
+
+	rsList, err := server.client.ListReplicaSets(namespace, api.ListOptions{
+		LabelSelector: selector,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	replicaSets := []extensions.ReplicaSet{}
+	for _, rs := range rsList.Items {
+		if revisionOf(rs.ObjectMeta) != 0 {
+			replicaSets = append(replicaSets, rs)
+		}
+	}
+	sort.Sort(byRevision(replicaSets))
+	return replicaSets, nil
+}
+
+//revisionFromReplicaSet summarizes the pod template spec a replica set was created from
+func revisionFromReplicaSet(rs extensions.ReplicaSet, current int64) deploymentRevision {
+	revision := deploymentRevision{
+		Revision:     revisionOf(rs.ObjectMeta),
+		ReplicaSet:   rs.GetName(),
+		Replicas:     rs.Spec.Replicas,
+		PublicHosts:  rs.Spec.Template.Annotations["publicHosts"],
+		PrivateHosts: rs.Spec.Template.Annotations["privateHosts"],
+		Containers:   []revisionContainer{},
+	}
+	revision.Current = revision.Revision == current
+
+	for _, container := range rs.Spec.Template.Spec.Containers {
+		revision.Containers = append(revision.Containers, revisionContainer{
+			Name:  container.Name,
+			Image: container.Image,
+			Env:   container.Env,
+		})
+	}
+	return revision
+}
+
+//rollbackTemplate returns the pod template spec of a replica set as it was on the deployment
+func rollbackTemplate(rs extensions.ReplicaSet) api.PodTemplateSpec {
+	template := rs.Spec.Template
+
+	labels := make(map[string]string, len(template.Labels))
+	for key, value := range template.Labels {
+		if key != podTemplateHashLabel {
+			labels[key] = value
+		}
+	}
+	template.Labels = labels
+	return template
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/30x/enrober/pkg/auth"
+	"github.com/30x/enrober/pkg/helper"
+	"github.com/30x/enrober/pkg/logging"
+
+	"github.com/gorilla/mux"
+
+	"k8s.io/kubernetes/pkg/api"
+	k8sErrors "k8s.io/kubernetes/pkg/api/errors"
+)
+
+//Namespace annotation holding the JSON map of subject to role bound in an environment
+const roleBindingsAnnotation = "roleBindings"
+
+//namespaceRoleBindings reads role bindings from the annotation of each environment's namespace
+type namespaceRoleBindings struct {
+	client KubeClient
+}
+
+//NewRoleBindings returns the role bindings stored on the environment namespaces, to be used with auth.New
+func NewRoleBindings(client KubeClient) auth.RoleBindings {
+	return namespaceRoleBindings{
+		client: client,
+	}
+}
+
+//Role returns the role bound to subject in the environment, a missing environment has no bindings
+func (b namespaceRoleBindings) Role(org, env, subject string) (auth.Role, error) {
+	ns, err := b.client.GetNamespace(org + "-" + env)
+	if k8sErrors.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return listedRoleBindings{ns}.Role(org, env, subject)
+}
+
+//listedRoleBindings reads the role bindings of a namespace already at hand
+type listedRoleBindings struct {
+	ns *api.Namespace
+}
+
+//Role returns the role bound to subject in the namespace
+func (b listedRoleBindings) Role(org, env, subject string) (auth.Role, error) {
+	bindings, err := parseRoleBindings(b.ns)
+	if err != nil {
+		return "", err
+	}
+	return bindings[subject], nil
+}
+
+//parseRoleBindings decodes the role bindings annotation of a namespace
+func parseRoleBindings(ns *api.Namespace) (map[string]auth.Role, error) {
+	bindings := map[string]auth.Role{}
+	raw := ns.Annotations[roleBindingsAnnotation]
+	if raw == "" {
+		return bindings, nil
+	}
+	err := json.Unmarshal([]byte(raw), &bindings)
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s annotation of %s: %v", roleBindingsAnnotation, ns.GetName(), err)
+	}
+	return bindings, nil
+}
+
+//getRoleBindings returns the roles bound in an environment
+func (server *Server) getRoleBindings(w http.ResponseWriter, r *http.Request) {
+	pathVars := mux.Vars(r)
+
+	getNs, err := server.client.GetNamespace(pathVars["org"] + "-" + pathVars["env"])
+	if err != nil {
+		helper.WriteError(w, kubeError(err, helper.ErrCodeEnvironmentNotFound, "Error getting existing Environment"))
+		return
+	}
+
+	bindings, err := parseRoleBindings(getNs)
+	if err != nil {
+		helper.WriteError(w, helper.NewAPIError(http.StatusInternalServerError, helper.ErrCodeInternal, "Error reading role bindings", err))
+		return
+	}
+
+	js, err := json.Marshal(roleBindings{Bindings: bindings})
+	if err != nil {
+		helper.WriteError(w, helper.NewAPIError(http.StatusInternalServerError, helper.ErrCodeInternal, "Error marshalling response JSON", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(js)
+}
+
+//updateRoleBindings replaces the roles bound in an environment
+func (server *Server) updateRoleBindings(w http.ResponseWriter, r *http.Request) {
+	pathVars := mux.Vars(r)
+
+	var tempJSON roleBindings
+	err := json.NewDecoder(r.Body).Decode(&tempJSON)
+	if err != nil {
+		helper.WriteError(w, helper.NewAPIError(http.StatusBadRequest, helper.ErrCodeInvalidJSON, "Error decoding JSON Body", err))
+		return
+	}
+	if tempJSON.Bindings == nil {
+		tempJSON.Bindings = map[string]auth.Role{}
+	}
+
+	for subject, role := range tempJSON.Bindings {
+		if subject == "" || !role.Valid() {
+			errorMessage := fmt.Sprintf("Invalid role %s for subject %s, expected %s, %s or %s", role, subject, auth.RoleViewer, auth.RoleDeployer, auth.RoleAdmin)
+			helper.WriteError(w, helper.NewAPIError(http.StatusBadRequest, helper.ErrCodeInvalidRole, errorMessage, nil))
+			return
+		}
+	}
+
+	getNs, err := server.client.GetNamespace(pathVars["org"] + "-" + pathVars["env"])
+	if err != nil {
+		helper.WriteError(w, kubeError(err, helper.ErrCodeEnvironmentNotFound, "Error getting existing Environment"))
+		return
+	}
+
+	annotation, err := json.Marshal(tempJSON.Bindings)
+	if err != nil {
+		helper.WriteError(w, helper.NewAPIError(http.StatusInternalServerError, helper.ErrCodeInternal, "Error marshalling role bindings", err))
+		return
+	}
+	if getNs.Annotations == nil {
+		getNs.Annotations = map[string]string{}
+	}
+	getNs.Annotations[roleBindingsAnnotation] = string(annotation)
+
+	_, err = server.client.UpdateNamespace(getNs)
+	if err != nil {
+		helper.WriteError(w, kubeError(err, helper.ErrCodeEnvironmentNotFound, "Error updating role bindings"))
+		return
+	}
+
+	js, err := json.Marshal(tempJSON)
+	if err != nil {
+		helper.WriteError(w, helper.NewAPIError(http.StatusInternalServerError, helper.ErrCodeInternal, "Error marshalling response JSON", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(js)
+
+	logging.FromContext(r.Context()).Infof("Updated role bindings of Namespace: %s", getNs.GetName())
+}
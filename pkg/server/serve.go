@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/30x/enrober/pkg/helper"
+	"github.com/30x/enrober/pkg/logging"
+)
+
+//Start serves the API on the configured address until SIGTERM or SIGINT, then drains in-flight requests
+func (server *Server) Start() error {
+	listener, err := net.Listen("tcp", server.config.HTTP.Address)
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(stop)
+
+	return server.Serve(listener, stop)
+}
+
+//Serve serves the API on listener, over HTTPS if a certificate is configured, until stop receives a signal
+//New connections are then refused and in-flight requests get the shutdown timeout to finish before their connections are closed,
+//so a rolling update doesn't cut off half-provisioned environments
+func (server *Server) Serve(listener net.Listener, stop <-chan os.Signal) error {
+	cfg := server.config.HTTP
+
+	//Cancelled once shutting down so requests waiting on rollouts or following logs finish within the shutdown timeout
+	requestsCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
+	httpServer := &http.Server{
+		Handler:      server.Router,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+		BaseContext: func(net.Listener) context.Context {
+			return requestsCtx
+		},
+	}
+
+	//Previous keys whose grace period ended while no replica was running are expired right away
+	reconcileStop := make(chan struct{})
+	defer close(reconcileStop)
+	go server.reconcilePreviousKeys(reconcileStop)
+
+	served := make(chan error, 1)
+	if cfg.TLSCertFile != "" {
+		reloader, err := helper.NewCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		httpServer.TLSConfig = &tls.Config{
+			GetCertificate: reloader.GetCertificate,
+		}
+		go func() {
+			served <- httpServer.ServeTLS(listener, "", "")
+		}()
+		logging.Infof("Serving HTTPS on %s", listener.Addr())
+	} else {
+		go func() {
+			served <- httpServer.Serve(listener)
+		}()
+		logging.Infof("Serving HTTP on %s", listener.Addr())
+	}
+
+	select {
+	case err := <-served:
+		return err
+	case sig := <-stop:
+		logging.Infof("Received %v, draining in-flight requests", sig)
+	}
+	cancelRequests()
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	err := httpServer.Shutdown(ctx)
+	if err != nil {
+		logging.Warnf("Requests still in flight after %v, closing their connections: %v", cfg.ShutdownTimeout, err)
+		httpServer.Close()
+	}
+
+	//Serve returns http.ErrServerClosed once shut down
+	<-served
+	logging.Infof("Server stopped")
+	return nil
+}
@@ -7,12 +7,12 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 
 	"k8s.io/kubernetes/pkg/api"
@@ -20,103 +20,143 @@ import (
 	"k8s.io/kubernetes/pkg/apis/extensions"
 	"k8s.io/kubernetes/pkg/labels"
 
-	k8sClient "k8s.io/kubernetes/pkg/client/unversioned"
-
+	"github.com/30x/enrober/pkg/apigee"
+	"github.com/30x/enrober/pkg/audit"
+	"github.com/30x/enrober/pkg/auth"
+	"github.com/30x/enrober/pkg/config"
 	"github.com/30x/enrober/pkg/helper"
+	"github.com/30x/enrober/pkg/logging"
+	"github.com/30x/enrober/pkg/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 const (
 	apigeeKVMName   = "shipyard-routing"
 	apigeeKVMPKName = "x-routing-api-key"
+	//KVM entry holding the previous public key during the grace period of a rotation
+	apigeeKVMPreviousPKName = "x-routing-api-key-previous"
+
+	//Keys in the routing secret
+	publicKeyName          = "public-api-key"
+	privateKeyName         = "private-api-key"
+	previousPublicKeyName  = "previous-public-api-key"
+	previousPrivateKeyName = "previous-private-api-key"
+
+	//Routing secret annotation holding the RFC3339 time the previous keys stop being valid
+	previousKeysExpireAnnotation = "previousKeysExpireAt"
+	//Routing secret annotation set while the previous public key is in the Apigee KVM
+	previousKVMKeyAnnotation = "previousKVMKey"
+	//previousKeysReconcileInterval is how often previous keys past their grace period are looked for
+	previousKeysReconcileInterval = 5 * time.Minute
+
+	//Namespace annotation used to isolate namespaces
+	networkPolicyAnnotation = "net.beta.kubernetes.io/network-policy"
 )
 
 //Global Vars
 var (
-	//Kubernetes Client
-	client k8sClient.Client
-
 	//Global Regex
 	validIPAddressRegex = regexp.MustCompile(`^(([0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])\.){3}([0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])$`)
 	validHostnameRegex  = regexp.MustCompile(`^(([a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9\-]*[a-zA-Z0-9])\.)*([A-Za-z0-9]|[A-Za-z0-9][A-Za-z0-9\-]*[A-Za-z0-9])$`)
 
 	//Env Name Regex
 	envNameRegex = regexp.MustCompile(`\w+\:\w+`)
-
-	//Privileged container flag
-	allowPrivilegedContainers bool
-
-	//Namespace Isolation
-	isolateNamespace bool
-
-	//Apigee KVM check
-	apigeeKVM bool
 )
 
 //NOTE: routing secret should probably be a configurable name
 
-//NewServer creates a new server
-func NewServer() (server *Server) {
+//NewServer creates a new server backed by the given Kubernetes client
+//Every request is checked with the given authorizer, cfg selects the enabled features
+//Mutating requests are recorded to auditSink, which may be nil to not record them
+func NewServer(client KubeClient, authorizer auth.Authorizer, cfg *config.Config, auditSink audit.Sink) (server *Server) {
 	router := mux.NewRouter()
+	router.Use(routed)
 
-	router.Path("/environments").Methods("POST").HandlerFunc(createEnvironment)
-	router.Path("/environments/{org}:{env}").Methods("GET").HandlerFunc(getEnvironment)
-	router.Path("/environments/{org}:{env}").Methods("PATCH").HandlerFunc(updateEnvironment)
-	router.Path("/environments/{org}:{env}").Methods("DELETE").HandlerFunc(deleteEnvironment)
-	router.Path("/environments/{org}:{env}/deployments").Methods("POST").HandlerFunc(createDeployment)
-	router.Path("/environments/{org}:{env}/deployments").Methods("GET").HandlerFunc(getDeployments)
-	router.Path("/environments/{org}:{env}/deployments/{deployment}").Methods("GET").HandlerFunc(getDeployment)
-	router.Path("/environments/{org}:{env}/deployments/{deployment}").Methods("PATCH").HandlerFunc(updateDeployment)
-	router.Path("/environments/{org}:{env}/deployments/{deployment}").Methods("DELETE").HandlerFunc(deleteDeployment)
-	router.Path("/environments/{org}:{env}/deployments/{deployment}/logs").Methods("GET").HandlerFunc(getDeploymentLogs)
-
-	// Health Check
-	router.Path("/environments/status/").Methods("GET").HandlerFunc(getStatus)
-	router.Path("/environments/status").Methods("GET").HandlerFunc(getStatus)
+	inventory := prometheus.NewRegistry()
+	inventory.MustRegister(newInventoryCollector(client))
 
-	loggedRouter := handlers.CombinedLoggingHandler(os.Stdout, router)
+	//A configured 0 turns retries and the organization cache off, the client would take it as its defaults
+	retries, orgCacheTTL := cfg.Apigee.Retries, cfg.Apigee.OrgCacheTTL
+	if retries == 0 {
+		retries = -1
+	}
+	if orgCacheTTL == 0 {
+		orgCacheTTL = -1
+	}
 
 	server = &Server{
-		Router: loggedRouter,
-	}
-	return server
-}
+		client:     client,
+		authorizer: authorizer,
+		config:     cfg,
+		audit:      auditSink,
+		apigee: apigee.NewClient(apigee.Config{
+			BaseURL:     fmt.Sprintf("https://%s/v1", cfg.Apigee.APIHost),
+			Timeout:     cfg.Apigee.Timeout,
+			Retries:     retries,
+			OrgCacheTTL: orgCacheTTL,
+			Transport: &metrics.Transport{
+				Operation: apigeeOperation,
+				Requests:  metrics.ApigeeRequests,
+				Duration:  metrics.ApigeeRequestDuration,
+			},
+		}),
+	}
+
+	server.hosts = newHostIndex(client)
+	server.readiness = &readiness{
+		checks: server.readinessChecks(),
+	}
+
+	router.Path("/environments").Methods("POST").HandlerFunc(server.audited("createEnvironment", server.createEnvironment))
+	router.Path("/environments").Methods("GET").HandlerFunc(server.getEnvironments)
+	router.Path("/organizations/{org}/environments").Methods("GET").HandlerFunc(server.getEnvironments)
+	router.Path("/organizations/{org}/features:invalidate").Methods("POST").HandlerFunc(server.audited("invalidateOrganizationFeatures", server.authorized(auth.ActionAdmin, server.invalidateOrganizationFeatures)))
+	router.Path("/environments/{org}:{env}").Methods("GET").HandlerFunc(server.authorized(auth.ActionRead, server.getEnvironment))
+	router.Path("/environments/{org}:{env}").Methods("PATCH").HandlerFunc(server.audited("updateEnvironment", server.authorized(auth.ActionAdmin, server.updateEnvironment)))
+	router.Path("/environments/{org}:{env}").Methods("DELETE").HandlerFunc(server.audited("deleteEnvironment", server.authorized(auth.ActionAdmin, server.deleteEnvironment)))
+	router.Path("/environments/{org}:{env}/audit").Methods("GET").HandlerFunc(server.authorized(auth.ActionAdmin, server.getAuditRecords))
+	router.Path("/environments/{org}:{env}/roles").Methods("GET").HandlerFunc(server.authorized(auth.ActionAdmin, server.getRoleBindings))
+	router.Path("/environments/{org}:{env}/roles").Methods("PUT").HandlerFunc(server.audited("updateRoleBindings", server.authorized(auth.ActionAdmin, server.updateRoleBindings)))
+	router.Path("/environments/{org}:{env}/keys:rotate").Methods("POST").HandlerFunc(server.audited("rotateKeys", server.authorized(auth.ActionAdmin, server.rotateKeys)))
+	router.Path("/environments/{org}:{env}/deployments").Methods("POST").HandlerFunc(server.audited("createDeployment", server.authorized(auth.ActionWrite, server.createDeployment)))
+	router.Path("/environments/{org}:{env}/deployments").Methods("GET").HandlerFunc(server.authorized(auth.ActionRead, server.getDeployments))
+	router.Path("/environments/{org}:{env}/deployments/{deployment}").Methods("GET").HandlerFunc(server.authorized(auth.ActionRead, server.getDeployment))
+	router.Path("/environments/{org}:{env}/deployments/{deployment}").Methods("PATCH").HandlerFunc(server.audited("updateDeployment", server.authorized(auth.ActionWrite, server.updateDeployment)))
+	router.Path("/environments/{org}:{env}/deployments/{deployment}").Methods("DELETE").HandlerFunc(server.audited("deleteDeployment", server.authorized(auth.ActionDelete, server.deleteDeployment)))
+	router.Path("/environments/{org}:{env}/deployments/{deployment}/status").Methods("GET").HandlerFunc(server.authorized(auth.ActionRead, server.getDeploymentStatus))
+	router.Path("/environments/{org}:{env}/deployments/{deployment}/logs").Methods("GET").HandlerFunc(server.authorized(auth.ActionLogs, server.getDeploymentLogs))
+	router.Path("/environments/{org}:{env}/deployments/{deployment}/revisions").Methods("GET").HandlerFunc(server.authorized(auth.ActionRead, server.getDeploymentRevisions))
+	router.Path("/environments/{org}:{env}/deployments/{deployment}/rollback").Methods("POST").HandlerFunc(server.audited("rollbackDeployment", server.authorized(auth.ActionWrite, server.rollbackDeployment)))
 
-// Copied from https://github.com/30x/authsdk/blob/master/apigee.go#L19
-//
-// TODO: Turn this into some Go-based Apigee client/SDK to replace authsdk
-var apigeeApiHost string
+	// Health Check
+	router.Path("/environments/status/").Methods("GET").HandlerFunc(getStatus)
+	router.Path("/environments/status").Methods("GET").HandlerFunc(getStatus)
+	router.Path("/healthz").Methods("GET").HandlerFunc(getHealth)
+	router.Path("/readyz").Methods("GET").HandlerFunc(server.getReadiness)
 
-func init() {
-	envVar := os.Getenv("AUTH_API_HOST")
+	router.Path("/metrics").Methods("GET").Handler(metrics.Handler(inventory))
 
-	if envVar == "" {
-		apigeeApiHost = "api.enterprise.apigee.com"
-	} else {
-		apigeeApiHost = envVar
-	}
-}
+	server.Router = observe(router)
 
-//Start the server
-func (server *Server) Start() error {
-	return http.ListenAndServe(":9000", server.Router)
+	return server
 }
 
 //createEnvironment creates a kubernetes namespace and secret
-func createEnvironment(w http.ResponseWriter, r *http.Request) {
+func (server *Server) createEnvironment(w http.ResponseWriter, r *http.Request) {
 
 	//Decode passed JSON body
 	var tempJSON environmentPost
 	err := json.NewDecoder(r.Body).Decode(&tempJSON)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		helper.LogError.Printf("Error decoding JSON Body: %s\n", err)
+		helper.WriteError(w, helper.NewAPIError(http.StatusBadRequest, helper.ErrCodeInvalidJSON, "Error decoding JSON Body", err))
 		return
 	}
 
 	//Make sure they passed a valid environment name of form {org}:{env}
 	if !envNameRegex.MatchString(tempJSON.EnvironmentName) {
-		http.Error(w, "Invalid environment name", http.StatusInternalServerError)
-		helper.LogError.Printf("Not a valid environment name: %s\n", tempJSON.EnvironmentName)
+		errorMessage := fmt.Sprintf("Not a valid environment name: %s", tempJSON.EnvironmentName)
+		helper.WriteError(w, helper.NewAPIError(http.StatusBadRequest, helper.ErrCodeInvalidEnvironmentName, errorMessage, nil))
 		return
 	}
 
@@ -124,11 +164,11 @@ func createEnvironment(w http.ResponseWriter, r *http.Request) {
 	nameSlice := strings.Split(tempJSON.EnvironmentName, ":")
 	apigeeOrgName := nameSlice[0]
 	apigeeEnvName := nameSlice[1]
+	setTarget(r, audit.Target{Organization: apigeeOrgName, Environment: apigeeEnvName})
 
-	if os.Getenv("DEPLOY_STATE") == "PROD" {
-		if !helper.ValidAdmin(apigeeOrgName, w, r) {
-			return
-		}
+	//The target only becomes known once the body is decoded so this can't be done by the router
+	if !server.authorize(w, r, apigeeOrgName, apigeeEnvName, auth.ActionAdmin) {
+		return
 	}
 
 	// transform EnvironmentName into acceptable k8s namespace name
@@ -144,8 +184,8 @@ func createEnvironment(w http.ResponseWriter, r *http.Request) {
 
 		if !(validIP || validHost) {
 			//Regex didn't match
-			http.Error(w, "Invalid Hostname", http.StatusInternalServerError)
-			helper.LogError.Printf("Not a valid hostname: %s\n", value)
+			errorMessage := fmt.Sprintf("Not a valid hostname: %s", value)
+			helper.WriteError(w, helper.NewAPIError(http.StatusBadRequest, helper.ErrCodeInvalidHostName, errorMessage, nil))
 			return
 		}
 		if index == 0 {
@@ -155,157 +195,29 @@ func createEnvironment(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	uniqueHosts, err := helper.UniqueHostNames(tempJSON.HostNames, client)
-	if err != nil {
-		errorMessage := fmt.Sprintf("Error in UniqueHostNames: %v", err)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
-		helper.LogError.Printf(errorMessage + "\n")
-		return
-	}
-	if !uniqueHosts {
-		errorMessage := "Duplicate HostNames"
-		http.Error(w, errorMessage, http.StatusInternalServerError)
-		helper.LogError.Printf(errorMessage)
+	//Held until the namespace is written so a concurrent request can't take the same hosts
+	release, ok := server.claimHostNames(w, tempJSON.EnvironmentName, tempJSON.HostNames)
+	if !ok {
 		return
 	}
+	defer release()
 
 	//Generate both a public and private key
 	privateKey, err := helper.GenerateRandomString(32)
-	publicKey, err := helper.GenerateRandomString(32)
 	if err != nil {
-		helper.LogError.Printf("Error generating random string: %v\n", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		helper.WriteError(w, helper.NewAPIError(http.StatusInternalServerError, helper.ErrCodeInternal, "Error generating random string", err))
+		return
 	}
-
-	//Should attempt KVM creation before creating k8s objects
-	if apigeeKVM {
-
-		httpClient := &http.Client{}
-
-		//construct URL
-		apigeeKVMURL := fmt.Sprintf("https://%s/v1/organizations/%s/environments/%s/keyvaluemaps", apigeeApiHost, apigeeOrgName, apigeeEnvName)
-
-		//create JSON body
-		kvmBody := apigeeKVMBody{
-			Name: apigeeKVMName,
-			Entry: []apigeeKVMEntry{
-				apigeeKVMEntry{
-					Name:  apigeeKVMPKName,
-					Value: base64.StdEncoding.EncodeToString([]byte(publicKey)),
-				},
-			},
-		}
-
-		b := new(bytes.Buffer)
-		json.NewEncoder(b).Encode(kvmBody)
-
-		req, err := http.NewRequest("POST", apigeeKVMURL, b)
-		if err != nil {
-			errorMessage := fmt.Sprintf("Unable to create request (Create KVM): %v", err)
-			http.Error(w, errorMessage, http.StatusInternalServerError)
-			helper.LogError.Printf(errorMessage + "\n")
-			return
-		}
-
-		//Must pass through the authz header
-		req.Header.Add("Authorization", r.Header.Get("Authorization"))
-		req.Header.Add("Content-Type", "application/json")
-
-		resp, err := httpClient.Do(req)
-		if err != nil {
-			errorMessage := fmt.Sprintf("Error creating Apigee KVM: %v", err)
-			http.Error(w, errorMessage, http.StatusInternalServerError)
-			helper.LogError.Printf(errorMessage + "\n")
-			return
-		}
-		defer resp.Body.Close()
-
-		// If the response was not a 201, we need to check if the response was a 409 because this means the KVM exists
-		// already and we'll need to update the KVM value(s).
-		if resp.StatusCode != 201 {
-			var retryFlag bool
-
-			// If the KVM already exists, we need to update its value(s).
-			if resp.StatusCode == 409 {
-				b2 := new(bytes.Buffer)
-				updateKVMURL := fmt.Sprintf("%s/%s", apigeeKVMURL, apigeeKVMName) // Use non-CPS endpoint by default
-
-				if isCPSEnabledForOrg(apigeeOrgName, r.Header.Get("Authorization")) {
-					// When using CPS, the API endpoint is different and instead of sending the whole KVM body, we can only send
-					// the KVM entry to update.  (This will work for now since we are only persisting one key but in the future
-					// we might need to update this to make N calls, one per key.)
-					updateKVMURL = fmt.Sprintf("%s/entries/%s", updateKVMURL, apigeeKVMPKName)
-
-					json.NewEncoder(b2).Encode(kvmBody.Entry[0])
-				} else {
-					// When not using CPS, send the whole KVM body to update all keys in the KVM.
-					json.NewEncoder(b2).Encode(kvmBody) // Non-CPS takes the whole payload
-				}
-
-				updateKVMReq, err := http.NewRequest("POST", updateKVMURL, b2)
-
-				if err != nil {
-					errorMessage := fmt.Sprintf("Unable to create request (Update KVM): %v", err)
-					http.Error(w, errorMessage, http.StatusInternalServerError)
-					helper.LogError.Printf(errorMessage + "\n")
-					return
-				}
-
-				fmt.Printf("The update KVM URL: %v\n", updateKVMReq.URL.String())
-
-				updateKVMReq.Header.Add("Authorization", r.Header.Get("Authorization"))
-				updateKVMReq.Header.Add("Content-Type", "application/json")
-
-				resp2, err := httpClient.Do(updateKVMReq)
-				if err != nil {
-					errorMessage := fmt.Sprintf("Error creating entry in existing Apigee KVM: %v", err)
-					http.Error(w, errorMessage, http.StatusInternalServerError)
-					helper.LogError.Printf(errorMessage + "\n")
-					return
-				}
-				defer resp2.Body.Close()
-
-				var updateKVMRes retryResponse
-
-				//Decode response
-				err = json.NewDecoder(resp2.Body).Decode(&updateKVMRes)
-
-				if err != nil {
-					fmt.Printf("Failed to decode response: %v\n", err)
-					http.Error(w, "Failed to decode response", http.StatusInternalServerError)
-					return
-				}
-
-				// Updating a KVM returns a 200 on success so if it's not a 200, it's a failure
-				if resp2.StatusCode != 200 {
-					errorMessage := fmt.Sprintf("Couldn't create KVM entry (Status Code: %d): %v", resp2.StatusCode, updateKVMRes.Message)
-					http.Error(w, errorMessage, http.StatusInternalServerError)
-					helper.LogError.Printf(errorMessage + "\n")
-					return
-				}
-
-				retryFlag = true
-			}
-
-			if !retryFlag {
-				errorMessage := fmt.Sprintf("Expected 201 or 409, got: %v", resp.StatusCode)
-				http.Error(w, errorMessage, http.StatusInternalServerError)
-				helper.LogError.Printf(errorMessage + "\n")
-				return
-			}
-		}
-
+	publicKey, err := helper.GenerateRandomString(32)
+	if err != nil {
+		helper.WriteError(w, helper.NewAPIError(http.StatusInternalServerError, helper.ErrCodeInternal, "Error generating random string", err))
+		return
 	}
 
 	//Should create an annotation object and pass it into the object literal
 	nsAnnotations := make(map[string]string)
 	nsAnnotations["hostNames"] = hostsList.String()
 
-	//Add network policy annotation if we are isolating namespaces
-	if isolateNamespace {
-		nsAnnotations["net.beta.kubernetes.io/network-policy"] = `{"ingress": {"isolation": "DefaultDeny"}}`
-	}
-
 	//NOTE: Probably shouldn't create annotation if there are no hostNames
 	nsObject := &api.Namespace{
 		ObjectMeta: api.ObjectMeta{
@@ -320,17 +232,6 @@ func createEnvironment(w http.ResponseWriter, r *http.Request) {
 		},
 	}
 
-	//Create Namespace
-	createdNs, err := client.Namespaces().Create(nsObject)
-	if err != nil {
-		errorMessage := fmt.Sprintf("Error creating namespace: %v", err)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
-		helper.LogError.Printf(errorMessage + "\n")
-		return
-	}
-	//Print to console for logging
-	helper.LogInfo.Printf("Created Namespace: %s\n", createdNs.GetName())
-
 	tempSecret := api.Secret{
 		ObjectMeta: api.ObjectMeta{
 			Name: "routing",
@@ -339,36 +240,125 @@ func createEnvironment(w http.ResponseWriter, r *http.Request) {
 		Type: "Opaque",
 	}
 
-	tempSecret.Data["public-api-key"] = []byte(publicKey)
-	tempSecret.Data["private-api-key"] = []byte(privateKey)
+	tempSecret.Data[publicKeyName] = []byte(publicKey)
+	tempSecret.Data[privateKeyName] = []byte(privateKey)
+
+	//The previous KVM value is kept so a failed provisioning doesn't break an existing environment's routing
+	var previousKVMValue string
+	var previousKVMFound bool
+	var createdNs *api.Namespace
+	var secret *api.Secret
+
+	//Each step registers how to undo itself so a partial failure leaves nothing behind
+	steps := []helper.Step{
+		{
+			//Should attempt KVM creation before creating k8s objects
+			Name: "kvm",
+			Skip: !server.config.Features.ApigeeKVM,
+			Do: func() error {
+				var apiErr *helper.APIError
+				previousKVMValue, previousKVMFound, apiErr = server.getRoutingKVMValue(apigeeOrgName, apigeeEnvName, r)
+				if apiErr != nil {
+					return apiErr
+				}
+				if apiErr = server.upsertRoutingKVM(apigeeOrgName, apigeeEnvName, publicKey, r); apiErr != nil {
+					return apiErr
+				}
+				return nil
+			},
+			Undo: func() error {
+				if previousKVMFound {
+					if apiErr := server.upsertRoutingKVM(apigeeOrgName, apigeeEnvName, previousKVMValue, r); apiErr != nil {
+						return apiErr
+					}
+					return nil
+				}
+				if apiErr := server.deleteRoutingKVM(apigeeOrgName, apigeeEnvName, r); apiErr != nil {
+					return apiErr
+				}
+				return nil
+			},
+		},
+		{
+			Name: "namespace",
+			Do: func() error {
+				var err error
+				createdNs, err = server.client.CreateNamespace(nsObject)
+				if err != nil {
+					return kubeError(err, helper.ErrCodeEnvironmentNotFound, "Error creating namespace")
+				}
+				server.hosts.Set(createdNs.GetName(), tempJSON.HostNames)
+				//Print to console for logging
+				logging.FromContext(r.Context()).Infof("Created Namespace: %s", createdNs.GetName())
+				return nil
+			},
+			Undo: func() error {
+				err := server.client.DeleteNamespace(createdNs.GetName())
+				if err == nil {
+					server.hosts.Delete(createdNs.GetName())
+				}
+				return err
+			},
+		},
+		{
+			Name: "secret",
+			Do: func() error {
+				var err error
+				secret, err = server.client.CreateSecret(tempJSON.EnvironmentName, &tempSecret)
+				if err != nil {
+					return kubeError(err, helper.ErrCodeEnvironmentNotFound, "Error creating secret")
+				}
+				//Print to console for logging
+				logging.FromContext(r.Context()).Infof("Created Secret: %s", secret.GetName())
+				return nil
+			},
+			Undo: func() error {
+				return server.client.DeleteSecret(tempJSON.EnvironmentName, secret.GetName())
+			},
+		},
+		{
+			//Add network policy annotation if we are isolating namespaces
+			Name: "networkPolicy",
+			Skip: !server.config.Features.IsolateNamespace,
+			Do: func() error {
+				createdNs.Annotations[networkPolicyAnnotation] = `{"ingress": {"isolation": "DefaultDeny"}}`
+				updatedNs, err := server.client.UpdateNamespace(createdNs)
+				if err != nil {
+					return kubeError(err, helper.ErrCodeEnvironmentNotFound, "Error isolating namespace")
+				}
+				createdNs = updatedNs
+				return nil
+			},
+			Undo: func() error {
+				delete(createdNs.Annotations, networkPolicyAnnotation)
+				_, err := server.client.UpdateNamespace(createdNs)
+				return err
+			},
+		},
+	}
 
-	//Create Secret
-	secret, err := client.Secrets(tempJSON.EnvironmentName).Create(&tempSecret)
+	stepResults, err := helper.RunSteps(logging.FromContext(r.Context()), steps)
+	observeSteps("create", stepResults)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		helper.LogError.Printf("Error creating secret: %s\n", err)
-
-		err = client.Namespaces().Delete(createdNs.GetName())
-		if err != nil {
-			helper.LogError.Printf("Failed to cleanup namespace\n")
-			return
+		apiErr, ok := err.(*helper.APIError)
+		if !ok {
+			apiErr = helper.NewAPIError(http.StatusInternalServerError, helper.ErrCodeInternal, "Error creating environment", err)
 		}
-		helper.LogError.Printf("Deleted namespace due to secret creation error\n")
+		apiErr.Steps = stepResults
+		helper.WriteError(w, apiErr)
 		return
 	}
-	//Print to console for logging
-	helper.LogInfo.Printf("Created Secret: %s\n", secret.GetName())
 
 	var jsResponse environmentResponse
 	jsResponse.Name = tempJSON.EnvironmentName
-	jsResponse.PrivateSecret = secret.Data["private-api-key"]
-	jsResponse.PublicSecret = secret.Data["public-api-key"]
+	jsResponse.PrivateSecret = secret.Data[privateKeyName]
+	jsResponse.PublicSecret = secret.Data[publicKeyName]
 	jsResponse.HostNames = tempJSON.HostNames
+	jsResponse.Steps = stepResults
 
 	js, err := json.Marshal(jsResponse)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		helper.LogError.Printf("Error marshalling response JSON: %s\n", err)
+		helper.WriteError(w, helper.NewAPIError(http.StatusInternalServerError, helper.ErrCodeInternal, "Error marshalling response JSON", err))
 		return
 	}
 
@@ -380,40 +370,124 @@ func createEnvironment(w http.ResponseWriter, r *http.Request) {
 	w.Write(js)
 }
 
-//getEnvironment returns a kubernetes namespace matching the given environmentGroupID and environmentName
-func getEnvironment(w http.ResponseWriter, r *http.Request) {
-	pathVars := mux.Vars(r)
+//getEnvironments lists the environments the caller may read, optionally only those of an organization
+//The organization comes from the path or the org query parameter
+func (server *Server) getEnvironments(w http.ResponseWriter, r *http.Request) {
+	org := mux.Vars(r)["org"]
+	if org == "" {
+		org = r.URL.Query().Get("org")
+	}
+
+	//Only checks the caller's credentials, environments are filtered below
+	if !server.authorize(w, r, "", "", auth.ActionRead) {
+		return
+	}
+	canRead, apiErr := server.environmentReader(r)
+	if apiErr != nil {
+		helper.WriteError(w, apiErr)
+		return
+	}
+
+	selectorString := "runtime=shipyard"
+	if org != "" {
+		selectorString += ",organization=" + org
+	}
+	selector, err := labels.Parse(selectorString)
+	if err != nil {
+		errorMessage := fmt.Sprintf("Invalid organization: %s", org)
+		helper.WriteError(w, helper.NewAPIError(http.StatusBadRequest, helper.ErrCodeInvalidQueryParameter, errorMessage, err))
+		return
+	}
+
+	nsList, err := server.client.ListNamespaces(api.ListOptions{
+		LabelSelector: selector,
+	})
+	if err != nil {
+		helper.WriteError(w, kubeError(err, helper.ErrCodeEnvironmentNotFound, "Error listing environments"))
+		return
+	}
 
-	if os.Getenv("DEPLOY_STATE") == "PROD" {
-		if !helper.ValidAdmin(pathVars["org"], w, r) {
+	environments := []environmentSummary{}
+	for _, ns := range nsList.Items {
+		//Only show the environments the caller may read
+		apiErr := canRead(&ns)
+		if apiErr != nil && apiErr.Status == http.StatusForbidden {
+			continue
+		}
+		if apiErr != nil {
+			helper.WriteError(w, apiErr)
+			return
+		}
+
+		depList, err := server.client.ListDeployments(ns.GetName(), api.ListOptions{
+			LabelSelector: labels.Everything(),
+		})
+		if err != nil {
+			helper.WriteError(w, kubeError(err, helper.ErrCodeEnvironmentNotFound, "Error retrieving deployment list"))
 			return
 		}
+
+		environments = append(environments, environmentSummary{
+			Name:            ns.GetName(),
+			Organization:    ns.Labels["organization"],
+			Environment:     ns.Labels["environment"],
+			HostNames:       strings.Fields(ns.Annotations["hostNames"]),
+			DeploymentCount: len(depList.Items),
+		})
+	}
+	sort.Sort(byEnvironmentName(environments))
+
+	js, err := json.Marshal(environments)
+	if err != nil {
+		helper.WriteError(w, helper.NewAPIError(http.StatusInternalServerError, helper.ErrCodeInternal, "Error marshalling environment list", err))
+		return
 	}
 
-	getNs, err := client.Namespaces().Get(pathVars["org"] + "-" + pathVars["env"])
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(js)
+
+	logging.FromContext(r.Context()).Infof("Listed %d Environments", len(environments))
+}
+
+//byEnvironmentName sorts environment summaries by name
+type byEnvironmentName []environmentSummary
+
+func (s byEnvironmentName) Len() int           { return len(s) }
+func (s byEnvironmentName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byEnvironmentName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+//getEnvironment returns a kubernetes namespace matching the given environmentGroupID and environmentName
+func (server *Server) getEnvironment(w http.ResponseWriter, r *http.Request) {
+	pathVars := mux.Vars(r)
+
+	getNs, err := server.client.GetNamespace(pathVars["org"] + "-" + pathVars["env"])
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		helper.LogError.Printf("Error getting existing Environment: %v\n", err)
+		helper.WriteError(w, kubeError(err, helper.ErrCodeEnvironmentNotFound, "Error getting existing Environment"))
 		return
 	}
 
-	getSecret, err := client.Secrets(pathVars["org"] + "-" + pathVars["env"]).Get("routing")
+	getSecret, err := server.client.GetSecret(pathVars["org"]+"-"+pathVars["env"], "routing")
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		helper.LogError.Printf("Error getting existing Secret: %v\n", err)
+		helper.WriteError(w, kubeError(err, helper.ErrCodeEnvironmentNotFound, "Error getting existing Secret"))
 		return
 	}
 
+	getSecret = server.expirePreviousKeys(logging.FromContext(r.Context()), pathVars["org"], pathVars["env"], getSecret, r.Header.Get("Authorization"))
+
 	var jsResponse environmentResponse
 	jsResponse.Name = getNs.Name
-	jsResponse.PrivateSecret = getSecret.Data["private-api-key"]
-	jsResponse.PublicSecret = getSecret.Data["public-api-key"]
+	jsResponse.PublicSecret = getSecret.Data[publicKeyName]
 	jsResponse.HostNames = strings.Split(getNs.Annotations["hostNames"], " ")
 
+	//The private key gives access to every private route of the environment so only admins get to see it
+	if server.authorizer.Authorize(r, pathVars["org"], pathVars["env"], auth.ActionAdmin) == nil {
+		jsResponse.PrivateSecret = getSecret.Data[privateKeyName]
+	}
+
 	js, err := json.Marshal(jsResponse)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		helper.LogError.Printf("Error marshalling response JSON: %v\n", err)
+		helper.WriteError(w, helper.NewAPIError(http.StatusInternalServerError, helper.ErrCodeInternal, "Error marshalling response JSON", err))
 		return
 	}
 
@@ -421,44 +495,35 @@ func getEnvironment(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(200)
 	w.Write(js)
 
-	helper.LogInfo.Printf("Got Namespace: %s\n", getNs.GetName())
+	logging.FromContext(r.Context()).Infof("Got Namespace: %s", getNs.GetName())
 }
 
 //updateEnvironment modifies the hostNames array on an existing environment
-func updateEnvironment(w http.ResponseWriter, r *http.Request) {
+func (server *Server) updateEnvironment(w http.ResponseWriter, r *http.Request) {
 	pathVars := mux.Vars(r)
 
-	if os.Getenv("DEPLOY_STATE") == "PROD" {
-		if !helper.ValidAdmin(pathVars["org"], w, r) {
-			return
-		}
-	}
-
 	//Get the existing namespace
-	getNs, err := client.Namespaces().Get(pathVars["org"] + "-" + pathVars["env"])
+	getNs, err := server.client.GetNamespace(pathVars["org"] + "-" + pathVars["env"])
 	if err != nil {
-		errorMessage := fmt.Sprintf("Namespace %s doesn't exist\n", pathVars["org"]+"-"+pathVars["env"])
-		helper.LogError.Printf(errorMessage)
-		http.Error(w, errorMessage, http.StatusNotFound)
+		errorMessage := fmt.Sprintf("Namespace %s doesn't exist", pathVars["org"]+"-"+pathVars["env"])
+		helper.WriteError(w, kubeError(err, helper.ErrCodeEnvironmentNotFound, errorMessage))
 		return
 	}
 
 	//Get the existing routing secret
-	getSecret, err := client.Secrets(pathVars["org"] + "-" + pathVars["env"]).Get("routing")
+	getSecret, err := server.client.GetSecret(pathVars["org"]+"-"+pathVars["env"], "routing")
 	if err != nil {
-		errorMessage := fmt.Sprintf("Failed to get existing routing secret on %s namespace\n", pathVars["org"]+"-"+pathVars["env"])
-		helper.LogError.Printf(errorMessage)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
+		errorMessage := fmt.Sprintf("Failed to get existing routing secret on %s namespace", pathVars["org"]+"-"+pathVars["env"])
+		helper.WriteError(w, kubeError(err, helper.ErrCodeEnvironmentNotFound, errorMessage))
 		return
 	}
+	getSecret = server.expirePreviousKeys(logging.FromContext(r.Context()), pathVars["org"], pathVars["env"], getSecret, r.Header.Get("Authorization"))
 
 	//Decode passed JSON body
 	var tempJSON environmentPatch
 	err = json.NewDecoder(r.Body).Decode(&tempJSON)
 	if err != nil {
-		errorMessage := fmt.Sprintf("Error decoding JSON Body: %s\n", err)
-		helper.LogError.Printf(errorMessage)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
+		helper.WriteError(w, helper.NewAPIError(http.StatusBadRequest, helper.ErrCodeInvalidJSON, "Error decoding JSON Body", err))
 		return
 	}
 
@@ -473,8 +538,8 @@ func updateEnvironment(w http.ResponseWriter, r *http.Request) {
 
 		if !(validIP || validHost) {
 			//Regex didn't match
-			http.Error(w, "Invalid Hostname", http.StatusInternalServerError)
-			helper.LogError.Printf("Not a valid hostname: %s\n", value)
+			errorMessage := fmt.Sprintf("Not a valid hostname: %s", value)
+			helper.WriteError(w, helper.NewAPIError(http.StatusBadRequest, helper.ErrCodeInvalidHostName, errorMessage, nil))
 			return
 		}
 		if index == 0 {
@@ -486,46 +551,38 @@ func updateEnvironment(w http.ResponseWriter, r *http.Request) {
 
 	//If hostNames are same as old then just give 200 back
 	if bytes.Equal(hostsList.Bytes(), []byte(getNs.Annotations["hostNames"])) {
-		helper.LogInfo.Printf("Nothing to be updated\n")
+		logging.FromContext(r.Context()).Infof("Nothing to be updated")
 		return
 	}
 
-	uniqueHosts, err := helper.UniqueHostNames(tempJSON.HostNames, client)
-	if err != nil {
-		errorMessage := fmt.Sprintf("Error in UniqueHostNames: %v", err)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
-		helper.LogError.Printf(errorMessage)
-		return
-	}
-	if !uniqueHosts {
-		errorMessage := "Duplicate HostNames"
-		http.Error(w, errorMessage, http.StatusInternalServerError)
-		helper.LogError.Printf(errorMessage)
+	//Held until the namespace is written so a concurrent request can't take the same hosts
+	release, ok := server.claimHostNames(w, getNs.GetName(), tempJSON.HostNames)
+	if !ok {
 		return
 	}
+	defer release()
 
 	getNs.Annotations["hostNames"] = hostsList.String()
 
-	updateNS, err := client.Namespaces().Update(getNs)
+	updateNS, err := server.client.UpdateNamespace(getNs)
 	if err != nil {
-		errorMessage := fmt.Sprintf("Failed to update existing namespace '%s'\n", getNs)
-		helper.LogError.Printf(errorMessage)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
+		errorMessage := fmt.Sprintf("Failed to update existing namespace '%s'", getNs.GetName())
+		helper.WriteError(w, kubeError(err, helper.ErrCodeEnvironmentNotFound, errorMessage))
 		return
 	}
-	helper.LogInfo.Printf("Updated hostNames: %s\n", updateNS.Annotations["hostNames"])
+	server.hosts.Set(updateNS.GetName(), tempJSON.HostNames)
+	logging.FromContext(r.Context()).Infof("Updated hostNames: %s", updateNS.Annotations["hostNames"])
 
 	var jsResponse environmentResponse
 	jsResponse.Name = pathVars["environment"]
-	jsResponse.PrivateSecret = getSecret.Data["private-api-key"]
-	jsResponse.PublicSecret = getSecret.Data["public-api-key"]
+	jsResponse.PrivateSecret = getSecret.Data[privateKeyName]
+	jsResponse.PublicSecret = getSecret.Data[publicKeyName]
 	jsResponse.HostNames = tempJSON.HostNames
 
 	js, err := json.Marshal(jsResponse)
 	if err != nil {
-		errorMessage := fmt.Sprintf("Couldn't marshall namespace: %s\n", err)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
-		helper.LogError.Printf(errorMessage)
+		helper.WriteError(w, helper.NewAPIError(http.StatusInternalServerError, helper.ErrCodeInternal, "Couldn't marshall namespace", err))
+		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(200)
@@ -534,113 +591,451 @@ func updateEnvironment(w http.ResponseWriter, r *http.Request) {
 }
 
 //deleteEnvironment deletes a kubernetes namespace matching the given org and env name
-func deleteEnvironment(w http.ResponseWriter, r *http.Request) {
+//If APIGEE_KVM is enabled the routing key is removed from Apigee too unless keepKVM=true is given
+func (server *Server) deleteEnvironment(w http.ResponseWriter, r *http.Request) {
 	pathVars := mux.Vars(r)
+	namespace := pathVars["org"] + "-" + pathVars["env"]
 
-	if os.Getenv("DEPLOY_STATE") == "PROD" {
-		if !helper.ValidAdmin(pathVars["org"], w, r) {
+	keepKVM := false
+	if keepParam := r.URL.Query().Get("keepKVM"); keepParam != "" {
+		var err error
+		keepKVM, err = strconv.ParseBool(keepParam)
+		if err != nil {
+			helper.WriteError(w, helper.NewAPIError(http.StatusBadRequest, helper.ErrCodeInvalidQueryParameter, "Invalid keepKVM value", err))
 			return
 		}
 	}
 
-	err := client.Namespaces().Delete(pathVars["org"] + "-" + pathVars["env"])
+	//The public key is needed to restore the KVM entry if the namespace can't be deleted
+	secret, err := server.client.GetSecret(namespace, "routing")
+	if err != nil {
+		helper.WriteError(w, kubeError(err, helper.ErrCodeEnvironmentNotFound, "Error in deleteEnvironment"))
+		return
+	}
+
+	steps := []helper.Step{
+		{
+			Name: "kvm",
+			Skip: !server.config.Features.ApigeeKVM || keepKVM,
+			Do: func() error {
+				if apiErr := server.deleteRoutingKVM(pathVars["org"], pathVars["env"], r); apiErr != nil {
+					return apiErr
+				}
+				return nil
+			},
+			Undo: func() error {
+				if apiErr := server.upsertRoutingKVM(pathVars["org"], pathVars["env"], string(secret.Data[publicKeyName]), r); apiErr != nil {
+					return apiErr
+				}
+				return nil
+			},
+		},
+		{
+			Name: "namespace",
+			Do: func() error {
+				err := server.client.DeleteNamespace(namespace)
+				if err != nil {
+					return kubeError(err, helper.ErrCodeEnvironmentNotFound, "Error in deleteEnvironment")
+				}
+				return nil
+			},
+		},
+	}
+
+	stepResults, err := helper.RunSteps(logging.FromContext(r.Context()), steps)
+	observeSteps("delete", stepResults)
 	if err != nil {
-		errorMessage := fmt.Sprintf("Error in deleteEnvironment: %v\n", err)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
-		helper.LogError.Printf(errorMessage)
+		apiErr, ok := err.(*helper.APIError)
+		if !ok {
+			apiErr = helper.NewAPIError(http.StatusInternalServerError, helper.ErrCodeInternal, "Error in deleteEnvironment", err)
+		}
+		apiErr.Steps = stepResults
+		helper.WriteError(w, apiErr)
 		return
 	}
 	w.WriteHeader(204)
 
-	helper.LogInfo.Printf("Deleted Namespace: %s\n", pathVars["org"]+"-"+pathVars["env"])
+	logging.FromContext(r.Context()).Infof("Deleted Namespace: %s", namespace)
 }
 
-//getDeployments returns a list of all deployments matching the given org and env name
-func getDeployments(w http.ResponseWriter, r *http.Request) {
+//rotateKeys regenerates one or both routing keys of an environment
+//If a grace period is given the old keys are kept in the secret as previous keys until it expires
+func (server *Server) rotateKeys(w http.ResponseWriter, r *http.Request) {
 	pathVars := mux.Vars(r)
+	namespace := pathVars["org"] + "-" + pathVars["env"]
+
+	//An empty body rotates both keys with no grace period
+	var tempJSON keyRotationPost
+	err := json.NewDecoder(r.Body).Decode(&tempJSON)
+	if err != nil && err != io.EOF {
+		helper.WriteError(w, helper.NewAPIError(http.StatusBadRequest, helper.ErrCodeInvalidJSON, "Error decoding JSON Body", err))
+		return
+	}
+
+	if len(tempJSON.Keys) == 0 {
+		tempJSON.Keys = []string{"public", "private"}
+	}
+
+	rotate := map[string]bool{}
+	for _, key := range tempJSON.Keys {
+		if key != "public" && key != "private" {
+			errorMessage := fmt.Sprintf("Unknown key %s, expected public or private", key)
+			helper.WriteError(w, helper.NewAPIError(http.StatusBadRequest, helper.ErrCodeInvalidKeyRotation, errorMessage, nil))
+			return
+		}
+		rotate[key] = true
+	}
+
+	var gracePeriod time.Duration
+	if tempJSON.GracePeriod != "" {
+		gracePeriod, err = time.ParseDuration(tempJSON.GracePeriod)
+		if err != nil || gracePeriod < 0 {
+			errorMessage := fmt.Sprintf("Invalid gracePeriod: %s", tempJSON.GracePeriod)
+			helper.WriteError(w, helper.NewAPIError(http.StatusBadRequest, helper.ErrCodeInvalidKeyRotation, errorMessage, err))
+			return
+		}
+	}
+
+	getSecret, err := server.client.GetSecret(namespace, "routing")
+	if err != nil {
+		helper.WriteError(w, kubeError(err, helper.ErrCodeEnvironmentNotFound, "Error getting existing Secret"))
+		return
+	}
+	getSecret = server.expirePreviousKeys(logging.FromContext(r.Context()), pathVars["org"], pathVars["env"], getSecret, r.Header.Get("Authorization"))
+
+	//Keep a copy so the secret can be restored if the KVM can't be updated
+	oldData := make(map[string][]byte, len(getSecret.Data))
+	for key, value := range getSecret.Data {
+		oldData[key] = value
+	}
+	oldAnnotations := make(map[string]string, len(getSecret.Annotations))
+	for key, value := range getSecret.Annotations {
+		oldAnnotations[key] = value
+	}
+
+	if getSecret.Data == nil {
+		getSecret.Data = map[string][]byte{}
+	}
+	if getSecret.Annotations == nil {
+		getSecret.Annotations = map[string]string{}
+	}
+
+	//Previous keys from an earlier rotation are replaced
+	delete(getSecret.Data, previousPublicKeyName)
+	delete(getSecret.Data, previousPrivateKeyName)
+	delete(getSecret.Annotations, previousKeysExpireAnnotation)
+
+	var expireAt *time.Time
+	if gracePeriod > 0 {
+		expire := time.Now().UTC().Add(gracePeriod)
+		expireAt = &expire
+		getSecret.Annotations[previousKeysExpireAnnotation] = expire.Format(time.RFC3339)
+	}
+
+	var rotated []string
+	for _, key := range []string{"public", "private"} {
+		if !rotate[key] {
+			continue
+		}
+
+		keyName, previousKeyName := publicKeyName, previousPublicKeyName
+		if key == "private" {
+			keyName, previousKeyName = privateKeyName, previousPrivateKeyName
+		}
+
+		newKey, err := helper.GenerateRandomString(32)
+		if err != nil {
+			helper.WriteError(w, helper.NewAPIError(http.StatusInternalServerError, helper.ErrCodeInternal, "Error generating random string", err))
+			return
+		}
+
+		if expireAt != nil {
+			getSecret.Data[previousKeyName] = getSecret.Data[keyName]
+		}
+		getSecret.Data[keyName] = []byte(newKey)
+		rotated = append(rotated, key)
+	}
+
+	//Apigee accepts the old public key during the grace period only if it stays in the KVM, next to the new one
+	kvm := server.config.Features.ApigeeKVM
+	keepPreviousKVMKey := kvm && rotate["public"] && expireAt != nil
+	//A previous public key left in the KVM by an earlier rotation is replaced like the one in the secret
+	hadPreviousKVMKey := kvm && getSecret.Annotations[previousKVMKeyAnnotation] != ""
+	if keepPreviousKVMKey {
+		getSecret.Annotations[previousKVMKeyAnnotation] = "true"
+	}
+
+	updatedSecret, err := server.client.UpdateSecret(namespace, getSecret)
+	if err != nil {
+		helper.WriteError(w, kubeError(err, helper.ErrCodeEnvironmentNotFound, "Error updating routing secret"))
+		return
+	}
+
+	//Push the new public key to Apigee, restoring the old keys if that fails so the two stay in step
+	if kvm && rotate["public"] {
+		var previousKey string
+		if hadPreviousKVMKey {
+			previousKey = string(oldData[previousPublicKeyName])
+		}
+		apiErr := server.rotateRoutingKVM(pathVars["org"], pathVars["env"], string(oldData[publicKeyName]), string(updatedSecret.Data[publicKeyName]), previousKey, keepPreviousKVMKey, r)
+		if apiErr != nil {
+			updatedSecret.Data = oldData
+			updatedSecret.Annotations = oldAnnotations
+			_, err = server.client.UpdateSecret(namespace, updatedSecret)
+			if err != nil {
+				logging.FromContext(r.Context()).Errorf("Failed to restore routing secret on %s: %v", namespace, err)
+			}
+			helper.WriteError(w, apiErr)
+			return
+		}
+	}
+
+	if hadPreviousKVMKey && !keepPreviousKVMKey {
+		updatedSecret = server.removePreviousKVMKey(logging.FromContext(r.Context()), pathVars["org"], pathVars["env"], updatedSecret, r.Header.Get("Authorization"))
+	}
+
+	var jsResponse keyRotationResponse
+	jsResponse.Name = namespace
+	jsResponse.PrivateSecret = updatedSecret.Data[privateKeyName]
+	jsResponse.PublicSecret = updatedSecret.Data[publicKeyName]
+	jsResponse.Rotated = rotated
+	jsResponse.PreviousKeysExpireAt = expireAt
+
+	js, err := json.Marshal(jsResponse)
+	if err != nil {
+		helper.WriteError(w, helper.NewAPIError(http.StatusInternalServerError, helper.ErrCodeInternal, "Error marshalling response JSON", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(js)
+
+	logging.FromContext(r.Context()).Infof("Rotated %s keys on %s", strings.Join(rotated, " and "), namespace)
+}
+
+//expirePreviousKeys removes the previous routing keys from secret once the time in its previousKeysExpireAt annotation has passed
+//The previous public key is removed from the Apigee KVM with the authz credentials, without them it stays marked in the secret for later
+//It is a no-op if the keys were already removed or replaced by a later rotation that hasn't expired yet, the secret is returned as it is now
+func (server *Server) expirePreviousKeys(logger *logging.Logger, org, env string, secret *api.Secret, authz string) *api.Secret {
+	namespace := org + "-" + env
+
+	expire, ok := secret.Annotations[previousKeysExpireAnnotation]
+	if ok {
+		expireAt, err := time.Parse(time.RFC3339, expire)
+		if err == nil && time.Now().Before(expireAt) {
+			return secret
+		}
+
+		expired := copySecret(secret)
+		delete(expired.Data, previousPublicKeyName)
+		delete(expired.Data, previousPrivateKeyName)
+		delete(expired.Annotations, previousKeysExpireAnnotation)
+
+		updatedSecret, err := server.client.UpdateSecret(namespace, expired)
+		if err != nil {
+			logger.Errorf("Error expiring previous keys on %s: %v", namespace, err)
+			return secret
+		}
+		secret = updatedSecret
+		logger.Infof("Expired previous routing keys on %s", namespace)
+	}
+
+	if secret.Annotations[previousKVMKeyAnnotation] != "" {
+		secret = server.removePreviousKVMKey(logger, org, env, secret, authz)
+	}
+	return secret
+}
+
+//reconcilePreviousKeys expires the previous routing keys of every environment whose grace period has passed
+//Run at startup and then every previousKeysReconcileInterval, it covers rotations handled by replicas that are gone
+//It has no Apigee credentials so previous public keys stay in the KVM until the next request on their environment
+func (server *Server) reconcilePreviousKeys(stop <-chan struct{}) {
+	ticker := time.NewTicker(previousKeysReconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		nsList, err := server.client.ListNamespaces(api.ListOptions{
+			LabelSelector: labels.SelectorFromSet(labels.Set{"runtime": "shipyard"}),
+		})
+		if err != nil {
+			logging.Errorf("Error listing environments to expire previous keys: %v", err)
+		}
+		if nsList != nil {
+			for _, ns := range nsList.Items {
+				org, env := ns.Labels["organization"], ns.Labels["environment"]
+				secret, err := server.client.GetSecret(ns.Name, "routing")
+				if err != nil {
+					logging.Errorf("Error getting routing secret on %s to expire previous keys: %v", ns.Name, err)
+					continue
+				}
+				if _, ok := secret.Annotations[previousKeysExpireAnnotation]; ok {
+					server.expirePreviousKeys(logging.Default(), org, env, secret, "")
+				}
+			}
+		}
 
-	if os.Getenv("DEPLOY_STATE") == "PROD" {
-		if !helper.ValidAdmin(pathVars["org"], w, r) {
+		select {
+		case <-ticker.C:
+		case <-stop:
 			return
 		}
 	}
+}
+
+//removePreviousKVMKey removes the previous public key from the Apigee KVM of an environment and clears its mark on the routing secret
+//Without authz credentials, or if Apigee fails, the mark is kept so a later request can remove it; the secret is returned as it is now
+func (server *Server) removePreviousKVMKey(logger *logging.Logger, org, env string, secret *api.Secret, authz string) *api.Secret {
+	namespace := org + "-" + env
+	if !server.config.Features.ApigeeKVM {
+		return secret
+	}
+	if authz == "" {
+		logger.Warnf("Previous public key of %s left in the Apigee KVM until a request with Apigee credentials", namespace)
+		return secret
+	}
+
+	err := server.apigee.RemoveKVMEntry(authz, org, env, apigeeKVMName, apigeeKVMPreviousPKName)
+	if err != nil {
+		logger.Warnf("Error removing previous public key of %s from the Apigee KVM: %v", namespace, err)
+		return secret
+	}
+
+	cleared := copySecret(secret)
+	delete(cleared.Annotations, previousKVMKeyAnnotation)
+	updatedSecret, err := server.client.UpdateSecret(namespace, cleared)
+	if err != nil {
+		logger.Errorf("Error clearing the previous KVM key of %s: %v", namespace, err)
+		return secret
+	}
+	logger.Infof("Removed previous public key of %s from the Apigee KVM", namespace)
+	return updatedSecret
+}
+
+//copySecret copies a secret so its data and annotations can be changed without touching the original
+func copySecret(secret *api.Secret) *api.Secret {
+	copied := *secret
+	copied.Data = make(map[string][]byte, len(secret.Data))
+	for key, value := range secret.Data {
+		copied.Data[key] = value
+	}
+	copied.Annotations = make(map[string]string, len(secret.Annotations))
+	for key, value := range secret.Annotations {
+		copied.Annotations[key] = value
+	}
+	return &copied
+}
 
-	depList, err := client.Deployments(pathVars["org"] + "-" + pathVars["env"]).List(api.ListOptions{
+//getDeployments returns a list of all deployments matching the given org and env name
+func (server *Server) getDeployments(w http.ResponseWriter, r *http.Request) {
+	pathVars := mux.Vars(r)
+
+	depList, err := server.client.ListDeployments(pathVars["org"]+"-"+pathVars["env"], api.ListOptions{
 		LabelSelector: labels.Everything(),
 	})
 	if err != nil {
-		errorMessage := fmt.Sprintf("Error retrieving deployment list: %v\n", err)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
-		helper.LogError.Printf(errorMessage)
+		helper.WriteError(w, kubeError(err, helper.ErrCodeEnvironmentNotFound, "Error retrieving deployment list"))
 		return
 	}
 	js, err := json.Marshal(depList)
 	if err != nil {
-		errorMessage := fmt.Sprintf("Error marshalling deployment list: %v\n", err)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
-		helper.LogError.Printf(errorMessage)
+		helper.WriteError(w, helper.NewAPIError(http.StatusInternalServerError, helper.ErrCodeInternal, "Error marshalling deployment list", err))
+		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(200)
 	w.Write(js)
 	for _, value := range depList.Items {
-		helper.LogInfo.Printf("Got Deployment: %s\n", value.GetName())
+		logging.FromContext(r.Context()).Infof("Got Deployment: %s", value.GetName())
+	}
+}
+
+//podTemplateSpec returns the pod template spec for a deployment request
+//Exactly one of ptsURL and pts must be given, privileged containers are stripped unless allowed
+func (server *Server) podTemplateSpec(ptsURL string, pts *api.PodTemplateSpec, r *http.Request) (api.PodTemplateSpec, *helper.APIError) {
+	tempPTS := api.PodTemplateSpec{}
+
+	switch {
+	case ptsURL != "" && pts != nil:
+		return tempPTS, helper.NewAPIError(http.StatusBadRequest, helper.ErrCodeInvalidDeployment, "Only one of ptsURL or pts may be given", nil)
+	case pts != nil:
+		//RestrictPTSHost doesn't apply, it keeps the caller's credentials from being sent to other hosts when fetching
+		//and an inline PTS is subject to the same checks as a fetched one below
+		tempPTS = *pts
+	case ptsURL != "":
+		start := time.Now()
+		var err error
+		tempPTS, err = helper.GetPTSFromURL(ptsURL, r, server.config.PTS, server.config.Features.RestrictPTSHost)
+		metrics.PTSFetchDuration.Observe(time.Since(start).Seconds())
+		if err != nil {
+			apiErr := ptsError(err)
+			metrics.PTSFetches.WithLabelValues(apiErr.Code).Inc()
+			return tempPTS, apiErr
+		}
+		metrics.PTSFetches.WithLabelValues("success").Inc()
+	default:
+		return tempPTS, helper.NewAPIError(http.StatusBadRequest, helper.ErrCodeInvalidDeployment, "No ptsURL or pts given", nil)
 	}
+
+	if len(tempPTS.Spec.Containers) == 0 {
+		return tempPTS, helper.NewAPIError(http.StatusBadRequest, helper.ErrCodeInvalidDeployment, "Pod template spec must have at least one container", nil)
+	}
+
+	if !server.config.Features.AllowPrivilegedContainers {
+		for _, val := range tempPTS.Spec.Containers {
+			if val.SecurityContext != nil {
+				val.SecurityContext.Privileged = func() *bool { b := false; return &b }()
+			}
+		}
+	}
+
+	return tempPTS, nil
 }
 
 //createDeployment creates a deployment in the given environment(namespace) with the given environmentGroupID based on the given deploymentBody
-func createDeployment(w http.ResponseWriter, r *http.Request) {
+func (server *Server) createDeployment(w http.ResponseWriter, r *http.Request) {
 	pathVars := mux.Vars(r)
 
-	if os.Getenv("DEPLOY_STATE") == "PROD" {
-		if !helper.ValidAdmin(pathVars["org"], w, r) {
-			return
-		}
+	wait, apiErr := parseWait(r)
+	if apiErr != nil {
+		helper.WriteError(w, apiErr)
+		return
 	}
 
 	//Decode passed JSON body
 	var tempJSON deploymentPost
 	err := json.NewDecoder(r.Body).Decode(&tempJSON)
 	if err != nil {
-		errorMessage := fmt.Sprintf("Error decoding JSON Body: %s\n", err)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
-		helper.LogError.Printf(errorMessage)
+		helper.WriteError(w, helper.NewAPIError(http.StatusBadRequest, helper.ErrCodeInvalidJSON, "Error decoding JSON Body", err))
 		return
 	}
 
-	if tempJSON.PublicHosts == nil && tempJSON.PrivateHosts == nil {
-		errorMessage := fmt.Sprintf("No privateHosts or publicHosts given\n")
-		http.Error(w, errorMessage, http.StatusInternalServerError)
-		helper.LogError.Printf(errorMessage)
+	if tempJSON.DeploymentName == "" {
+		helper.WriteError(w, helper.NewAPIError(http.StatusBadRequest, helper.ErrCodeInvalidDeployment, "No deploymentName given", nil))
 		return
 	}
 
-	tempPTS := api.PodTemplateSpec{}
-
-	//Check if we got a URL
-	if tempJSON.PtsURL == "" {
-		//No URL so error
-		errorMessage := fmt.Sprintf("No ptsURL given\n")
-		http.Error(w, errorMessage, http.StatusInternalServerError)
-		helper.LogError.Printf(errorMessage)
+	if tempJSON.Replicas == nil {
+		helper.WriteError(w, helper.NewAPIError(http.StatusBadRequest, helper.ErrCodeInvalidDeployment, "No replicas given", nil))
 		return
 	}
 
-	tempPTS, err = helper.GetPTSFromURL(tempJSON.PtsURL, r)
-	if err != nil {
-		helper.LogError.Printf(err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if tempJSON.PublicHosts == nil && tempJSON.PrivateHosts == nil {
+		helper.WriteError(w, helper.NewAPIError(http.StatusBadRequest, helper.ErrCodeInvalidDeployment, "No privateHosts or publicHosts given", nil))
+		return
 	}
 
-	if allowPrivilegedContainers == false {
-		for _, val := range tempPTS.Spec.Containers {
-			if val.SecurityContext != nil {
-				val.SecurityContext.Privileged = func() *bool { b := false; return &b }()
-			}
-		}
+	tempPTS, apiErr := server.podTemplateSpec(tempJSON.PtsURL, tempJSON.PTS, r)
+	if apiErr != nil {
+		helper.WriteError(w, apiErr)
+		return
 	}
 
-	tempPTS.Spec.Containers[0].Env = helper.CacheEnvVars(tempPTS.Spec.Containers[0].Env, tempJSON.EnvVars)
+	err = helper.InjectEnvVars(tempPTS.Spec.Containers, tempJSON.EnvVars, tempJSON.ContainerEnvVars)
+	if err != nil {
+		helper.WriteError(w, helper.NewAPIError(http.StatusBadRequest, helper.ErrCodeInvalidDeployment, "Invalid containerEnvVars", err))
+		return
+	}
 
 	//If map is empty then we need to make it
 	if len(tempPTS.Annotations) == 0 {
@@ -684,30 +1079,69 @@ func createDeployment(w http.ResponseWriter, r *http.Request) {
 	}
 
 	labelSelector, err := labels.Parse("component=" + tempPTS.Labels["component"])
+	if err != nil {
+		helper.WriteError(w, helper.NewAPIError(http.StatusBadRequest, helper.ErrCodeInvalidDeployment, "Invalid component label on pod template spec", err))
+		return
+	}
 	//Get list of all deployments in namespace with MatchLabels["app"] = tempPTS.Labels["app"]
-	depList, err := client.Deployments(pathVars["org"] + "-" + pathVars["env"]).List(api.ListOptions{
+	depList, err := server.client.ListDeployments(pathVars["org"]+"-"+pathVars["env"], api.ListOptions{
 		LabelSelector: labelSelector,
 	})
+	if err != nil {
+		helper.WriteError(w, kubeError(err, helper.ErrCodeEnvironmentNotFound, "Error retrieving deployment list"))
+		return
+	}
 	if len(depList.Items) != 0 {
-		errorMessage := fmt.Sprintf("LabelSelector " + labelSelector.String() + " already exists")
-		helper.LogError.Printf(errorMessage)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
+		errorMessage := fmt.Sprintf("LabelSelector %s already exists", labelSelector.String())
+		helper.WriteError(w, helper.NewAPIError(http.StatusConflict, helper.ErrCodeLabelSelectorExists, errorMessage, nil))
 		return
 	}
 
+	//Create the Service first so a bad one doesn't leave a deployment behind
+	if tempJSON.CreateService {
+		service, apiErr := deploymentService(tempJSON.DeploymentName, tempPTS)
+		if apiErr != nil {
+			helper.WriteError(w, apiErr)
+			return
+		}
+
+		createdService, err := server.client.CreateService(pathVars["org"]+"-"+pathVars["env"], service)
+		if err != nil {
+			helper.WriteError(w, kubeError(err, helper.ErrCodeEnvironmentNotFound, "Error creating service"))
+			return
+		}
+		logging.FromContext(r.Context()).Infof("Created Service: %s", createdService.GetName())
+	}
+
 	//Create Deployment
-	dep, err := client.Deployments(pathVars["org"] + "-" + pathVars["env"]).Create(&template)
+	dep, err := server.client.CreateDeployment(pathVars["org"]+"-"+pathVars["env"], &template)
 	if err != nil {
-		errorMessage := fmt.Sprintf("Error creating deployment: %s\n", err)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
-		helper.LogError.Printf(errorMessage)
+		helper.WriteError(w, kubeError(err, helper.ErrCodeEnvironmentNotFound, "Error creating deployment"))
+
+		if tempJSON.CreateService {
+			err = server.client.DeleteService(pathVars["org"]+"-"+pathVars["env"], tempJSON.DeploymentName)
+			if err != nil {
+				logging.FromContext(r.Context()).Errorf("Failed to cleanup service")
+				return
+			}
+			logging.FromContext(r.Context()).Errorf("Deleted service due to deployment creation error")
+		}
 		return
 	}
+
+	//Block until the rollout is done if asked to
+	if wait > 0 {
+		dep, apiErr = server.waitForRollout(r.Context(), pathVars["org"]+"-"+pathVars["env"], dep.GetName(), wait)
+		if apiErr != nil {
+			helper.WriteError(w, apiErr)
+			return
+		}
+	}
+
 	js, err := json.Marshal(dep)
 	if err != nil {
-		errorMessage := fmt.Sprintf("Error marshalling deployment: %s\n", err)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
-		helper.LogError.Printf(errorMessage)
+		helper.WriteError(w, helper.NewAPIError(http.StatusInternalServerError, helper.ErrCodeInternal, "Error marshalling deployment", err))
+		return
 	}
 
 	//Create absolute path for Location header
@@ -717,86 +1151,61 @@ func createDeployment(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(201)
 	w.Write(js)
 
-	helper.LogInfo.Printf("Created Deployment: %s\n", dep.GetName())
+	logging.FromContext(r.Context()).Infof("Created Deployment: %s", dep.GetName())
 }
 
 //getDeployment returns a deployment matching the given environmentGroupID, environmentName, and deploymentName
-func getDeployment(w http.ResponseWriter, r *http.Request) {
+func (server *Server) getDeployment(w http.ResponseWriter, r *http.Request) {
 	pathVars := mux.Vars(r)
 
-	if os.Getenv("DEPLOY_STATE") == "PROD" {
-		if !helper.ValidAdmin(pathVars["org"], w, r) {
-			//Errors should be returned from function
-			return
-		}
-	}
-
-	getDep, err := client.Deployments(pathVars["org"] + "-" + pathVars["env"]).Get(pathVars["deployment"])
+	getDep, err := server.client.GetDeployment(pathVars["org"]+"-"+pathVars["env"], pathVars["deployment"])
 	if err != nil {
-		errorMessage := fmt.Sprintf("Error retrieving deployment: %s\n", err)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
-		helper.LogError.Printf(errorMessage)
+		helper.WriteError(w, kubeError(err, helper.ErrCodeDeploymentNotFound, "Error retrieving deployment"))
 		return
 	}
 	js, err := json.Marshal(getDep)
 	if err != nil {
-		errorMessage := fmt.Sprintf("Error marshalling deployment: %v\n", err)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
-		helper.LogError.Printf(errorMessage)
+		helper.WriteError(w, helper.NewAPIError(http.StatusInternalServerError, helper.ErrCodeInternal, "Error marshalling deployment", err))
+		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(200)
 	w.Write(js)
 
-	helper.LogInfo.Printf("Got Deployment: %v\n", getDep.GetName())
+	logging.FromContext(r.Context()).Infof("Got Deployment: %v", getDep.GetName())
 }
 
 //updateDeployment updates a deployment matching the given environmentGroupID, environmentName, and deploymentName
-func updateDeployment(w http.ResponseWriter, r *http.Request) {
+func (server *Server) updateDeployment(w http.ResponseWriter, r *http.Request) {
 
 	pathVars := mux.Vars(r)
 
-	if os.Getenv("DEPLOY_STATE") == "PROD" {
-		if !helper.ValidAdmin(pathVars["org"], w, r) {
-			return
-		}
+	wait, apiErr := parseWait(r)
+	if apiErr != nil {
+		helper.WriteError(w, apiErr)
+		return
 	}
 
 	//Get the old namespace first so we can fail quickly if it's not there
-	getDep, err := client.Deployments(pathVars["org"] + "-" + pathVars["env"]).Get(pathVars["deployment"])
+	getDep, err := server.client.GetDeployment(pathVars["org"]+"-"+pathVars["env"], pathVars["deployment"])
 	if err != nil {
-		errorMessage := fmt.Sprintf("Error getting existing deployment: %s\n", err)
-		http.Error(w, errorMessage, http.StatusNotFound)
-		helper.LogError.Printf(errorMessage)
+		helper.WriteError(w, kubeError(err, helper.ErrCodeDeploymentNotFound, "Error getting existing deployment"))
 		return
 	}
 	//Decode passed JSON body
 	var tempJSON deploymentPatch
 	err = json.NewDecoder(r.Body).Decode(&tempJSON)
 	if err != nil {
-		errorMessage := fmt.Sprintf("Error decoding JSON Body: %v\n", err)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
-		helper.LogError.Printf(errorMessage)
+		helper.WriteError(w, helper.NewAPIError(http.StatusBadRequest, helper.ErrCodeInvalidJSON, "Error decoding JSON Body", err))
 		return
 	}
 
-	tempPTS := api.PodTemplateSpec{}
-
-	//Check if we got a URL
-	if tempJSON.PtsURL == "" {
-		//No URL so error
-		errorMessage := fmt.Sprintf("No ptsURL or PTS given\n")
-		http.Error(w, errorMessage, http.StatusInternalServerError)
-		helper.LogError.Printf(errorMessage)
+	tempPTS, apiErr := server.podTemplateSpec(tempJSON.PtsURL, tempJSON.PTS, r)
+	if apiErr != nil {
+		helper.WriteError(w, apiErr)
 		return
 	}
 
-	tempPTS, err = helper.GetPTSFromURL(tempJSON.PtsURL, r)
-	if err != nil {
-		helper.LogError.Printf(err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
-
 	//If annotations map is empty then we need to make it
 	if len(tempPTS.Annotations) == 0 {
 		tempPTS.Annotations = make(map[string]string)
@@ -828,275 +1237,437 @@ func updateDeployment(w http.ResponseWriter, r *http.Request) {
 		getDep.Spec.Template.Annotations["publicHosts"] = *tempJSON.PublicHosts
 	}
 
-	getDep.Spec.Template.Spec.Containers[0].Env = helper.CacheEnvVars(getDep.Spec.Template.Spec.Containers[0].Env, tempJSON.EnvVars)
+	err = helper.InjectEnvVars(getDep.Spec.Template.Spec.Containers, tempJSON.EnvVars, tempJSON.ContainerEnvVars)
+	if err != nil {
+		helper.WriteError(w, helper.NewAPIError(http.StatusBadRequest, helper.ErrCodeInvalidDeployment, "Invalid containerEnvVars", err))
+		return
+	}
 
 	//Add routable label
 	getDep.Spec.Template.Labels["routable"] = "true"
 
-	dep, err := client.Deployments(pathVars["org"] + "-" + pathVars["env"]).Update(getDep)
+	//Keep the Service ports in sync with the new pod template spec, it is only written once the deployment is
+	service, apiErr := server.syncedDeploymentService(pathVars["org"]+"-"+pathVars["env"], pathVars["deployment"], getDep.Spec.Template)
+	if apiErr != nil {
+		helper.WriteError(w, apiErr)
+		return
+	}
+
+	dep, err := server.client.UpdateDeployment(pathVars["org"]+"-"+pathVars["env"], getDep)
 	if err != nil {
-		errorMessage := fmt.Sprintf("Error updating deployment: %v\n", err)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
-		helper.LogError.Printf(errorMessage)
+		helper.WriteError(w, kubeError(err, helper.ErrCodeDeploymentNotFound, "Error updating deployment"))
+		return
+	}
+
+	apiErr = server.updateDeploymentService(logging.FromContext(r.Context()), pathVars["org"]+"-"+pathVars["env"], service)
+	if apiErr != nil {
+		helper.WriteError(w, apiErr)
 		return
 	}
 
+	//Block until the rollout is done if asked to
+	if wait > 0 {
+		dep, apiErr = server.waitForRollout(r.Context(), pathVars["org"]+"-"+pathVars["env"], dep.GetName(), wait)
+		if apiErr != nil {
+			helper.WriteError(w, apiErr)
+			return
+		}
+	}
+
 	js, err := json.Marshal(dep)
 	if err != nil {
-		errorMessage := fmt.Sprintf("Error marshalling deployment: %v\n", err)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
-		helper.LogError.Printf(errorMessage)
+		helper.WriteError(w, helper.NewAPIError(http.StatusInternalServerError, helper.ErrCodeInternal, "Error marshalling deployment", err))
+		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(200)
 	w.Write(js)
-	helper.LogInfo.Printf("Updated Deployment: %s\n", dep.GetName())
+	logging.FromContext(r.Context()).Infof("Updated Deployment: %s", dep.GetName())
 }
 
 //deleteDeployment deletes a deployment matching the given environmentGroupID, environmentName, and deploymentName
-func deleteDeployment(w http.ResponseWriter, r *http.Request) {
+func (server *Server) deleteDeployment(w http.ResponseWriter, r *http.Request) {
 	pathVars := mux.Vars(r)
 
-	if os.Getenv("DEPLOY_STATE") == "PROD" {
-		if !helper.ValidAdmin(pathVars["org"], w, r) {
-			return
-		}
-	}
-
 	//Get the deployment object
-	dep, err := client.Deployments(pathVars["org"] + "-" + pathVars["env"]).Get(pathVars["deployment"])
+	dep, err := server.client.GetDeployment(pathVars["org"]+"-"+pathVars["env"], pathVars["deployment"])
 	if err != nil {
-		errorMessage := fmt.Sprintf("Error getting old deployment: %s\n", err)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
-		helper.LogError.Printf(errorMessage)
+		helper.WriteError(w, kubeError(err, helper.ErrCodeDeploymentNotFound, "Error getting old deployment"))
 		return
 	}
 
 	//Get the match label
 	selector, err := labels.Parse("component=" + dep.Labels["component"])
 	if err != nil {
-		errorMessage := fmt.Sprintf("Error creating label selector: %v\n", err)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
-		helper.LogError.Printf(errorMessage)
+		helper.WriteError(w, helper.NewAPIError(http.StatusInternalServerError, helper.ErrCodeInternal, "Error creating label selector", err))
 		return
 	}
 
 	//Get the replica sets with the corresponding label
-	rsList, err := client.ReplicaSets(pathVars["org"] + "-" + pathVars["env"]).List(api.ListOptions{
+	rsList, err := server.client.ListReplicaSets(pathVars["org"]+"-"+pathVars["env"], api.ListOptions{
 		LabelSelector: selector,
 	})
 	if err != nil {
-		errorMessage := fmt.Sprintf("Error getting replica set list: %v\n", err)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
-		helper.LogError.Printf(errorMessage)
+		helper.WriteError(w, kubeError(err, helper.ErrCodeDeploymentNotFound, "Error getting replica set list"))
 		return
 	}
 
 	//Get the pods with the corresponding label
-	podList, err := client.Pods(pathVars["org"] + "-" + pathVars["env"]).List(api.ListOptions{
+	podList, err := server.client.ListPods(pathVars["org"]+"-"+pathVars["env"], api.ListOptions{
 		LabelSelector: selector,
 	})
+	if err != nil {
+		helper.WriteError(w, kubeError(err, helper.ErrCodeDeploymentNotFound, "Error getting pod list"))
+		return
+	}
 
 	//Delete Deployment
-	err = client.Deployments(pathVars["org"]+"-"+pathVars["env"]).Delete(pathVars["deployment"], &api.DeleteOptions{})
+	err = server.client.DeleteDeployment(pathVars["org"]+"-"+pathVars["env"], pathVars["deployment"])
 	if err != nil {
-		errorMessage := fmt.Sprintf("Error deleting deployment: %v\n", err)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
-		helper.LogError.Printf(errorMessage)
+		helper.WriteError(w, kubeError(err, helper.ErrCodeDeploymentNotFound, "Error deleting deployment"))
 		return
 	}
-	helper.LogInfo.Printf("Deleted Deployment: %v\n", pathVars["deployment"])
+	logging.FromContext(r.Context()).Infof("Deleted Deployment: %v", pathVars["deployment"])
 
 	//Delete all Replica Sets that came up in the list
 	for _, value := range rsList.Items {
-		err = client.ReplicaSets(pathVars["org"]+"-"+pathVars["env"]).Delete(value.GetName(), &api.DeleteOptions{})
+		err = server.client.DeleteReplicaSet(pathVars["org"]+"-"+pathVars["env"], value.GetName())
 		if err != nil {
-			errorMessage := fmt.Sprintf("Error deleting replica set: %v\n", err)
-			http.Error(w, errorMessage, http.StatusInternalServerError)
-			helper.LogError.Printf(errorMessage)
+			helper.WriteError(w, kubeError(err, helper.ErrCodeDeploymentNotFound, "Error deleting replica set"))
 			return
 		}
-		helper.LogInfo.Printf("Deleted Replica Set: %v\n", value.GetName())
+		logging.FromContext(r.Context()).Infof("Deleted Replica Set: %v", value.GetName())
 	}
 
 	//Delete all Pods that came up in the list
 	for _, value := range podList.Items {
-		err = client.Pods(pathVars["org"]+"-"+pathVars["env"]).Delete(value.GetName(), &api.DeleteOptions{})
+		err = server.client.DeletePod(pathVars["org"]+"-"+pathVars["env"], value.GetName())
+		if err != nil {
+			helper.WriteError(w, kubeError(err, helper.ErrCodeDeploymentNotFound, "Error deleting pod"))
+			return
+		}
+		logging.FromContext(r.Context()).Infof("Deleted Pod: %v", value.GetName())
+	}
+
+	//The Service goes last so failing to delete it doesn't leave the replica sets and pods behind
+	service, err := server.getDeploymentService(pathVars["org"]+"-"+pathVars["env"], pathVars["deployment"])
+	if err != nil {
+		helper.WriteError(w, kubeError(err, helper.ErrCodeDeploymentNotFound, "Error getting service"))
+		return
+	}
+	if service != nil {
+		err = server.client.DeleteService(pathVars["org"]+"-"+pathVars["env"], service.GetName())
 		if err != nil {
-			errorMessage := fmt.Sprintf("Error deleting pod: %v\n", err)
-			http.Error(w, errorMessage, http.StatusInternalServerError)
-			helper.LogError.Printf(errorMessage)
+			helper.WriteError(w, kubeError(err, helper.ErrCodeDeploymentNotFound, "Error deleting service"))
 			return
 		}
-		helper.LogInfo.Printf("Deleted Pod: %v\n", value.GetName())
+		logging.FromContext(r.Context()).Infof("Deleted Service: %v", service.GetName())
 	}
 	w.WriteHeader(204)
 }
 
-func getDeploymentLogs(w http.ResponseWriter, r *http.Request) {
+//getDeploymentStatus returns the rollout status of a deployment along with the readiness of its pods
+func (server *Server) getDeploymentStatus(w http.ResponseWriter, r *http.Request) {
 	pathVars := mux.Vars(r)
 
-	if os.Getenv("DEPLOY_STATE") == "PROD" {
-		if !helper.ValidAdmin(pathVars["org"], w, r) {
-			return
-		}
+	dep, err := server.client.GetDeployment(pathVars["org"]+"-"+pathVars["env"], pathVars["deployment"])
+	if err != nil {
+		helper.WriteError(w, kubeError(err, helper.ErrCodeDeploymentNotFound, "Error retrieving deployment"))
+		return
 	}
 
-	//Get query strings
-	queries := r.URL.Query()
+	status, err := server.rolloutStatus(pathVars["org"]+"-"+pathVars["env"], dep)
+	if err != nil {
+		helper.WriteError(w, kubeError(err, helper.ErrCodeDeploymentNotFound, "Error getting rollout status"))
+		return
+	}
 
-	tailString := queries.Get("tail")
-	var tail int64 = -1
-	if tailString != "" {
-		tailInt, err := strconv.Atoi(tailString)
-		if err != nil {
-			errorMessage := fmt.Sprintf("Invalid tail value: %s\n", err)
-			http.Error(w, errorMessage, http.StatusInternalServerError)
-			helper.LogError.Printf(errorMessage)
-			return
-		}
-		tail = int64(tailInt)
+	js, err := json.Marshal(status)
+	if err != nil {
+		helper.WriteError(w, helper.NewAPIError(http.StatusInternalServerError, helper.ErrCodeInternal, "Error marshalling deployment status", err))
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(js)
+}
 
-	previousString := queries.Get("previous")
-	var previous bool
-	if previousString != "" {
-		var err error
-		previous, err = strconv.ParseBool(previousString)
-		if err != nil {
-			errorMessage := fmt.Sprintf("Invalid previous value: %s\n", err)
-			http.Error(w, errorMessage, http.StatusInternalServerError)
-			helper.LogError.Printf(errorMessage)
-			return
-		}
+//getDeploymentRevisions returns the revision history kept for a deployment, newest first
+func (server *Server) getDeploymentRevisions(w http.ResponseWriter, r *http.Request) {
+	pathVars := mux.Vars(r)
+
+	dep, err := server.client.GetDeployment(pathVars["org"]+"-"+pathVars["env"], pathVars["deployment"])
+	if err != nil {
+		helper.WriteError(w, kubeError(err, helper.ErrCodeDeploymentNotFound, "Error retrieving deployment"))
+		return
 	}
 
-	//Get the deployment
-	dep, err := client.Deployments(pathVars["org"] + "-" + pathVars["env"]).Get(pathVars["deployment"])
+	replicaSets, err := server.revisionReplicaSets(pathVars["org"]+"-"+pathVars["env"], dep)
 	if err != nil {
-		errorMessage := fmt.Sprintf("Error retrieving deployment: %s\n", err)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
-		helper.LogError.Printf(errorMessage)
+		helper.WriteError(w, kubeError(err, helper.ErrCodeDeploymentNotFound, "Error getting replica set list"))
 		return
 	}
 
-	selector := dep.Spec.Selector
-	label, err := labels.Parse("component=" + selector.MatchLabels["component"])
+	current := revisionOf(dep.ObjectMeta)
+	revisions := []deploymentRevision{}
+	for _, rs := range replicaSets {
+		revisions = append(revisions, revisionFromReplicaSet(rs, current))
+	}
+
+	js, err := json.Marshal(revisions)
 	if err != nil {
-		errorMessage := fmt.Sprintf("Error parsing label selector: %s\n", err)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
-		helper.LogError.Printf(errorMessage)
+		helper.WriteError(w, helper.NewAPIError(http.StatusInternalServerError, helper.ErrCodeInternal, "Error marshalling revisions", err))
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(js)
 
-	podInterface := client.Pods(pathVars["org"] + "-" + pathVars["env"])
+	logging.FromContext(r.Context()).Infof("Got %d Revisions for Deployment: %s", len(revisions), dep.GetName())
+}
 
-	pods, err := podInterface.List(api.ListOptions{
-		LabelSelector: label,
-	})
+//rollbackDeployment puts the pod template spec of an earlier revision back on a deployment
+//A revision of 0 rolls back to the revision before the current one
+func (server *Server) rollbackDeployment(w http.ResponseWriter, r *http.Request) {
+	pathVars := mux.Vars(r)
 
-	if err != nil {
-		errorMessage := fmt.Sprintf("Error retrieving pods: %s\n", err)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
-		helper.LogError.Printf(errorMessage)
+	//Decode passed JSON body, an empty body rolls back to the previous revision
+	var tempJSON deploymentRollbackPost
+	err := json.NewDecoder(r.Body).Decode(&tempJSON)
+	if err != nil && err != io.EOF {
+		helper.WriteError(w, helper.NewAPIError(http.StatusBadRequest, helper.ErrCodeInvalidJSON, "Error decoding JSON Body", err))
+		return
+	}
+	if tempJSON.Revision < 0 {
+		errorMessage := fmt.Sprintf("Invalid revision: %d", tempJSON.Revision)
+		helper.WriteError(w, helper.NewAPIError(http.StatusBadRequest, helper.ErrCodeInvalidDeployment, errorMessage, nil))
 		return
 	}
 
-	logBuffer := bytes.NewBuffer(nil)
+	getDep, err := server.client.GetDeployment(pathVars["org"]+"-"+pathVars["env"], pathVars["deployment"])
+	if err != nil {
+		helper.WriteError(w, kubeError(err, helper.ErrCodeDeploymentNotFound, "Error getting existing deployment"))
+		return
+	}
 
-	for _, pod := range pods.Items {
-		podLogOpts := &api.PodLogOptions{}
+	replicaSets, err := server.revisionReplicaSets(pathVars["org"]+"-"+pathVars["env"], getDep)
+	if err != nil {
+		helper.WriteError(w, kubeError(err, helper.ErrCodeDeploymentNotFound, "Error getting replica set list"))
+		return
+	}
 
-		if tail != -1 {
-			podLogOpts.TailLines = &tail
+	//Replica sets are sorted newest first so the first one below the current revision is the previous one
+	current := revisionOf(getDep.ObjectMeta)
+	var target *extensions.ReplicaSet
+	for i, rs := range replicaSets {
+		revision := revisionOf(rs.ObjectMeta)
+		if (tempJSON.Revision == 0 && revision < current) || (tempJSON.Revision != 0 && revision == tempJSON.Revision) {
+			target = &replicaSets[i]
+			break
+		}
+	}
+	if target == nil {
+		errorMessage := fmt.Sprintf("Revision %d of deployment %s doesn't exist", tempJSON.Revision, pathVars["deployment"])
+		if tempJSON.Revision == 0 {
+			errorMessage = fmt.Sprintf("Deployment %s has no previous revision", pathVars["deployment"])
 		}
+		helper.WriteError(w, helper.NewAPIError(http.StatusNotFound, helper.ErrCodeRevisionNotFound, errorMessage, nil))
+		return
+	}
+
+	dep := getDep
+	if revisionOf(target.ObjectMeta) != current {
+		getDep.Spec.Template = rollbackTemplate(*target)
 
-		if previous {
-			podLogOpts.Previous = previous
+		//Keep the Service ports in sync with the restored pod template spec, it is only written once the deployment is
+		service, apiErr := server.syncedDeploymentService(pathVars["org"]+"-"+pathVars["env"], pathVars["deployment"], getDep.Spec.Template)
+		if apiErr != nil {
+			helper.WriteError(w, apiErr)
+			return
 		}
 
-		req := podInterface.GetLogs(pod.Name, podLogOpts)
-		stream, err := req.Stream()
+		dep, err = server.client.UpdateDeployment(pathVars["org"]+"-"+pathVars["env"], getDep)
 		if err != nil {
-			errorMessage := fmt.Sprintf("Error getting log stream: %s\n", err)
-			http.Error(w, errorMessage, http.StatusInternalServerError)
-			helper.LogError.Printf(errorMessage)
+			helper.WriteError(w, kubeError(err, helper.ErrCodeDeploymentNotFound, "Error rolling back deployment"))
 			return
 		}
 
-		defer stream.Close()
-		podLogLine := fmt.Sprintf("Logs for pod: %v\n", pod.Name)
-		_, err = logBuffer.WriteString(podLogLine)
-		_, err = io.Copy(logBuffer, stream)
-		if err != nil {
-			errorMessage := fmt.Sprintf("Error copying log stream to var: %s\n", err)
-			http.Error(w, errorMessage, http.StatusInternalServerError)
-			helper.LogError.Printf(errorMessage)
+		apiErr = server.updateDeploymentService(logging.FromContext(r.Context()), pathVars["org"]+"-"+pathVars["env"], service)
+		if apiErr != nil {
+			helper.WriteError(w, apiErr)
 			return
 		}
 	}
 
-	w.Header().Set("Content-Type", "text/plain")
+	js, err := json.Marshal(dep)
+	if err != nil {
+		helper.WriteError(w, helper.NewAPIError(http.StatusInternalServerError, helper.ErrCodeInternal, "Error marshalling deployment", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(200)
-	w.Write(logBuffer.Bytes())
-
-	helper.LogInfo.Printf("Got Logs for Deployment: %v\n", dep.GetName())
-}
+	w.Write(js)
 
-func getStatus(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/plain")
-	w.Write([]byte("OK"))
+	logging.FromContext(r.Context()).Infof("Rolled back Deployment %s to revision %d", dep.GetName(), revisionOf(target.ObjectMeta))
 }
 
-func isCPSEnabledForOrg(orgName, authzHeader string) bool {
-	cpsEnabled := false
-	httpClient := &http.Client{}
+//getDeploymentLogs streams the logs of every pod of a deployment
+func (server *Server) getDeploymentLogs(w http.ResponseWriter, r *http.Request) {
+	pathVars := mux.Vars(r)
 
-	req, err := http.NewRequest("GET", fmt.Sprintf("https://%s/v1/organizations/%s", apigeeApiHost, orgName), nil)
+	podLogOpts, follow, apiErr := parseLogOptions(r)
+	if apiErr != nil {
+		helper.WriteError(w, apiErr)
+		return
+	}
 
+	//Get the deployment
+	dep, err := server.client.GetDeployment(pathVars["org"]+"-"+pathVars["env"], pathVars["deployment"])
 	if err != nil {
-		fmt.Printf("Error checking for CPS: %v", err)
+		helper.WriteError(w, kubeError(err, helper.ErrCodeDeploymentNotFound, "Error retrieving deployment"))
+		return
+	}
 
-		return cpsEnabled
+	//Kubernetes only picks the container itself for pods that have just one
+	if containers := dep.Spec.Template.Spec.Containers; podLogOpts.Container == "" && len(containers) > 1 {
+		names := make([]string, len(containers))
+		for i, container := range containers {
+			names[i] = container.Name
+		}
+		errorMessage := fmt.Sprintf("Deployment %s has several containers, choose one of %s with the container parameter", dep.GetName(), strings.Join(names, ", "))
+		helper.WriteError(w, helper.NewAPIError(http.StatusBadRequest, helper.ErrCodeInvalidQueryParameter, errorMessage, nil))
+		return
 	}
 
-	fmt.Printf("Checking if %s has CPS enabled using URL: %v\n", orgName, req.URL.String())
+	selector := dep.Spec.Selector
+	label, err := labels.Parse("component=" + selector.MatchLabels["component"])
+	if err != nil {
+		helper.WriteError(w, helper.NewAPIError(http.StatusInternalServerError, helper.ErrCodeInternal, "Error parsing label selector", err))
+		return
+	}
 
-	req.Header.Add("Authorization", authzHeader)
+	pods, err := server.client.ListPods(pathVars["org"]+"-"+pathVars["env"], api.ListOptions{
+		LabelSelector: label,
+	})
 
-	res, err := httpClient.Do(req)
+	if err != nil {
+		helper.WriteError(w, kubeError(err, helper.ErrCodeDeploymentNotFound, "Error retrieving pods"))
+		return
+	}
 
-	defer res.Body.Close()
+	//Open every stream before writing anything so errors can still be returned as JSON
+	streams := []podLogStream{}
+	for _, pod := range pods.Items {
+		stream, err := server.client.GetPodLogs(pathVars["org"]+"-"+pathVars["env"], pod.Name, podLogOpts)
+		if err != nil {
+			closeLogStreams(streams)
+			helper.WriteError(w, kubeError(err, helper.ErrCodeDeploymentNotFound, "Error getting log stream"))
+			return
+		}
+		streams = append(streams, podLogStream{pod: pod.Name, stream: stream})
+	}
 
-	if err != nil {
-		fmt.Printf("Error checking for CPS: %v", err)
+	if follow {
+		followLogs(w, r, streams)
 	} else {
-		var rawOrg interface{}
+		writeLogs(logging.FromContext(r.Context()), w, streams)
+	}
 
-		err := json.NewDecoder(res.Body).Decode(&rawOrg)
+	logging.FromContext(r.Context()).Infof("Got Logs for Deployment: %v", dep.GetName())
+}
 
-		if err != nil {
-			fmt.Printf("Error unmarshalling response: %v\n", err)
-		} else {
-			org := rawOrg.(map[string]interface{})
-			orgProps := org["properties"].(map[string]interface{})
-			orgProp := orgProps["property"].([]interface{})
+//getStatus always answers OK, it is kept for existing probes and /healthz and /readyz should be used instead
+func getStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("OK"))
+}
 
-			for _, rawProp := range orgProp {
-				prop := rawProp.(map[string]interface{})
+//invalidateOrganizationFeatures drops the cached Apigee feature flags (e.g. CPS) of an organization
+//Useful right after an org has been migrated instead of waiting for the cache to expire
+func (server *Server) invalidateOrganizationFeatures(w http.ResponseWriter, r *http.Request) {
+	pathVars := mux.Vars(r)
 
-				if prop["name"] == "features.isCpsEnabled" {
-					if prop["value"] == "true" {
-						cpsEnabled = true
-					}
+	server.apigee.InvalidateOrganization(pathVars["org"])
+	w.WriteHeader(204)
 
-					break
-				}
-			}
+	logging.FromContext(r.Context()).Infof("Invalidated cached features of organization: %s", pathVars["org"])
+}
+
+//upsertRoutingKVM creates the shipyard-routing KVM for an environment or updates its public key entry if it already exists
+func (server *Server) upsertRoutingKVM(apigeeOrgName string, apigeeEnvName string, publicKey string, r *http.Request) *helper.APIError {
+	err := server.apigee.SetKVMEntry(r.Header.Get("Authorization"), apigeeOrgName, apigeeEnvName, apigeeKVMName, apigee.KVMEntry{
+		Name:  apigeeKVMPKName,
+		Value: base64.StdEncoding.EncodeToString([]byte(publicKey)),
+	})
+	if err != nil {
+		return apigeeError(err, "Error setting Apigee KVM entry")
+	}
+	return nil
+}
+
+//rotateRoutingKVM sets a new public key in the shipyard-routing KVM of an environment
+//With keepPrevious the old key is first put in the previous key entry so Apigee accepts both during the grace period
+//If the new key can't be set the previous key entry is put back to previousKey, or removed if there was none
+func (server *Server) rotateRoutingKVM(apigeeOrgName, apigeeEnvName, oldKey, newKey, previousKey string, keepPrevious bool, r *http.Request) *helper.APIError {
+	authz := r.Header.Get("Authorization")
+	if keepPrevious {
+		err := server.apigee.SetKVMEntry(authz, apigeeOrgName, apigeeEnvName, apigeeKVMName, apigee.KVMEntry{
+			Name:  apigeeKVMPreviousPKName,
+			Value: base64.StdEncoding.EncodeToString([]byte(oldKey)),
+		})
+		if err != nil {
+			return apigeeError(err, "Error setting previous key Apigee KVM entry")
 		}
 	}
 
-	fmt.Printf("  CPS Enabled: %v", cpsEnabled)
+	apiErr := server.upsertRoutingKVM(apigeeOrgName, apigeeEnvName, newKey, r)
+	if apiErr == nil || !keepPrevious {
+		return apiErr
+	}
+
+	var err error
+	if previousKey != "" {
+		err = server.apigee.SetKVMEntry(authz, apigeeOrgName, apigeeEnvName, apigeeKVMName, apigee.KVMEntry{
+			Name:  apigeeKVMPreviousPKName,
+			Value: base64.StdEncoding.EncodeToString([]byte(previousKey)),
+		})
+	} else {
+		err = server.apigee.RemoveKVMEntry(authz, apigeeOrgName, apigeeEnvName, apigeeKVMName, apigeeKVMPreviousPKName)
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("Failed to restore previous key Apigee KVM entry of %s-%s: %v", apigeeOrgName, apigeeEnvName, err)
+	}
+	return apiErr
+}
+
+//getRoutingKVMValue returns the public key currently stored in the shipyard-routing KVM of an environment
+//found is false if the KVM or its entry doesn't exist
+func (server *Server) getRoutingKVMValue(apigeeOrgName string, apigeeEnvName string, r *http.Request) (value string, found bool, apiErr *helper.APIError) {
+	entry, err := server.apigee.GetKVMEntry(r.Header.Get("Authorization"), apigeeOrgName, apigeeEnvName, apigeeKVMName, apigeeKVMPKName)
+	if apigee.IsNotFound(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, apigeeError(err, "Error getting Apigee KVM")
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(entry.Value)
+	if err != nil {
+		return "", false, helper.NewAPIError(http.StatusBadGateway, helper.ErrCodeApigee, "Failed to decode KVM entry", err)
+	}
+	return string(decoded), true, nil
+}
 
-	return cpsEnabled
+//deleteRoutingKVM removes the public key of an environment from Apigee, along with the previous one of a rotation
+//The shipyard-routing KVM itself is deleted once it holds nothing else
+func (server *Server) deleteRoutingKVM(apigeeOrgName string, apigeeEnvName string, r *http.Request) *helper.APIError {
+	err := server.apigee.RemoveKVMEntry(r.Header.Get("Authorization"), apigeeOrgName, apigeeEnvName, apigeeKVMName, apigeeKVMPreviousPKName)
+	if err != nil {
+		return apigeeError(err, "Error deleting previous key Apigee KVM entry")
+	}
+	err = server.apigee.RemoveKVMEntry(r.Header.Get("Authorization"), apigeeOrgName, apigeeEnvName, apigeeKVMName, apigeeKVMPKName)
+	if err != nil {
+		return apigeeError(err, "Error deleting Apigee KVM entry")
+	}
+	return nil
 }
@@ -2,16 +2,26 @@ package server_test
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/30x/enrober/pkg/auth"
+	"github.com/30x/enrober/pkg/config"
+	"github.com/30x/enrober/pkg/fakeapigee"
+	"github.com/30x/enrober/pkg/fakekube"
+	"github.com/30x/enrober/pkg/helper"
 	"github.com/30x/enrober/pkg/server"
 
-	"k8s.io/kubernetes/pkg/client/restclient"
-
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -21,15 +31,101 @@ type environmentRequest struct {
 	HostNames []string `json:"hostNames"`
 }
 
+type stepResult struct {
+	Step   string `json:"step"`
+	Status string `json:"status"`
+}
+
 type environmentResponse struct {
-	Name          string   `json:"name"`
-	HostNames     []string `json:"hostNames,omitempty"`
-	PublicSecret  []byte   `json:"publicSecret"`
-	PrivateSecret []byte   `json:"privateSecret"`
+	Name          string       `json:"name"`
+	HostNames     []string     `json:"hostNames,omitempty"`
+	PublicSecret  []byte       `json:"publicSecret"`
+	PrivateSecret []byte       `json:"privateSecret"`
+	Steps         []stepResult `json:"steps"`
+}
+
+type envVar struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type deploymentResponse struct {
+	Spec struct {
+		Template struct {
+			Spec struct {
+				Containers []struct {
+					Name  string   `json:"name"`
+					Image string   `json:"image"`
+					Env   []envVar `json:"env"`
+				} `json:"containers"`
+			} `json:"spec"`
+		} `json:"template"`
+	} `json:"spec"`
+}
+
+type revisionResponse struct {
+	Revision    int64  `json:"revision"`
+	Current     bool   `json:"current"`
+	PublicHosts string `json:"publicHosts"`
+	Containers  []struct {
+		Image string `json:"image"`
+	} `json:"containers"`
+}
+
+type statusResponse struct {
+	Generation         int64 `json:"generation"`
+	ObservedGeneration int64 `json:"observedGeneration"`
+	Replicas           int32 `json:"replicas"`
+	AvailableReplicas  int32 `json:"availableReplicas"`
+	Complete           bool  `json:"complete"`
+	Failed             bool  `json:"failed"`
+	Pods               []struct {
+		Name  string `json:"name"`
+		Ready bool   `json:"ready"`
+	} `json:"pods"`
+}
+
+type environmentSummary struct {
+	Name            string   `json:"name"`
+	HostNames       []string `json:"hostNames"`
+	DeploymentCount int      `json:"deploymentCount"`
+}
+
+type auditRecord struct {
+	RequestID string `json:"requestId"`
+	Actor     string `json:"actor"`
+	Action    string `json:"action"`
+	Target    struct {
+		Organization string `json:"organization"`
+		Environment  string `json:"environment"`
+		Deployment   string `json:"deployment"`
+	} `json:"target"`
+	Diff    json.RawMessage `json:"diff"`
+	Outcome struct {
+		Result    string `json:"result"`
+		Status    int    `json:"status"`
+		ErrorCode string `json:"errorCode"`
+	} `json:"outcome"`
+}
+
+type healthResponse struct {
+	Status string `json:"status"`
+	Checks []struct {
+		Name   string `json:"name"`
+		Status string `json:"status"`
+		Error  string `json:"error"`
+	} `json:"checks"`
+}
+
+type errorResponse struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Details string       `json:"details"`
+	Steps   []stepResult `json:"steps"`
 }
 
 var _ = Describe("Server Test", func() {
-	ServerTests := func(testServer *server.Server, hostBase string) {
+	ServerTests := func(testServer *server.Server, hostBase string, ptsBase string) {
 
 		client := &http.Client{}
 
@@ -59,10 +155,32 @@ var _ = Describe("Server Test", func() {
 
 			Expect(respStore.PrivateSecret).ShouldNot(BeNil())
 			Expect(respStore.PublicSecret).ShouldNot(BeNil())
+			Expect(respStore.Steps).Should(ContainElement(stepResult{Step: "namespace", Status: "done"}))
+			Expect(respStore.Steps).Should(ContainElement(stepResult{Step: "secret", Status: "done"}))
 
 			Expect(resp.StatusCode).Should(Equal(201), "Response should be 201 Created")
 		})
 
+		It("Create Environment that already exists", func() {
+			url := fmt.Sprintf("%s/environments", hostBase)
+
+			jsonStr := []byte(`{"environmentName": "testorg1:testenv1", "hostNames": ["testhost99"]}`)
+			req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonStr))
+
+			resp, err := client.Do(req)
+
+			Expect(err).Should(BeNil(), "Shouldn't get an error on POST. Error: %v", err)
+
+			Expect(resp.StatusCode).Should(Equal(409), "Response should be 409 Conflict")
+
+			respStore := errorResponse{}
+			err = json.NewDecoder(resp.Body).Decode(&respStore)
+			Expect(err).Should(BeNil(), "Error decoding response: %v", err)
+			Expect(respStore.Code).Should(Equal("AlreadyExists"))
+			Expect(respStore.Steps).Should(ContainElement(stepResult{Step: "namespace", Status: "failed"}))
+			Expect(respStore.Steps).Should(ContainElement(stepResult{Step: "secret", Status: "notRun"}))
+		})
+
 		It("Create Environment with duplicated Host Name", func() {
 			url := fmt.Sprintf("%s/environments", hostBase)
 
@@ -73,7 +191,31 @@ var _ = Describe("Server Test", func() {
 
 			Expect(err).Should(BeNil(), "Shouldn't get an error on POST. Error: %v", err)
 
-			Expect(resp.StatusCode).Should(Equal(500), "Response should be 500 Internal Server Error")
+			Expect(resp.StatusCode).Should(Equal(409), "Response should be 409 Conflict")
+
+			respStore := errorResponse{}
+			err = json.NewDecoder(resp.Body).Decode(&respStore)
+			Expect(err).Should(BeNil(), "Error decoding response: %v", err)
+			Expect(respStore.Code).Should(Equal("DuplicateHostName"))
+		})
+
+		It("Create Environment with invalid JSON", func() {
+			url := fmt.Sprintf("%s/environments", hostBase)
+
+			jsonStr := []byte(`{"environmentName": `)
+			req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonStr))
+
+			resp, err := client.Do(req)
+
+			Expect(err).Should(BeNil(), "Shouldn't get an error on POST. Error: %v", err)
+
+			Expect(resp.StatusCode).Should(Equal(400), "Response should be 400 Bad Request")
+			Expect(resp.Header.Get("Content-Type")).Should(Equal("application/json"))
+
+			respStore := errorResponse{}
+			err = json.NewDecoder(resp.Body).Decode(&respStore)
+			Expect(err).Should(BeNil(), "Error decoding response: %v", err)
+			Expect(respStore.Code).Should(Equal("InvalidJSON"))
 		})
 
 		It("Update Environment", func() {
@@ -99,15 +241,66 @@ var _ = Describe("Server Test", func() {
 			Expect(resp.StatusCode).Should(Equal(200), "Response should be 200 OK")
 		})
 
+		It("Rotate public key of Environment", func() {
+			url := fmt.Sprintf("%s/environments/testorg1:testenv1/keys:rotate", hostBase)
+
+			jsonStr := []byte(`{"keys": ["public"], "gracePeriod": "1h"}`)
+			req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonStr))
+
+			resp, err := client.Do(req)
+			Expect(err).Should(BeNil(), "Shouldn't get an error on POST. Error: %v", err)
+
+			Expect(resp.StatusCode).Should(Equal(200), "Response should be 200 OK")
+
+			respStore := environmentResponse{}
+			err = json.NewDecoder(resp.Body).Decode(&respStore)
+			Expect(err).Should(BeNil(), "Error decoding response: %v", err)
+
+			//Only the public-api-key should have changed
+			Expect(string(respStore.PublicSecret)).ShouldNot(Equal(globalPublic))
+			Expect(string(respStore.PrivateSecret)).Should(Equal(globalPrivate))
+
+			globalPublic = string(respStore.PublicSecret)
+		})
+
+		It("Rotate unknown key of Environment", func() {
+			url := fmt.Sprintf("%s/environments/testorg1:testenv1/keys:rotate", hostBase)
+
+			jsonStr := []byte(`{"keys": ["secret"]}`)
+			req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonStr))
+
+			resp, err := client.Do(req)
+			Expect(err).Should(BeNil(), "Shouldn't get an error on POST. Error: %v", err)
+
+			Expect(resp.StatusCode).Should(Equal(400), "Response should be 400 Bad Request")
+		})
+
+		It("Get Environment after key rotation", func() {
+			url := fmt.Sprintf("%s/environments/testorg1:testenv1", hostBase)
+
+			req, err := http.NewRequest("GET", url, nil)
+
+			resp, err := client.Do(req)
+			Expect(err).Should(BeNil(), "Shouldn't get an error on GET. Error: %v", err)
+
+			respStore := environmentResponse{}
+			err = json.NewDecoder(resp.Body).Decode(&respStore)
+			Expect(err).Should(BeNil(), "Error decoding response: %v", err)
+
+			Expect(string(respStore.PublicSecret)).Should(Equal(globalPublic))
+			Expect(string(respStore.PrivateSecret)).Should(Equal(globalPrivate))
+		})
+
 		It("Create Deployment from PTS URL", func() {
 			url := fmt.Sprintf("%s/environments/testorg1:testenv1/deployments", hostBase)
 
-			jsonStr := []byte(`{
+			jsonStr := []byte(fmt.Sprintf(`{
 				"deploymentName": "testdep1",
 				"publicHosts": "deploy.k8s.public",
 				"privateHosts": "deploy.k8s.private",
     			"replicas": 1,
-    			"ptsURL": "https://api.myjson.com/bins/2p9z1",
+    			"ptsURL": "%s/pts/testdep1",
+				"createService": true,
 				"envVars": [{
 					"name": "test1",
 					"value": "test3"
@@ -116,7 +309,7 @@ var _ = Describe("Server Test", func() {
 					"name": "test2",
 					"value": "test4"
    				}] 
-			}`)
+			}`, ptsBase))
 
 			req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonStr))
 
@@ -129,14 +322,11 @@ var _ = Describe("Server Test", func() {
 		})
 
 		It("Update Deployment from PTS URL", func() {
-			//Need to wait a little before we run an update
-			//Should look into a better fix
-			time.Sleep(2000 * time.Millisecond)
 			url := fmt.Sprintf("%s/environments/testorg1:testenv1/deployments/testdep1", hostBase)
 
-			jsonStr := []byte(`{
+			jsonStr := []byte(fmt.Sprintf(`{
 				"replicas": 3,
-				"ptsURL": "https://api.myjson.com/bins/119h9",
+				"ptsURL": "%s/pts/testdep1-v2",
 				"envVars": [{
 					"name": "test1",
 					"value": "test3"
@@ -145,7 +335,7 @@ var _ = Describe("Server Test", func() {
 					"name": "test2",
 					"value": "test4"
 				}] 
-			}`)
+			}`, ptsBase))
 
 			req, err := http.NewRequest("PATCH", url, bytes.NewBuffer(jsonStr))
 
@@ -157,6 +347,98 @@ var _ = Describe("Server Test", func() {
 
 		})
 
+		It("Get Revisions for Deployment testdep1", func() {
+			url := fmt.Sprintf("%s/environments/testorg1:testenv1/deployments/testdep1/revisions", hostBase)
+
+			req, err := http.NewRequest("GET", url, nil)
+
+			resp, err := client.Do(req)
+
+			Expect(err).Should(BeNil(), "Shouldn't get an error on GET. Error: %v", err)
+
+			Expect(resp.StatusCode).Should(Equal(200), "Response should be 200 OK")
+
+			revisions := []revisionResponse{}
+			err = json.NewDecoder(resp.Body).Decode(&revisions)
+			Expect(err).Should(BeNil(), "Error decoding response: %v", err)
+
+			//Newest revision first
+			Expect(revisions).Should(HaveLen(2))
+			Expect(revisions[0].Current).Should(BeTrue())
+			Expect(revisions[0].Containers[0].Image).Should(Equal("jbowen/testapp:v1"))
+			Expect(revisions[1].Containers[0].Image).Should(Equal("jbowen/testapp:v0"))
+			Expect(revisions[1].PublicHosts).Should(Equal("deploy.k8s.public"))
+		})
+
+		It("Rollback Deployment testdep1", func() {
+			url := fmt.Sprintf("%s/environments/testorg1:testenv1/deployments/testdep1/rollback", hostBase)
+
+			req, err := http.NewRequest("POST", url, nil)
+
+			resp, err := client.Do(req)
+
+			Expect(err).Should(BeNil(), "Shouldn't get an error on POST. Error: %v", err)
+
+			Expect(resp.StatusCode).Should(Equal(200), "Response should be 200 OK")
+
+			respStore := deploymentResponse{}
+			err = json.NewDecoder(resp.Body).Decode(&respStore)
+			Expect(err).Should(BeNil(), "Error decoding response: %v", err)
+
+			Expect(respStore.Spec.Template.Spec.Containers[0].Image).Should(Equal("jbowen/testapp:v0"))
+		})
+
+		It("Rollback Deployment testdep1 to missing revision", func() {
+			url := fmt.Sprintf("%s/environments/testorg1:testenv1/deployments/testdep1/rollback", hostBase)
+
+			jsonStr := []byte(`{"revision": 42}`)
+			req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonStr))
+
+			resp, err := client.Do(req)
+
+			Expect(err).Should(BeNil(), "Shouldn't get an error on POST. Error: %v", err)
+
+			Expect(resp.StatusCode).Should(Equal(404), "Response should be 404 Not Found")
+		})
+
+		It("Get Status for Deployment testdep1", func() {
+			url := fmt.Sprintf("%s/environments/testorg1:testenv1/deployments/testdep1/status", hostBase)
+
+			req, err := http.NewRequest("GET", url, nil)
+
+			resp, err := client.Do(req)
+
+			Expect(err).Should(BeNil(), "Shouldn't get an error on GET. Error: %v", err)
+
+			Expect(resp.StatusCode).Should(Equal(200), "Response should be 200 OK")
+
+			respStore := statusResponse{}
+			err = json.NewDecoder(resp.Body).Decode(&respStore)
+			Expect(err).Should(BeNil(), "Error decoding response: %v", err)
+
+			Expect(respStore.Complete).Should(BeTrue())
+			Expect(respStore.Failed).Should(BeFalse())
+			Expect(respStore.AvailableReplicas).Should(Equal(respStore.Replicas))
+			Expect(respStore.ObservedGeneration).Should(Equal(respStore.Generation))
+			Expect(respStore.Pods).ShouldNot(BeEmpty())
+			for _, pod := range respStore.Pods {
+				Expect(pod.Ready).Should(BeTrue())
+			}
+		})
+
+		It("Update Deployment with an invalid wait", func() {
+			url := fmt.Sprintf("%s/environments/testorg1:testenv1/deployments/testdep1?wait=forever", hostBase)
+
+			jsonStr := []byte(`{"replicas": 2}`)
+			req, err := http.NewRequest("PATCH", url, bytes.NewBuffer(jsonStr))
+
+			resp, err := client.Do(req)
+
+			Expect(err).Should(BeNil(), "Shouldn't get an error on PATCH. Error: %v", err)
+
+			Expect(resp.StatusCode).Should(Equal(400), "Response should be 400 Bad Request")
+		})
+
 		It("Create Deployment from direct PTS", func() {
 			url := fmt.Sprintf("%s/environments/testorg1:testenv1/deployments", hostBase)
 
@@ -214,10 +496,168 @@ var _ = Describe("Server Test", func() {
 			//TODO: Maybe more thorough checking of response
 		})
 
-		It("Update Deployment from direct PTS", func() {
-			time.Sleep(2000 * time.Millisecond)
+		It("Create Deployment with both PTS URL and direct PTS", func() {
+			url := fmt.Sprintf("%s/environments/testorg1:testenv1/deployments", hostBase)
 
-			url := fmt.Sprintf("%s/environments/testorg1:testenv1/deployments/testdep2", hostBase)
+			jsonStr := []byte(fmt.Sprintf(`{
+				"deploymentName": "testdep3",
+				"publicHosts": "deploy.k8s.public",
+				"replicas": 1,
+				"ptsURL": "%s/pts/testdep1",
+				"pts": {
+					"metadata": {
+						"labels": {
+							"component": "web3"
+						}
+					},
+					"spec": {
+						"containers": [{
+							"name": "test",
+							"image": "jbowen/testapp:v0"
+						}]
+					}
+				}
+			}`, ptsBase))
+
+			req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonStr))
+
+			resp, err := client.Do(req)
+
+			Expect(err).Should(BeNil(), "Shouldn't get an error on POST. Error: %v", err)
+
+			Expect(resp.StatusCode).Should(Equal(400), "Response should be 400 Bad Request")
+		})
+
+		It("Create Deployment with no containers", func() {
+			url := fmt.Sprintf("%s/environments/testorg1:testenv1/deployments", hostBase)
+
+			jsonStr := []byte(`{
+				"deploymentName": "testdep3",
+				"publicHosts": "deploy.k8s.public",
+				"replicas": 1,
+				"pts": {
+					"metadata": {
+						"labels": {
+							"component": "web3"
+						}
+					},
+					"spec": {
+						"containers": []
+					}
+				}
+			}`)
+
+			req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonStr))
+
+			resp, err := client.Do(req)
+
+			Expect(err).Should(BeNil(), "Shouldn't get an error on POST. Error: %v", err)
+
+			Expect(resp.StatusCode).Should(Equal(400), "Response should be 400 Bad Request")
+
+			respStore := errorResponse{}
+			err = json.NewDecoder(resp.Body).Decode(&respStore)
+			Expect(err).Should(BeNil(), "Error decoding response: %v", err)
+			Expect(respStore.Code).Should(Equal("InvalidDeployment"))
+		})
+
+		It("Create Deployment with a sidecar container", func() {
+			url := fmt.Sprintf("%s/environments/testorg1:testenv1/deployments", hostBase)
+
+			jsonStr := []byte(`{
+				"deploymentName": "testdep3",
+				"privateHosts": "deploy.k8s.private",
+				"replicas": 1,
+				"pts": {
+					"metadata": {
+						"labels": {
+							"component": "web3"
+						}
+					},
+					"spec": {
+						"containers": [{
+							"name": "app",
+							"image": "jbowen/testapp:v0"
+						},
+						{
+							"name": "sidecar",
+							"image": "jbowen/testapp:v0"
+						}]
+					}
+				},
+				"envVars": [{
+					"name": "test1",
+					"value": "test3"
+				}],
+				"containerEnvVars": {
+					"sidecar": [{
+						"name": "test1",
+						"value": "sidecar"
+					}]
+				}
+			}`)
+
+			req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonStr))
+
+			resp, err := client.Do(req)
+
+			Expect(err).Should(BeNil(), "Shouldn't get an error on POST. Error: %v", err)
+
+			Expect(resp.StatusCode).Should(Equal(201), "Response should be 201 Created")
+
+			respStore := deploymentResponse{}
+			err = json.NewDecoder(resp.Body).Decode(&respStore)
+			Expect(err).Should(BeNil(), "Error decoding response: %v", err)
+
+			containers := respStore.Spec.Template.Spec.Containers
+			Expect(containers).Should(HaveLen(2))
+			Expect(containers[0].Env).Should(ContainElement(envVar{Name: "test1", Value: "test3"}))
+			Expect(containers[1].Env).Should(ContainElement(envVar{Name: "test1", Value: "sidecar"}))
+		})
+
+		It("Create Deployment with a Service but no ports", func() {
+			url := fmt.Sprintf("%s/environments/testorg1:testenv1/deployments", hostBase)
+
+			jsonStr := []byte(`{
+				"deploymentName": "testdep4",
+				"publicHosts": "deploy.k8s.public",
+				"replicas": 1,
+				"createService": true,
+				"pts": {
+					"metadata": {
+						"labels": {
+							"component": "web4"
+						}
+					},
+					"spec": {
+						"containers": [{
+							"name": "test",
+							"image": "jbowen/testapp:v0"
+						}]
+					}
+				}
+			}`)
+
+			req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonStr))
+
+			resp, err := client.Do(req)
+
+			Expect(err).Should(BeNil(), "Shouldn't get an error on POST. Error: %v", err)
+
+			Expect(resp.StatusCode).Should(Equal(400), "Response should be 400 Bad Request")
+
+			//The deployment shouldn't have been created either
+			req, err = http.NewRequest("GET", url+"/testdep4", nil)
+
+			resp, err = client.Do(req)
+
+			Expect(err).Should(BeNil(), "Shouldn't get an error on GET. Error: %v", err)
+
+			Expect(resp.StatusCode).Should(Equal(404), "Response should be 404 Not Found")
+		})
+
+		It("Update Deployment from direct PTS", func() {
+			url := fmt.Sprintf("%s/environments/testorg1:testenv1/deployments/testdep2?wait=30s", hostBase)
 
 			jsonStr := []byte(`{
 				"publicHosts": "deploy.k8s.local",
@@ -298,6 +738,23 @@ var _ = Describe("Server Test", func() {
 
 		})
 
+		It("Get missing Deployment", func() {
+			url := fmt.Sprintf("%s/environments/testorg1:testenv1/deployments/nosuchdep", hostBase)
+
+			req, err := http.NewRequest("GET", url, nil)
+
+			resp, err := client.Do(req)
+
+			Expect(err).Should(BeNil(), "Shouldn't get an error on GET. Error: %v", err)
+
+			Expect(resp.StatusCode).Should(Equal(404), "Response should be 404 Not Found")
+
+			respStore := errorResponse{}
+			err = json.NewDecoder(resp.Body).Decode(&respStore)
+			Expect(err).Should(BeNil(), "Error decoding response: %v", err)
+			Expect(respStore.Code).Should(Equal("DeploymentNotFound"))
+		})
+
 		It("Get Environment", func() {
 			url := fmt.Sprintf("%s/environments/testorg1:testenv1", hostBase)
 
@@ -310,10 +767,61 @@ var _ = Describe("Server Test", func() {
 			Expect(resp.StatusCode).Should(Equal(200), "Response should be 200 OK")
 		})
 
-		It("Get Logs for Deployment testdep1", func() {
-			//Need to wait for container to start
-			time.Sleep(5000 * time.Millisecond)
+		It("List Environments for testorg1", func() {
+			for _, url := range []string{
+				fmt.Sprintf("%s/environments?org=testorg1", hostBase),
+				fmt.Sprintf("%s/organizations/testorg1/environments", hostBase),
+			} {
+				req, err := http.NewRequest("GET", url, nil)
+
+				resp, err := client.Do(req)
+
+				Expect(err).Should(BeNil(), "Shouldn't get an error on GET. Error: %v", err)
+
+				Expect(resp.StatusCode).Should(Equal(200), "Response should be 200 OK")
+
+				environments := []environmentSummary{}
+				err = json.NewDecoder(resp.Body).Decode(&environments)
+				Expect(err).Should(BeNil(), "Error decoding response: %v", err)
+
+				Expect(environments).Should(HaveLen(1))
+				Expect(environments[0].Name).Should(Equal("testorg1-testenv1"))
+				Expect(environments[0].HostNames).Should(Equal([]string{"testhost2"}))
+				Expect(environments[0].DeploymentCount).Should(BeNumerically(">", 0))
+			}
+		})
+
+		It("List Environments for an unknown organization", func() {
+			url := fmt.Sprintf("%s/organizations/noorg/environments", hostBase)
+
+			req, err := http.NewRequest("GET", url, nil)
 
+			resp, err := client.Do(req)
+
+			Expect(err).Should(BeNil(), "Shouldn't get an error on GET. Error: %v", err)
+
+			Expect(resp.StatusCode).Should(Equal(200), "Response should be 200 OK")
+
+			environments := []environmentSummary{}
+			err = json.NewDecoder(resp.Body).Decode(&environments)
+			Expect(err).Should(BeNil(), "Error decoding response: %v", err)
+
+			Expect(environments).Should(BeEmpty())
+		})
+
+		It("Invalidate cached features of testorg1", func() {
+			url := fmt.Sprintf("%s/organizations/testorg1/features:invalidate", hostBase)
+
+			req, err := http.NewRequest("POST", url, nil)
+
+			resp, err := client.Do(req)
+
+			Expect(err).Should(BeNil(), "Shouldn't get an error on POST. Error: %v", err)
+
+			Expect(resp.StatusCode).Should(Equal(204), "Response should be 204 No Content")
+		})
+
+		It("Get Logs for Deployment testdep1", func() {
 			url := fmt.Sprintf("%s/environments/testorg1:testenv1/deployments/testdep1/logs", hostBase)
 
 			req, err := http.NewRequest("GET", url, nil)
@@ -325,6 +833,58 @@ var _ = Describe("Server Test", func() {
 			Expect(resp.StatusCode).Should(Equal(200), "Response should be 200 OK")
 		})
 
+		It("Follow Logs for Deployment testdep1", func() {
+			url := fmt.Sprintf("%s/environments/testorg1:testenv1/deployments/testdep1/logs?follow=true&timestamps=true", hostBase)
+
+			req, err := http.NewRequest("GET", url, nil)
+
+			resp, err := client.Do(req)
+
+			Expect(err).Should(BeNil(), "Shouldn't get an error on GET. Error: %v", err)
+
+			Expect(resp.StatusCode).Should(Equal(200), "Response should be 200 OK")
+
+			body, err := ioutil.ReadAll(resp.Body)
+			Expect(err).Should(BeNil(), "Error reading response: %v", err)
+
+			//Every line is prefixed with the pod it came from
+			lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+			Expect(lines).ShouldNot(BeEmpty())
+			for _, line := range lines {
+				Expect(line).Should(HavePrefix("[testdep1-"))
+			}
+		})
+
+		It("Follow Logs for Deployment testdep1 as server sent events", func() {
+			url := fmt.Sprintf("%s/environments/testorg1:testenv1/deployments/testdep1/logs?follow=true&container=test", hostBase)
+
+			req, err := http.NewRequest("GET", url, nil)
+			req.Header.Set("Accept", "text/event-stream")
+
+			resp, err := client.Do(req)
+
+			Expect(err).Should(BeNil(), "Shouldn't get an error on GET. Error: %v", err)
+
+			Expect(resp.StatusCode).Should(Equal(200), "Response should be 200 OK")
+			Expect(resp.Header.Get("Content-Type")).Should(Equal("text/event-stream"))
+
+			body, err := ioutil.ReadAll(resp.Body)
+			Expect(err).Should(BeNil(), "Error reading response: %v", err)
+			Expect(string(body)).Should(HavePrefix("data: [testdep1-"))
+		})
+
+		It("Get Logs with both sinceSeconds and sinceTime", func() {
+			url := fmt.Sprintf("%s/environments/testorg1:testenv1/deployments/testdep1/logs?sinceSeconds=10&sinceTime=2016-01-01T00:00:00Z", hostBase)
+
+			req, err := http.NewRequest("GET", url, nil)
+
+			resp, err := client.Do(req)
+
+			Expect(err).Should(BeNil(), "Shouldn't get an error on GET. Error: %v", err)
+
+			Expect(resp.StatusCode).Should(Equal(400), "Response should be 400 Bad Request")
+		})
+
 		It("Delete Deployment testdep1", func() {
 			url := fmt.Sprintf("%s/environments/testorg1:testenv1/deployments/testdep1", hostBase)
 
@@ -351,6 +911,23 @@ var _ = Describe("Server Test", func() {
 
 		})
 
+		It("Delete Environment with an invalid keepKVM", func() {
+			url := fmt.Sprintf("%s/environments/testorg1:testenv1?keepKVM=maybe", hostBase)
+
+			req, err := http.NewRequest("DELETE", url, nil)
+
+			resp, err := client.Do(req)
+
+			Expect(err).Should(BeNil(), "Shouldn't get an error on DELETE. Error: %v", err)
+
+			Expect(resp.StatusCode).Should(Equal(400), "Response should be 400 Bad Request")
+
+			respStore := errorResponse{}
+			err = json.NewDecoder(resp.Body).Decode(&respStore)
+			Expect(err).Should(BeNil(), "Error decoding response: %v", err)
+			Expect(respStore.Code).Should(Equal("InvalidQueryParameter"))
+		})
+
 		It("Delete Environment", func() {
 			url := fmt.Sprintf("%s/environments/testorg1:testenv1", hostBase)
 
@@ -365,41 +942,945 @@ var _ = Describe("Server Test", func() {
 	}
 
 	Context("Local Testing", func() {
-		server, hostBase, err := setup()
+		server, hostBase, ptsBase, err := setup()
 		if err != nil {
 			Fail(fmt.Sprintf("Failed to start server %s", err))
 		}
 
-		ServerTests(server, hostBase)
+		ServerTests(server, hostBase, ptsBase)
 	})
 })
 
-//Initialize a server for testing
-func setup() (*server.Server, string, error) {
-	kubeHost := os.Getenv("KUBE_HOST")
-	testServer := server.NewServer()
+//orgAuthorizer only lets requests for a single organization through
+type orgAuthorizer struct {
+	org string
+}
 
-	if kubeHost == "" {
-		kubeHost = "127.0.0.1:8080"
+func (a orgAuthorizer) Authorize(r *http.Request, org, env string, action auth.Action) *helper.APIError {
+	if org == "" || org == a.org {
+		return nil
 	}
-	clientConfig := restclient.Config{
-		Host: kubeHost,
+	return helper.NewAPIError(http.StatusForbidden, helper.ErrCodeForbidden, "Not allowed", nil)
+}
+
+var _ = Describe("Authorization", func() {
+	_, hostBase, _, err := setupWithAuthorizer(func(server.KubeClient) auth.Authorizer {
+		return orgAuthorizer{org: "authorg1"}
+	})
+	if err != nil {
+		Fail(fmt.Sprintf("Failed to start server %s", err))
+	}
+
+	client := &http.Client{}
+
+	It("Create Environment in an allowed organization", func() {
+		url := fmt.Sprintf("%s/environments", hostBase)
+
+		jsonStr := []byte(`{"environmentName": "authorg1:testenv1", "hostNames": ["authhost1"]}`)
+		req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonStr))
+
+		resp, err := client.Do(req)
+
+		Expect(err).Should(BeNil(), "Shouldn't get an error on POST. Error: %v", err)
+
+		Expect(resp.StatusCode).Should(Equal(201), "Response should be 201 Created")
+	})
+
+	It("Create Environment in a forbidden organization", func() {
+		url := fmt.Sprintf("%s/environments", hostBase)
+
+		jsonStr := []byte(`{"environmentName": "authorg2:testenv1", "hostNames": ["authhost2"]}`)
+		req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonStr))
+
+		resp, err := client.Do(req)
+
+		Expect(err).Should(BeNil(), "Shouldn't get an error on POST. Error: %v", err)
+
+		Expect(resp.StatusCode).Should(Equal(403), "Response should be 403 Forbidden")
+
+		respStore := errorResponse{}
+		err = json.NewDecoder(resp.Body).Decode(&respStore)
+		Expect(err).Should(BeNil(), "Error decoding response: %v", err)
+		Expect(respStore.Code).Should(Equal("Forbidden"))
+	})
+
+	It("Get Deployments in a forbidden organization", func() {
+		url := fmt.Sprintf("%s/environments/authorg2:testenv1/deployments", hostBase)
+
+		req, err := http.NewRequest("GET", url, nil)
+
+		resp, err := client.Do(req)
+
+		Expect(err).Should(BeNil(), "Shouldn't get an error on GET. Error: %v", err)
+
+		Expect(resp.StatusCode).Should(Equal(403), "Response should be 403 Forbidden")
+	})
+
+	It("Delete Environment in an allowed organization", func() {
+		url := fmt.Sprintf("%s/environments/authorg1:testenv1", hostBase)
+
+		req, err := http.NewRequest("DELETE", url, nil)
+
+		resp, err := client.Do(req)
+
+		Expect(err).Should(BeNil(), "Shouldn't get an error on DELETE. Error: %v", err)
+
+		Expect(resp.StatusCode).Should(Equal(204), "Response should be 204 No Content")
+	})
+})
+
+//userCaller is identified by the X-User header, "admin" administering every organization
+type userCaller string
+
+func (caller userCaller) Subject() string {
+	return string(caller)
+}
+
+func (caller userCaller) IsOrgAdmin(org string) (bool, error) {
+	return caller == "admin", nil
+}
+
+type userAuthenticator struct{}
+
+func (userAuthenticator) Authenticate(r *http.Request) (auth.Caller, *helper.APIError) {
+	user := r.Header.Get("X-User")
+	if user == "" {
+		return nil, helper.NewAPIError(http.StatusUnauthorized, helper.ErrCodeUnauthorized, "Invalid Token", nil)
+	}
+	return userCaller(user), nil
+}
+
+var _ = Describe("Roles", func() {
+	_, hostBase, ptsBase, err := setupWithAuthorizer(func(kubeClient server.KubeClient) auth.Authorizer {
+		return auth.NewRoles(userAuthenticator{}, server.NewRoleBindings(kubeClient))
+	})
+	if err != nil {
+		Fail(fmt.Sprintf("Failed to start server %s", err))
 	}
-	err := server.Init(clientConfig)
+
+	It("Create Environment and bind roles as an org admin", func() {
+		resp := request(hostBase, "admin", "POST", "/environments", `{"environmentName": "roleorg1:testenv1", "hostNames": ["rolehost1"]}`)
+		Expect(resp.StatusCode).Should(Equal(201), "Response should be 201 Created")
+
+		resp = request(hostBase, "admin", "PUT", "/environments/roleorg1:testenv1/roles", `{"bindings": {"oncall": "viewer", "ci": "deployer"}}`)
+		Expect(resp.StatusCode).Should(Equal(200), "Response should be 200 OK")
+	})
+
+	It("Bind an unknown role", func() {
+		resp := request(hostBase, "admin", "PUT", "/environments/roleorg1:testenv1/roles", `{"bindings": {"oncall": "owner"}}`)
+		Expect(resp.StatusCode).Should(Equal(400), "Response should be 400 Bad Request")
+
+		respStore := errorResponse{}
+		err := json.NewDecoder(resp.Body).Decode(&respStore)
+		Expect(err).Should(BeNil(), "Error decoding response: %v", err)
+		Expect(respStore.Code).Should(Equal("InvalidRole"))
+	})
+
+	It("Get Environment as a viewer hides the private key", func() {
+		resp := request(hostBase, "oncall", "GET", "/environments/roleorg1:testenv1", "")
+		Expect(resp.StatusCode).Should(Equal(200), "Response should be 200 OK")
+
+		respStore := environmentResponse{}
+		err := json.NewDecoder(resp.Body).Decode(&respStore)
+		Expect(err).Should(BeNil(), "Error decoding response: %v", err)
+		Expect(respStore.PublicSecret).ShouldNot(BeEmpty())
+		Expect(respStore.PrivateSecret).Should(BeEmpty())
+
+		resp = request(hostBase, "admin", "GET", "/environments/roleorg1:testenv1", "")
+		respStore = environmentResponse{}
+		err = json.NewDecoder(resp.Body).Decode(&respStore)
+		Expect(err).Should(BeNil(), "Error decoding response: %v", err)
+		Expect(respStore.PrivateSecret).ShouldNot(BeEmpty())
+	})
+
+	It("Create Deployment as a viewer", func() {
+		resp := request(hostBase, "oncall", "POST", "/environments/roleorg1:testenv1/deployments", fmt.Sprintf(`{"deploymentName": "roledep1", "publicHosts": "role.k8s.public", "privateHosts": "role.k8s.private", "replicas": 1, "ptsURL": "%s/pts/testdep1"}`, ptsBase))
+		Expect(resp.StatusCode).Should(Equal(403), "Response should be 403 Forbidden")
+	})
+
+	It("Create and delete a Deployment as a deployer", func() {
+		resp := request(hostBase, "ci", "POST", "/environments/roleorg1:testenv1/deployments", fmt.Sprintf(`{"deploymentName": "roledep1", "publicHosts": "role.k8s.public", "privateHosts": "role.k8s.private", "replicas": 1, "ptsURL": "%s/pts/testdep1"}`, ptsBase))
+		Expect(resp.StatusCode).Should(Equal(201), "Response should be 201 Created")
+
+		resp = request(hostBase, "ci", "DELETE", "/environments/roleorg1:testenv1/deployments/roledep1", "")
+		Expect(resp.StatusCode).Should(Equal(204), "Response should be 204 No Content")
+	})
+
+	It("Update Environment as a deployer", func() {
+		resp := request(hostBase, "ci", "PATCH", "/environments/roleorg1:testenv1", `{"hostNames": ["rolehost2"]}`)
+		Expect(resp.StatusCode).Should(Equal(403), "Response should be 403 Forbidden")
+	})
+
+	It("List Environments as a stranger", func() {
+		resp := request(hostBase, "stranger", "GET", "/environments", "")
+		Expect(resp.StatusCode).Should(Equal(200), "Response should be 200 OK")
+
+		environments := []environmentSummary{}
+		err := json.NewDecoder(resp.Body).Decode(&environments)
+		Expect(err).Should(BeNil(), "Error decoding response: %v", err)
+		Expect(environments).Should(BeEmpty())
+	})
+
+	It("Delete Environment as an org admin", func() {
+		resp := request(hostBase, "admin", "DELETE", "/environments/roleorg1:testenv1", "")
+		Expect(resp.StatusCode).Should(Equal(204), "Response should be 204 No Content")
+	})
+})
+
+var _ = Describe("Audit", func() {
+	_, hostBase, ptsBase, err := setupWithAuthorizer(func(kubeClient server.KubeClient) auth.Authorizer {
+		return auth.NewRoles(userAuthenticator{}, server.NewRoleBindings(kubeClient))
+	})
 	if err != nil {
-		fmt.Printf("Error on init: %v\n", err)
+		Fail(fmt.Sprintf("Failed to start server %s", err))
 	}
 
-	//Start in background
-	go func() {
-		err := testServer.Start()
+	It("Create Environment and Deployment to audit", func() {
+		resp := request(hostBase, "admin", "POST", "/environments", `{"environmentName": "auditorg1:testenv1", "hostNames": ["audithost1"]}`)
+		Expect(resp.StatusCode).Should(Equal(201), "Response should be 201 Created")
 
-		if err != nil {
-			fmt.Printf("Could not start server %s", err)
+		resp = request(hostBase, "admin", "POST", "/environments/auditorg1:testenv1/deployments", fmt.Sprintf(`{"deploymentName": "auditdep1", "publicHosts": "audit.k8s.public", "privateHosts": "audit.k8s.private", "replicas": 1, "ptsURL": "%s/pts/testdep1", "envVars": [{"name": "DB_PASSWORD", "value": "hunter2"}]}`, ptsBase))
+		Expect(resp.StatusCode).Should(Equal(201), "Response should be 201 Created")
+	})
+
+	It("Delete Deployment without a role", func() {
+		resp := request(hostBase, "intruder", "DELETE", "/environments/auditorg1:testenv1/deployments/auditdep1", "")
+		Expect(resp.StatusCode).Should(Equal(403), "Response should be 403 Forbidden")
+	})
+
+	It("Get audit records of the Environment", func() {
+		resp := request(hostBase, "admin", "GET", "/environments/auditorg1:testenv1/audit", "")
+		Expect(resp.StatusCode).Should(Equal(200), "Response should be 200 OK")
+
+		records := []auditRecord{}
+		err := json.NewDecoder(resp.Body).Decode(&records)
+		Expect(err).Should(BeNil(), "Error decoding response: %v", err)
+		Expect(records).Should(HaveLen(3))
+
+		//The most recent first
+		Expect(records[0].Actor).Should(Equal("intruder"))
+		Expect(records[0].Action).Should(Equal("deleteDeployment"))
+		Expect(records[0].Target.Deployment).Should(Equal("auditdep1"))
+		Expect(records[0].Outcome.Result).Should(Equal("failure"))
+		Expect(records[0].Outcome.Status).Should(Equal(403))
+		Expect(records[0].Outcome.ErrorCode).Should(Equal("Forbidden"))
+
+		Expect(records[1].Actor).Should(Equal("admin"))
+		Expect(records[1].Action).Should(Equal("createDeployment"))
+		Expect(records[1].Outcome.Result).Should(Equal("success"))
+		Expect(string(records[1].Diff)).Should(ContainSubstring(`"deploymentName":"auditdep1"`))
+		Expect(string(records[1].Diff)).ShouldNot(ContainSubstring("hunter2"))
+		Expect(records[1].RequestID).ShouldNot(BeEmpty())
+
+		Expect(records[2].Action).Should(Equal("createEnvironment"))
+		Expect(records[2].Target.Organization).Should(Equal("auditorg1"))
+		Expect(records[2].Target.Environment).Should(Equal("testenv1"))
+	})
+
+	It("Filter audit records by action", func() {
+		resp := request(hostBase, "admin", "GET", "/environments/auditorg1:testenv1/audit?action=createEnvironment&limit=10", "")
+		Expect(resp.StatusCode).Should(Equal(200), "Response should be 200 OK")
+
+		records := []auditRecord{}
+		err := json.NewDecoder(resp.Body).Decode(&records)
+		Expect(err).Should(BeNil(), "Error decoding response: %v", err)
+		Expect(records).Should(HaveLen(1))
+		Expect(records[0].Action).Should(Equal("createEnvironment"))
+	})
+
+	It("Get audit records with an invalid since", func() {
+		resp := request(hostBase, "admin", "GET", "/environments/auditorg1:testenv1/audit?since=yesterday", "")
+		Expect(resp.StatusCode).Should(Equal(400), "Response should be 400 Bad Request")
+	})
+
+	It("Get audit records without a role", func() {
+		resp := request(hostBase, "intruder", "GET", "/environments/auditorg1:testenv1/audit", "")
+		Expect(resp.StatusCode).Should(Equal(403), "Response should be 403 Forbidden")
+	})
+
+	It("Delete Environment", func() {
+		resp := request(hostBase, "admin", "DELETE", "/environments/auditorg1:testenv1", "")
+		Expect(resp.StatusCode).Should(Equal(204), "Response should be 204 No Content")
+	})
+})
+
+var _ = Describe("Metrics", func() {
+	_, hostBase, _, err := setup()
+	if err != nil {
+		Fail(fmt.Sprintf("Failed to start server %s", err))
+	}
+
+	client := &http.Client{}
+
+	It("Create Environment to measure", func() {
+		jsonStr := []byte(`{"environmentName": "metricsorg1:testenv1", "hostNames": ["metricshost1"]}`)
+		resp, err := client.Post(hostBase+"/environments", "application/json", bytes.NewBuffer(jsonStr))
+		Expect(err).Should(BeNil(), "Shouldn't get an error on POST. Error: %v", err)
+		Expect(resp.StatusCode).Should(Equal(201), "Response should be 201 Created")
+	})
+
+	It("Export request, Kubernetes, provisioning and inventory metrics", func() {
+		resp, err := client.Get(hostBase + "/metrics")
+		Expect(err).Should(BeNil(), "Shouldn't get an error on GET. Error: %v", err)
+		Expect(resp.StatusCode).Should(Equal(200), "Response should be 200 OK")
+
+		body, err := ioutil.ReadAll(resp.Body)
+		Expect(err).Should(BeNil())
+		Expect(string(body)).Should(ContainSubstring(`enrober_http_requests_total{code="201",method="POST",route="/environments"}`))
+		Expect(string(body)).Should(ContainSubstring(`enrober_kubernetes_requests_total{code="201",operation="create namespaces"}`))
+		Expect(string(body)).Should(ContainSubstring(`enrober_environment_steps_total{operation="create",status="done",step="namespace"}`))
+		Expect(string(body)).Should(ContainSubstring(`enrober_environments{organization="metricsorg1"} 1`))
+		Expect(string(body)).Should(ContainSubstring(`enrober_deployments{organization="metricsorg1"} 0`))
+	})
+
+	It("Delete Environment", func() {
+		req, err := http.NewRequest("DELETE", hostBase+"/environments/metricsorg1:testenv1", nil)
+		Expect(err).Should(BeNil())
+		resp, err := client.Do(req)
+		Expect(err).Should(BeNil(), "Shouldn't get an error on DELETE. Error: %v", err)
+		Expect(resp.StatusCode).Should(Equal(204), "Response should be 204 No Content")
+	})
+})
+
+var _ = Describe("Host names", func() {
+	_, hostBase, _, err := setup()
+	if err != nil {
+		Fail(fmt.Sprintf("Failed to start server %s", err))
+	}
+
+	It("Match whole host names only", func() {
+		resp := request(hostBase, "", "POST", "/environments", `{"environmentName": "hostorg1:testenv1", "hostNames": ["api.hosts.com"]}`)
+		Expect(resp.StatusCode).Should(Equal(201), "Response should be 201 Created")
+
+		resp = request(hostBase, "", "POST", "/environments", `{"environmentName": "hostorg2:testenv1", "hostNames": ["myapi.hosts.com"]}`)
+		Expect(resp.StatusCode).Should(Equal(201), "A host containing another one shouldn't be a duplicate")
+	})
+
+	It("Ignore the hosts of the environment being updated", func() {
+		resp := request(hostBase, "", "PATCH", "/environments/hostorg2:testenv1", `{"hostNames": ["myapi.hosts.com", "other.hosts.com"]}`)
+		Expect(resp.StatusCode).Should(Equal(200), "Response should be 200 OK")
+	})
+
+	It("Reject the hosts of other environments", func() {
+		resp := request(hostBase, "", "PATCH", "/environments/hostorg2:testenv1", `{"hostNames": ["myapi.hosts.com", "API.hosts.com"]}`)
+		Expect(resp.StatusCode).Should(Equal(409), "Response should be 409 Conflict")
+
+		respStore := errorResponse{}
+		err := json.NewDecoder(resp.Body).Decode(&respStore)
+		Expect(err).Should(BeNil(), "Error decoding response: %v", err)
+		Expect(respStore.Code).Should(Equal("DuplicateHostName"))
+		Expect(respStore.Message).Should(Equal("Duplicate HostNames: api.hosts.com"))
+	})
+
+	It("Free the hosts of deleted environments", func() {
+		resp := request(hostBase, "", "DELETE", "/environments/hostorg1:testenv1", "")
+		Expect(resp.StatusCode).Should(Equal(204), "Response should be 204 No Content")
+
+		//The index learns about the deletion from the namespace watch
+		Eventually(func() int {
+			resp := request(hostBase, "", "POST", "/environments", `{"environmentName": "hostorg3:testenv1", "hostNames": ["api.hosts.com"]}`)
+			resp.Body.Close()
+			return resp.StatusCode
+		}).Should(Equal(201))
+	})
+})
+
+var _ = Describe("Deployment logs", func() {
+	_, hostBase, ptsBase, err := setup()
+	if err != nil {
+		Fail(fmt.Sprintf("Failed to start server %s", err))
+	}
+
+	It("Create Environment and a Deployment with a sidecar", func() {
+		resp := request(hostBase, "", "POST", "/environments", `{"environmentName": "logsorg1:testenv1", "hostNames": ["logshost1"]}`)
+		Expect(resp.StatusCode).Should(Equal(201), "Response should be 201 Created")
+
+		resp = request(hostBase, "", "POST", "/environments/logsorg1:testenv1/deployments", fmt.Sprintf(`{"deploymentName": "logsdep1", "publicHosts": "logs.k8s.public", "privateHosts": "logs.k8s.private", "replicas": 1, "ptsURL": "%s/pts/logsdep1"}`, ptsBase))
+		Expect(resp.StatusCode).Should(Equal(201), "Response should be 201 Created")
+	})
+
+	It("Get Logs without a container", func() {
+		resp := request(hostBase, "", "GET", "/environments/logsorg1:testenv1/deployments/logsdep1/logs", "")
+		Expect(resp.StatusCode).Should(Equal(400), "Response should be 400 Bad Request")
+
+		respStore := errorResponse{}
+		err := json.NewDecoder(resp.Body).Decode(&respStore)
+		Expect(err).Should(BeNil(), "Error decoding response: %v", err)
+		Expect(respStore.Code).Should(Equal("InvalidQueryParameter"))
+		Expect(respStore.Message).Should(ContainSubstring("web, sidecar"))
+	})
+
+	It("Get Logs of a container", func() {
+		resp := request(hostBase, "", "GET", "/environments/logsorg1:testenv1/deployments/logsdep1/logs?container=sidecar", "")
+		Expect(resp.StatusCode).Should(Equal(200), "Response should be 200 OK")
+
+		body, err := ioutil.ReadAll(resp.Body)
+		Expect(err).Should(BeNil(), "Error reading response: %v", err)
+		Expect(string(body)).Should(ContainSubstring("/sidecar started"))
+		Expect(string(body)).ShouldNot(ContainSubstring("/web started"))
+	})
+
+	It("Delete Environment", func() {
+		resp := request(hostBase, "", "DELETE", "/environments/logsorg1:testenv1", "")
+		Expect(resp.StatusCode).Should(Equal(204), "Response should be 204 No Content")
+	})
+})
+
+var _ = Describe("Health", func() {
+	_, hostBase, _, err := setup()
+	if err != nil {
+		Fail(fmt.Sprintf("Failed to start server %s", err))
+	}
+
+	client := &http.Client{}
+
+	getHealth := func(url string) (int, healthResponse) {
+		resp, err := client.Get(url)
+		Expect(err).Should(BeNil(), "Shouldn't get an error on GET. Error: %v", err)
+
+		respStore := healthResponse{}
+		err = json.NewDecoder(resp.Body).Decode(&respStore)
+		Expect(err).Should(BeNil(), "Error decoding response: %v", err)
+		return resp.StatusCode, respStore
+	}
+
+	It("Report liveness", func() {
+		status, health := getHealth(hostBase + "/healthz")
+		Expect(status).Should(Equal(200), "Response should be 200 OK")
+		Expect(health.Status).Should(Equal("ok"))
+	})
+
+	It("Report readiness with every check", func() {
+		status, health := getHealth(hostBase + "/readyz")
+		Expect(status).Should(Equal(200), "Response should be 200 OK")
+		Expect(health.Status).Should(Equal("ok"))
+		Expect(health.Checks).Should(HaveLen(3))
+		for _, check := range health.Checks {
+			Expect(check.Status).Should(Equal("ok"), "Check %s failed: %s", check.Name, check.Error)
 		}
-	}()
+	})
+
+	It("Report not ready without Kubernetes", func() {
+		kubeServer := httptest.NewServer(http.NotFoundHandler())
+		kubeServer.Close()
+
+		cfg := config.Default()
+		cfg.Kubernetes.Master = kubeServer.URL
+		kubeClient, err := server.Init(cfg)
+		Expect(err).Should(BeNil())
+		unreachable := httptest.NewServer(server.NewServer(kubeClient, auth.AllowAll{}, cfg, nil).Router)
+		defer unreachable.Close()
+
+		status, health := getHealth(unreachable.URL + "/readyz")
+		Expect(status).Should(Equal(503), "Response should be 503 Service Unavailable")
+		Expect(health.Status).Should(Equal("failed"))
+		for _, check := range health.Checks {
+			Expect(check.Status).Should(Equal("failed"))
+			Expect(check.Error).ShouldNot(BeEmpty())
+		}
+
+		//Liveness doesn't depend on Kubernetes
+		status, _ = getHealth(unreachable.URL + "/healthz")
+		Expect(status).Should(Equal(200), "Response should be 200 OK")
+	})
+})
+
+var _ = Describe("Request IDs", func() {
+	_, hostBase, _, err := setup()
+	if err != nil {
+		Fail(fmt.Sprintf("Failed to start server %s", err))
+	}
+
+	client := &http.Client{}
 
-	hostBase := "http://localhost:9000"
+	It("Generate a request ID", func() {
+		resp, err := client.Get(hostBase + "/environments/requestidorg1:testenv1")
+		Expect(err).Should(BeNil(), "Shouldn't get an error on GET. Error: %v", err)
+		Expect(resp.Header.Get("X-Request-Id")).Should(MatchRegexp(`^[0-9a-f]{32}$`))
+	})
+
+	It("Echo the caller's request ID", func() {
+		req, err := http.NewRequest("GET", hostBase+"/environments/requestidorg1:testenv1", nil)
+		Expect(err).Should(BeNil())
+		req.Header.Set("X-Request-Id", "caller-id.1")
+		resp, err := client.Do(req)
+		Expect(err).Should(BeNil(), "Shouldn't get an error on GET. Error: %v", err)
+		Expect(resp.Header.Get("X-Request-Id")).Should(Equal("caller-id.1"))
+	})
+
+	It("Replace an invalid request ID", func() {
+		req, err := http.NewRequest("GET", hostBase+"/environments/requestidorg1:testenv1", nil)
+		Expect(err).Should(BeNil())
+		req.Header.Set("X-Request-Id", "not a valid id")
+		resp, err := client.Do(req)
+		Expect(err).Should(BeNil(), "Shouldn't get an error on GET. Error: %v", err)
+		Expect(resp.Header.Get("X-Request-Id")).Should(MatchRegexp(`^[0-9a-f]{32}$`))
+	})
+})
+
+var _ = Describe("Kubernetes client config", func() {
+	const kubeconfig = `apiVersion: v1
+kind: Config
+current-context: local
+clusters:
+- name: local
+  cluster:
+    server: http://127.0.0.1:8080
+- name: staging
+  cluster:
+    server: https://staging.example.com
+users:
+- name: deployer
+  user:
+    token: staging-token
+contexts:
+- name: local
+  context:
+    cluster: local
+- name: staging
+  context:
+    cluster: staging
+    user: deployer
+`
+
+	var kubeconfigFile string
+
+	BeforeEach(func() {
+		file, err := ioutil.TempFile("", "kubeconfig")
+		Expect(err).Should(BeNil())
+		_, err = file.WriteString(kubeconfig)
+		Expect(err).Should(BeNil())
+		file.Close()
+		kubeconfigFile = file.Name()
+	})
+
+	AfterEach(func() {
+		os.Remove(kubeconfigFile)
+	})
+
+	It("Use the current context of a kubeconfig", func() {
+		clientConfig, err := server.KubeClientConfig(config.Kubernetes{Kubeconfig: kubeconfigFile})
+		Expect(err).Should(BeNil(), "Error loading kubeconfig: %v", err)
+		Expect(clientConfig.Host).Should(Equal("http://127.0.0.1:8080"))
+	})
+
+	It("Use another context of a kubeconfig", func() {
+		clientConfig, err := server.KubeClientConfig(config.Kubernetes{Kubeconfig: kubeconfigFile, Context: "staging"})
+		Expect(err).Should(BeNil(), "Error loading kubeconfig: %v", err)
+		Expect(clientConfig.Host).Should(Equal("https://staging.example.com"))
+		Expect(clientConfig.BearerToken).Should(Equal("staging-token"))
+	})
+
+	It("Override the master of a kubeconfig", func() {
+		clientConfig, err := server.KubeClientConfig(config.Kubernetes{Kubeconfig: kubeconfigFile, Context: "staging", Master: "https://other.example.com"})
+		Expect(err).Should(BeNil(), "Error loading kubeconfig: %v", err)
+		Expect(clientConfig.Host).Should(Equal("https://other.example.com"))
+	})
+
+	It("Fail on an unknown context", func() {
+		_, err := server.KubeClientConfig(config.Kubernetes{Kubeconfig: kubeconfigFile, Context: "missing"})
+		Expect(err).ShouldNot(BeNil())
+	})
+
+	It("Use a master with TLS settings", func() {
+		clientConfig, err := server.KubeClientConfig(config.Kubernetes{
+			Master:               "https://kube.example.com",
+			CertificateAuthority: "/etc/enrober/ca.crt",
+			Token:                "token",
+		})
+		Expect(err).Should(BeNil())
+		Expect(clientConfig.Host).Should(Equal("https://kube.example.com"))
+		Expect(clientConfig.BearerToken).Should(Equal("token"))
+		Expect(clientConfig.TLSClientConfig.CAFile).Should(Equal("/etc/enrober/ca.crt"))
+	})
+})
+
+//kvmEntry returns the decoded value of an entry of the shipyard-routing KVM held by the fake Apigee
+func kvmEntry(apigeeAPI *fakeapigee.API, org, env, name string) (string, bool) {
+	kvm, ok := apigeeAPI.KVM(org, env, "shipyard-routing")
+	if !ok {
+		return "", false
+	}
+	entry, ok := kvm.GetEntry(name)
+	if !ok {
+		return "", false
+	}
+	value, err := base64.StdEncoding.DecodeString(entry.Value)
+	Expect(err).Should(BeNil(), "Error decoding KVM entry: %v", err)
+	return string(value), true
+}
+
+var _ = Describe("Routing KVM", func() {
+	hostBase, apigeeAPI, cluster, err := setupWithApigee("kvmorg1")
+	if err != nil {
+		Fail(fmt.Sprintf("Failed to start server %s", err))
+	}
+
+	//createEnvironment creates an environment and returns its public key
+	createEnvironment := func(env string) string {
+		resp := request(hostBase, "admin", "POST", "/environments", fmt.Sprintf(`{"environmentName": "kvmorg1:%s"}`, env))
+		Expect(resp.StatusCode).Should(Equal(201), "Response should be 201 Created")
+
+		respStore := environmentResponse{}
+		err := json.NewDecoder(resp.Body).Decode(&respStore)
+		Expect(err).Should(BeNil(), "Error decoding response: %v", err)
+		Expect(respStore.Steps).Should(ContainElement(stepResult{Step: "kvm", Status: "done"}))
+
+		value, ok := kvmEntry(apigeeAPI, "kvmorg1", env, "x-routing-api-key")
+		Expect(ok).Should(BeTrue(), "The public key should be in the KVM")
+		Expect(value).Should(Equal(string(respStore.PublicSecret)))
+		return value
+	}
+
+	//rotatePublicKey rotates the public key of an environment and returns the new one
+	rotatePublicKey := func(env, gracePeriod string) string {
+		resp := request(hostBase, "admin", "POST", fmt.Sprintf("/environments/kvmorg1:%s/keys:rotate", env), fmt.Sprintf(`{"keys": ["public"], "gracePeriod": "%s"}`, gracePeriod))
+		Expect(resp.StatusCode).Should(Equal(200), "Response should be 200 OK")
+
+		respStore := environmentResponse{}
+		err := json.NewDecoder(resp.Body).Decode(&respStore)
+		Expect(err).Should(BeNil(), "Error decoding response: %v", err)
+		return string(respStore.PublicSecret)
+	}
+
+	It("Rotate keys pushes the new public key and keeps the old one through the grace period", func() {
+		oldKey := createEnvironment("rotateenv1")
+		newKey := rotatePublicKey("rotateenv1", "1h")
+
+		value, ok := kvmEntry(apigeeAPI, "kvmorg1", "rotateenv1", "x-routing-api-key")
+		Expect(ok).Should(BeTrue(), "The new public key should be in the KVM")
+		Expect(value).Should(Equal(newKey))
+
+		//Reading the environment expires previous keys whose grace period is over, not this one
+		resp := request(hostBase, "admin", "GET", "/environments/kvmorg1:rotateenv1", "")
+		Expect(resp.StatusCode).Should(Equal(200), "Response should be 200 OK")
+
+		value, ok = kvmEntry(apigeeAPI, "kvmorg1", "rotateenv1", "x-routing-api-key-previous")
+		Expect(ok).Should(BeTrue(), "The old public key should be kept in the KVM during the grace period")
+		Expect(value).Should(Equal(oldKey))
+
+		resp = request(hostBase, "admin", "DELETE", "/environments/kvmorg1:rotateenv1", "")
+		Expect(resp.StatusCode).Should(Equal(204), "Response should be 204 No Content")
+
+		_, ok = kvmEntry(apigeeAPI, "kvmorg1", "rotateenv1", "x-routing-api-key-previous")
+		Expect(ok).Should(BeFalse(), "The old public key should be removed along with the environment")
+	})
+
+	It("Rotate keys removes the old public key once the grace period is over", func() {
+		oldKey := createEnvironment("rotateenv2")
+		newKey := rotatePublicKey("rotateenv2", "1s")
+
+		value, ok := kvmEntry(apigeeAPI, "kvmorg1", "rotateenv2", "x-routing-api-key-previous")
+		Expect(ok).Should(BeTrue(), "The old public key should be kept in the KVM during the grace period")
+		Expect(value).Should(Equal(oldKey))
+
+		Eventually(func() bool {
+			resp := request(hostBase, "admin", "GET", "/environments/kvmorg1:rotateenv2", "")
+			Expect(resp.StatusCode).Should(Equal(200), "Response should be 200 OK")
+			_, ok := kvmEntry(apigeeAPI, "kvmorg1", "rotateenv2", "x-routing-api-key-previous")
+			return ok
+		}, 5*time.Second, 250*time.Millisecond).Should(BeFalse(), "The old public key should be removed from the KVM once the grace period is over")
+
+		value, ok = kvmEntry(apigeeAPI, "kvmorg1", "rotateenv2", "x-routing-api-key")
+		Expect(ok).Should(BeTrue(), "The new public key should stay in the KVM")
+		Expect(value).Should(Equal(newKey))
+
+		resp := request(hostBase, "admin", "DELETE", "/environments/kvmorg1:rotateenv2", "")
+		Expect(resp.StatusCode).Should(Equal(204), "Response should be 204 No Content")
+	})
+
+	It("Delete Environment removes the KVM entry", func() {
+		createEnvironment("testenv1")
+
+		resp := request(hostBase, "admin", "DELETE", "/environments/kvmorg1:testenv1", "")
+		Expect(resp.StatusCode).Should(Equal(204), "Response should be 204 No Content")
+
+		_, ok := kvmEntry(apigeeAPI, "kvmorg1", "testenv1", "x-routing-api-key")
+		Expect(ok).Should(BeFalse(), "The public key should be removed from the KVM")
+	})
+
+	It("Delete Environment with keepKVM keeps the KVM entry", func() {
+		publicKey := createEnvironment("testenv2")
+
+		resp := request(hostBase, "admin", "DELETE", "/environments/kvmorg1:testenv2?keepKVM=true", "")
+		Expect(resp.StatusCode).Should(Equal(204), "Response should be 204 No Content")
+
+		value, ok := kvmEntry(apigeeAPI, "kvmorg1", "testenv2", "x-routing-api-key")
+		Expect(ok).Should(BeTrue(), "The public key should be kept in the KVM")
+		Expect(value).Should(Equal(publicKey))
+	})
+
+	It("Delete Environment keeps the namespace when the KVM entry can't be removed", func() {
+		publicKey := createEnvironment("testenv3")
+
+		apigeeAPI.FailNext(500)
+		resp := request(hostBase, "admin", "DELETE", "/environments/kvmorg1:testenv3", "")
+		Expect(resp.StatusCode).Should(Equal(502), "Response should be 502 Bad Gateway")
+
+		respStore := errorResponse{}
+		err := json.NewDecoder(resp.Body).Decode(&respStore)
+		Expect(err).Should(BeNil(), "Error decoding response: %v", err)
+		Expect(respStore.Code).Should(Equal("ApigeeError"))
+		Expect(respStore.Steps).Should(ContainElement(stepResult{Step: "kvm", Status: "failed"}))
+		Expect(respStore.Steps).Should(ContainElement(stepResult{Step: "namespace", Status: "notRun"}))
+
+		value, ok := kvmEntry(apigeeAPI, "kvmorg1", "testenv3", "x-routing-api-key")
+		Expect(ok).Should(BeTrue(), "The public key should still be in the KVM")
+		Expect(value).Should(Equal(publicKey))
+
+		resp = request(hostBase, "admin", "GET", "/environments/kvmorg1:testenv3", "")
+		Expect(resp.StatusCode).Should(Equal(200), "Response should be 200 OK")
+
+		resp = request(hostBase, "admin", "DELETE", "/environments/kvmorg1:testenv3", "")
+		Expect(resp.StatusCode).Should(Equal(204), "Response should be 204 No Content")
+	})
+
+	It("Create Environment rolls back the KVM entry when the secret can't be created", func() {
+		cluster.FailNext("POST", "secrets", 500)
+		resp := request(hostBase, "admin", "POST", "/environments", `{"environmentName": "kvmorg1:testenv4"}`)
+		Expect(resp.StatusCode).Should(Equal(500), "Response should be 500 Internal Server Error")
+
+		respStore := errorResponse{}
+		err := json.NewDecoder(resp.Body).Decode(&respStore)
+		Expect(err).Should(BeNil(), "Error decoding response: %v", err)
+		Expect(respStore.Code).Should(Equal("KubernetesError"))
+		Expect(respStore.Steps).Should(ContainElement(stepResult{Step: "kvm", Status: "compensated"}))
+		Expect(respStore.Steps).Should(ContainElement(stepResult{Step: "namespace", Status: "compensated"}))
+		Expect(respStore.Steps).Should(ContainElement(stepResult{Step: "secret", Status: "failed"}))
+
+		_, ok := kvmEntry(apigeeAPI, "kvmorg1", "testenv4", "x-routing-api-key")
+		Expect(ok).Should(BeFalse(), "The public key should be removed from the KVM")
+
+		resp = request(hostBase, "admin", "GET", "/environments/kvmorg1:testenv4", "")
+		Expect(resp.StatusCode).Should(Equal(404), "Response should be 404 Not Found")
+	})
+
+	It("Create Environment restores the KVM entry of a kept environment when the namespace can't be created", func() {
+		publicKey := createEnvironment("testenv5")
+		resp := request(hostBase, "admin", "DELETE", "/environments/kvmorg1:testenv5?keepKVM=true", "")
+		Expect(resp.StatusCode).Should(Equal(204), "Response should be 204 No Content")
+
+		cluster.FailNext("POST", "namespaces", 500)
+		resp = request(hostBase, "admin", "POST", "/environments", `{"environmentName": "kvmorg1:testenv5"}`)
+		Expect(resp.StatusCode).Should(Equal(500), "Response should be 500 Internal Server Error")
+
+		respStore := errorResponse{}
+		err := json.NewDecoder(resp.Body).Decode(&respStore)
+		Expect(err).Should(BeNil(), "Error decoding response: %v", err)
+		Expect(respStore.Steps).Should(ContainElement(stepResult{Step: "kvm", Status: "compensated"}))
+		Expect(respStore.Steps).Should(ContainElement(stepResult{Step: "namespace", Status: "failed"}))
+		Expect(respStore.Steps).Should(ContainElement(stepResult{Step: "secret", Status: "notRun"}))
+
+		value, ok := kvmEntry(apigeeAPI, "kvmorg1", "testenv5", "x-routing-api-key")
+		Expect(ok).Should(BeTrue(), "The previous public key should be put back in the KVM")
+		Expect(value).Should(Equal(publicKey))
+	})
+})
+
+var _ = Describe("Graceful shutdown", func() {
+	It("Drain in-flight requests on SIGTERM", func() {
+		testServer, _, _, err := setup()
+		Expect(err).Should(BeNil(), "Error setting up tests: %v", err)
+
+		//Stand in for a slow request such as provisioning an environment
+		started := make(chan struct{})
+		release := make(chan struct{})
+		testServer.Router = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			w.WriteHeader(201)
+		})
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).Should(BeNil())
+		stop := make(chan os.Signal, 1)
+		served := make(chan error, 1)
+		go func() {
+			served <- testServer.Serve(listener, stop)
+		}()
+
+		responses := make(chan *http.Response, 1)
+		go func() {
+			resp, err := http.Post("http://"+listener.Addr().String()+"/environments", "application/json", strings.NewReader("{}"))
+			Expect(err).Should(BeNil(), "In-flight request should complete: %v", err)
+			responses <- resp
+		}()
+		Eventually(started).Should(BeClosed())
+
+		stop <- syscall.SIGTERM
+		Consistently(served, "200ms").ShouldNot(Receive(), "Serve should wait for in-flight requests")
+
+		close(release)
+		var resp *http.Response
+		Eventually(responses).Should(Receive(&resp))
+		Expect(resp.StatusCode).Should(Equal(201))
+		Eventually(served).Should(Receive(BeNil()))
+	})
+})
+
+//Pod template specs served to the "from PTS URL" specs
+var testPTS = map[string]string{
+	"testdep1": `{
+		"metadata": {
+			"name": "testpod1",
+			"labels": {
+				"component": "web1"
+			},
+			"annotations": {
+				"publicPaths": "80:/",
+				"privatePaths": "80:/"
+			}
+		},
+		"spec": {
+			"containers": [{
+				"name": "test",
+				"image": "jbowen/testapp:v0",
+				"env": [{
+					"name": "PORT",
+					"value": "80"
+				}],
+				"ports": [{
+					"containerPort": 80
+				}]
+			}]
+		}
+	}`,
+	"logsdep1": `{
+		"metadata": {
+			"name": "logspod1",
+			"labels": {
+				"component": "logs1"
+			},
+			"annotations": {
+				"publicPaths": "80:/",
+				"privatePaths": "80:/"
+			}
+		},
+		"spec": {
+			"containers": [{
+				"name": "web",
+				"image": "jbowen/testapp:v0",
+				"ports": [{
+					"containerPort": 80
+				}]
+			}, {
+				"name": "sidecar",
+				"image": "jbowen/testapp:v0"
+			}]
+		}
+	}`,
+	"testdep1-v2": `{
+		"metadata": {
+			"name": "testpod1",
+			"labels": {
+				"component": "web1"
+			},
+			"annotations": {
+				"publicPaths": "81:/",
+				"privatePaths": "81:/"
+			}
+		},
+		"spec": {
+			"containers": [{
+				"name": "test",
+				"image": "jbowen/testapp:v1",
+				"env": [{
+					"name": "PORT",
+					"value": "81"
+				}],
+				"ports": [{
+					"containerPort": 81
+				}]
+			}]
+		}
+	}`,
+}
+
+//Initialize a server for testing
+//Kubernetes, the PTS host and enrober itself all run as local httptest servers
+func setup() (*server.Server, string, string, error) {
+	return setupWithAuthorizer(func(server.KubeClient) auth.Authorizer {
+		return auth.AllowAll{}
+	})
+}
+
+//setupWithAuthorizer initializes a server for testing that checks requests with the authorizer returned by newAuthorizer
+func setupWithAuthorizer(newAuthorizer func(server.KubeClient) auth.Authorizer) (*server.Server, string, string, error) {
+	_, kubeServer := fakekube.NewServer()
+
+	//Features like the Apigee KVM only make sense against real infrastructure and are off by default
+	cfg := config.Default()
+	cfg.Kubernetes.Master = kubeServer.URL
+	cfg.Audit.Sink = config.AuditSinkEvent
+
+	return startServer(cfg, newAuthorizer)
+}
+
+//setupWithApigee initializes a server for testing with the Apigee KVM feature on, talking to a fake Apigee holding org
+func setupWithApigee(org string) (string, *fakeapigee.API, *fakekube.Cluster, error) {
+	cluster, kubeServer := fakekube.NewServer()
+
+	apigeeAPI := fakeapigee.NewAPI()
+	apigeeAPI.AddOrganization(org, true)
+	apigeeServer := httptest.NewTLSServer(apigeeAPI)
+
+	//The Apigee client always uses https with the default transport, every httptest TLS server shares the same certificate
+	http.DefaultTransport.(*http.Transport).TLSClientConfig = apigeeServer.Client().Transport.(*http.Transport).TLSClientConfig
+
+	cfg := config.Default()
+	cfg.Kubernetes.Master = kubeServer.URL
+	cfg.Audit.Sink = config.AuditSinkEvent
+	cfg.Features.ApigeeKVM = true
+	cfg.Apigee.APIHost = strings.TrimPrefix(apigeeServer.URL, "https://")
+	//Injected failures should surface right away
+	cfg.Apigee.Retries = 0
+
+	_, hostBase, _, err := startServer(cfg, func(server.KubeClient) auth.Authorizer {
+		return auth.AllowAll{}
+	})
+	return hostBase, apigeeAPI, cluster, err
+}
+
+//startServer starts enrober and a PTS host as local httptest servers
+func startServer(cfg *config.Config, newAuthorizer func(server.KubeClient) auth.Authorizer) (*server.Server, string, string, error) {
+	kubeClient, err := server.Init(cfg)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	ptsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pts, ok := testPTS[path.Base(r.URL.Path)]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(pts))
+	}))
+
+	auditSink, err := server.NewAuditSink(cfg.Audit, kubeClient)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	testServer := server.NewServer(kubeClient, newAuthorizer(kubeClient), cfg, auditSink)
+	enroberServer := httptest.NewServer(testServer.Router)
+
+	return testServer, enroberServer.URL, ptsServer.URL, nil
+}
+
+//request sends a request to the enrober server at hostBase on behalf of user, who userAuthenticator identifies by the X-User header
+//The user is also sent as a bearer token, which enrober passes on to Apigee
+//An empty user sends neither header
+func request(hostBase, user, method, url string, body string) *http.Response {
+	req, err := http.NewRequest(method, hostBase+url, strings.NewReader(body))
+	Expect(err).Should(BeNil())
+	if user != "" {
+		req.Header.Set("X-User", user)
+		req.Header.Set("Authorization", "Bearer "+user)
+	}
 
-	return testServer, hostBase, nil
+	resp, err := http.DefaultClient.Do(req)
+	Expect(err).Should(BeNil(), "Shouldn't get an error on %s. Error: %v", method, err)
+	return resp
 }
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/30x/enrober/pkg/helper"
+	"github.com/30x/enrober/pkg/logging"
+
+	"k8s.io/kubernetes/pkg/api"
+	k8sErrors "k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/util/intstr"
+)
+
+//servicePorts returns a service port for every container port in the pod template spec
+func servicePorts(pts api.PodTemplateSpec) []api.ServicePort {
+	ports := []api.ServicePort{}
+	seen := map[string]bool{}
+
+	for _, container := range pts.Spec.Containers {
+		for _, port := range container.Ports {
+			protocol := port.Protocol
+			if protocol == "" {
+				protocol = api.ProtocolTCP
+			}
+
+			//The same port can't be exposed twice
+			id := fmt.Sprintf("%s-%d", strings.ToLower(string(protocol)), port.ContainerPort)
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+
+			name := port.Name
+			if name == "" {
+				name = id
+			}
+
+			ports = append(ports, api.ServicePort{
+				Name:       name,
+				Protocol:   protocol,
+				Port:       port.ContainerPort,
+				TargetPort: intstr.FromInt(int(port.ContainerPort)),
+			})
+		}
+	}
+	return ports
+}
+
+//deploymentService builds the ClusterIP service for a deployment, selecting on its component label
+func deploymentService(deploymentName string, pts api.PodTemplateSpec) (*api.Service, *helper.APIError) {
+	ports := servicePorts(pts)
+	if len(ports) == 0 {
+		return nil, helper.NewAPIError(http.StatusBadRequest, helper.ErrCodeInvalidDeployment, "A service needs at least one container port in the pod template spec", nil)
+	}
+
+	return &api.Service{
+		ObjectMeta: api.ObjectMeta{
+			Name: deploymentName,
+			Labels: map[string]string{
+				"runtime":   "shipyard",
+				"component": pts.Labels["component"],
+			},
+		},
+		Spec: api.ServiceSpec{
+			Type:  api.ServiceTypeClusterIP,
+			Ports: ports,
+			Selector: map[string]string{
+				"component": pts.Labels["component"],
+			},
+		},
+	}, nil
+}
+
+//getDeploymentService returns the service enrober created for a deployment or nil if it doesn't have one
+func (server *Server) getDeploymentService(namespace string, deploymentName string) (*api.Service, error) {
+	service, err := server.client.GetService(namespace, deploymentName)
+	if err != nil {
+		if k8sErrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	//Leave services that weren't created by enrober alone
+	if service.Labels["runtime"] != "shipyard" {
+		return nil, nil
+	}
+	return service, nil
+}
+
+//syncedDeploymentService returns a deployment's service with its ports matching the given pod template spec
+//It is nil for deployments without a service, which are left alone
+//Nothing is written so the pod template spec can be checked before the deployment is updated
+func (server *Server) syncedDeploymentService(namespace string, deploymentName string, pts api.PodTemplateSpec) (*api.Service, *helper.APIError) {
+	service, err := server.getDeploymentService(namespace, deploymentName)
+	if err != nil {
+		return nil, kubeError(err, helper.ErrCodeDeploymentNotFound, "Error getting existing service")
+	}
+	if service == nil {
+		return nil, nil
+	}
+
+	newService, apiErr := deploymentService(deploymentName, pts)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	service.Spec.Ports = newService.Spec.Ports
+	service.Spec.Selector = newService.Spec.Selector
+	return service, nil
+}
+
+//updateDeploymentService writes a service returned by syncedDeploymentService once the deployment is updated
+//Services that don't match the deployment are fixed by updating it again
+func (server *Server) updateDeploymentService(logger *logging.Logger, namespace string, service *api.Service) *helper.APIError {
+	if service == nil {
+		return nil
+	}
+
+	_, err := server.client.UpdateService(namespace, service)
+	if err != nil {
+		return kubeError(err, helper.ErrCodeDeploymentNotFound, "Deployment updated but error updating its service")
+	}
+	logger.Infof("Updated Service: %s", service.GetName())
+	return nil
+}
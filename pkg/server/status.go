@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/30x/enrober/pkg/helper"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/apis/extensions"
+	"k8s.io/kubernetes/pkg/labels"
+)
+
+//maxRolloutWait caps how long a request can block waiting for a rollout
+const maxRolloutWait = 10 * time.Minute
+
+//rolloutPollInterval is how often the deployment is checked while waiting for a rollout
+var rolloutPollInterval = time.Second
+
+//failedWaitingReasons are container waiting reasons that won't fix themselves without a new rollout
+var failedWaitingReasons = map[string]bool{
+	"CrashLoopBackOff":           true,
+	"ErrImagePull":               true,
+	"ImagePullBackOff":           true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+}
+
+//parseWait reads the optional wait query parameter of a POST or PATCH
+func parseWait(r *http.Request) (time.Duration, *helper.APIError) {
+	waitParam := r.URL.Query().Get("wait")
+	if waitParam == "" {
+		return 0, nil
+	}
+
+	wait, err := time.ParseDuration(waitParam)
+	if err != nil || wait <= 0 || wait > maxRolloutWait {
+		errorMessage := fmt.Sprintf("Invalid wait value %s, expected a duration up to %s", waitParam, maxRolloutWait)
+		return 0, helper.NewAPIError(http.StatusBadRequest, helper.ErrCodeInvalidQueryParameter, errorMessage, err)
+	}
+	return wait, nil
+}
+
+//podReadiness summarizes the status of a single pod
+func podReadiness(pod api.Pod) podStatus {
+	status := podStatus{
+		Name:  pod.GetName(),
+		Phase: string(pod.Status.Phase),
+	}
+
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == api.PodReady {
+			status.Ready = condition.Status == api.ConditionTrue
+		}
+	}
+
+	for _, container := range pod.Status.ContainerStatuses {
+		status.Restarts += container.RestartCount
+		if container.State.Waiting != nil && container.State.Waiting.Reason != "" {
+			status.Reason = container.State.Waiting.Reason
+		}
+	}
+	if status.Reason == "" && pod.Status.Phase == api.PodFailed {
+		status.Reason = string(api.PodFailed)
+	}
+	return status
+}
+
+//rolloutStatus works out how far the rollout of a deployment's current revision has got
+//The deployment is complete once the controller has seen the latest spec and every replica is updated and available,
+//it has failed if a pod of the current revision is stuck in a state it won't recover from
+func (server *Server) rolloutStatus(namespace string, dep *extensions.Deployment) (*deploymentStatus, error) {
+	status := &deploymentStatus{
+		DeploymentName:      dep.GetName(),
+		Revision:            revisionOf(dep.ObjectMeta),
+		Generation:          dep.Generation,
+		ObservedGeneration:  dep.Status.ObservedGeneration,
+		Replicas:            dep.Spec.Replicas,
+		UpdatedReplicas:     dep.Status.UpdatedReplicas,
+		AvailableReplicas:   dep.Status.AvailableReplicas,
+		UnavailableReplicas: dep.Status.UnavailableReplicas,
+		Pods:                []podStatus{},
+	}
+
+	//Only pods of the current revision count towards a failure
+	replicaSets, err := server.revisionReplicaSets(namespace, dep)
+	if err != nil {
+		return nil, err
+	}
+	currentHash := ""
+	for _, rs := range replicaSets {
+		if revisionOf(rs.ObjectMeta) == status.Revision {
+			currentHash = rs.Labels[podTemplateHashLabel]
+		}
+	}
+
+	var selector labels.Selector
+	if dep.Spec.Selector != nil {
+		selector = labels.SelectorFromSet(labels.Set(dep.Spec.Selector.MatchLabels))
+	} else {
+		selector = labels.SelectorFromSet(labels.Set(dep.Spec.Template.Labels))
+	}
+	podList, err := server.client.ListPods(namespace, api.ListOptions{
+		LabelSelector: selector,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pod := range podList.Items {
+		readiness := podReadiness(pod)
+		status.Pods = append(status.Pods, readiness)
+
+		current := currentHash == "" || pod.Labels[podTemplateHashLabel] == currentHash
+		if current && (failedWaitingReasons[readiness.Reason] || readiness.Reason == string(api.PodFailed)) {
+			status.Failed = true
+			status.Reason = fmt.Sprintf("Pod %s is %s", readiness.Name, readiness.Reason)
+		}
+	}
+
+	status.Complete = !status.Failed &&
+		status.ObservedGeneration >= status.Generation &&
+		status.UpdatedReplicas == status.Replicas &&
+		status.AvailableReplicas >= status.Replicas &&
+		dep.Status.Replicas == status.UpdatedReplicas
+
+	return status, nil
+}
+
+//waitForRollout polls a deployment until its rollout completes, fails or the timeout is reached
+//It stops early once ctx is done, when the client goes away or the server shuts down
+func (server *Server) waitForRollout(ctx context.Context, namespace string, name string, timeout time.Duration) (*extensions.Deployment, *helper.APIError) {
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(rolloutPollInterval)
+	defer ticker.Stop()
+
+	for {
+		dep, err := server.client.GetDeployment(namespace, name)
+		if err != nil {
+			return nil, kubeError(err, helper.ErrCodeDeploymentNotFound, "Error getting deployment while waiting for rollout")
+		}
+
+		status, err := server.rolloutStatus(namespace, dep)
+		if err != nil {
+			return nil, kubeError(err, helper.ErrCodeDeploymentNotFound, "Error getting rollout status")
+		}
+
+		if status.Complete {
+			return dep, nil
+		}
+		if status.Failed {
+			errorMessage := fmt.Sprintf("Rollout of revision %d failed", status.Revision)
+			return dep, helper.NewAPIError(http.StatusUnprocessableEntity, helper.ErrCodeRolloutFailed, errorMessage, errors.New(status.Reason))
+		}
+		if time.Now().After(deadline) {
+			errorMessage := fmt.Sprintf("Rollout of revision %d didn't complete within %s", status.Revision, timeout)
+			details := fmt.Errorf("%d of %d replicas updated, %d available", status.UpdatedReplicas, status.Replicas, status.AvailableReplicas)
+			return dep, helper.NewAPIError(http.StatusGatewayTimeout, helper.ErrCodeRolloutTimeout, errorMessage, details)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			errorMessage := fmt.Sprintf("Stopped waiting for the rollout of revision %d", status.Revision)
+			return dep, helper.NewAPIError(http.StatusGatewayTimeout, helper.ErrCodeRolloutTimeout, errorMessage, ctx.Err())
+		}
+	}
+}
@@ -2,13 +2,27 @@ package server
 
 import (
 	"net/http"
+	"time"
+
+	"github.com/30x/enrober/pkg/apigee"
+	"github.com/30x/enrober/pkg/audit"
+	"github.com/30x/enrober/pkg/auth"
+	"github.com/30x/enrober/pkg/config"
+	"github.com/30x/enrober/pkg/helper"
 
 	"k8s.io/kubernetes/pkg/api"
 )
 
 //Server struct
 type Server struct {
-	Router http.Handler
+	Router     http.Handler
+	client     KubeClient
+	authorizer auth.Authorizer
+	config     *config.Config
+	apigee     *apigee.Client
+	audit      audit.Sink
+	readiness  *readiness
+	hosts      *hostIndex
 }
 
 type environmentPost struct {
@@ -26,27 +40,54 @@ type environmentRequest struct {
 }
 
 type environmentResponse struct {
-	Name          string   `json:"name"`
-	HostNames     []string `json:"hostNames,omitempty"`
-	PublicSecret  []byte   `json:"publicSecret"`
-	PrivateSecret []byte   `json:"privateSecret"`
+	Name          string              `json:"name"`
+	HostNames     []string            `json:"hostNames,omitempty"`
+	PublicSecret  []byte              `json:"publicSecret"`
+	PrivateSecret []byte              `json:"privateSecret,omitempty"`
+	Steps         []helper.StepResult `json:"steps,omitempty"`
+}
+
+type keyRotationPost struct {
+	Keys        []string `json:"keys,omitempty"`
+	GracePeriod string   `json:"gracePeriod,omitempty"`
+}
+
+type keyRotationResponse struct {
+	Name                 string     `json:"name"`
+	PublicSecret         []byte     `json:"publicSecret"`
+	PrivateSecret        []byte     `json:"privateSecret"`
+	Rotated              []string   `json:"rotated"`
+	PreviousKeysExpireAt *time.Time `json:"previousKeysExpireAt,omitempty"`
+}
+
+type environmentSummary struct {
+	Name            string   `json:"name"`
+	Organization    string   `json:"organization"`
+	Environment     string   `json:"environment"`
+	HostNames       []string `json:"hostNames"`
+	DeploymentCount int      `json:"deploymentCount"`
 }
 
 type deploymentPost struct {
-	DeploymentName string       `json:"deploymentName"`
-	PublicHosts    *string      `json:"publicHosts,omitempty"`
-	PrivateHosts   *string      `json:"privateHosts,omitempty"`
-	Replicas       *int32       `json:"replicas"`
-	PtsURL         string       `json:"ptsURL,omitempty"`
-	EnvVars        []api.EnvVar `json:"envVars,omitempty"`
+	DeploymentName   string                  `json:"deploymentName"`
+	PublicHosts      *string                 `json:"publicHosts,omitempty"`
+	PrivateHosts     *string                 `json:"privateHosts,omitempty"`
+	Replicas         *int32                  `json:"replicas"`
+	PtsURL           string                  `json:"ptsURL,omitempty"`
+	PTS              *api.PodTemplateSpec    `json:"pts,omitempty"`
+	EnvVars          []api.EnvVar            `json:"envVars,omitempty"`
+	ContainerEnvVars map[string][]api.EnvVar `json:"containerEnvVars,omitempty"`
+	CreateService    bool                    `json:"createService,omitempty"`
 }
 
 type deploymentPatch struct {
-	PublicHosts  *string      `json:"publicHosts,omitempty"`
-	PrivateHosts *string      `json:"privateHosts,omitempty"`
-	Replicas     *int32       `json:"replicas,omitempty"`
-	PtsURL       string       `json:"ptsURL"`
-	EnvVars      []api.EnvVar `json:"envVars,omitempty"`
+	PublicHosts      *string                 `json:"publicHosts,omitempty"`
+	PrivateHosts     *string                 `json:"privateHosts,omitempty"`
+	Replicas         *int32                  `json:"replicas,omitempty"`
+	PtsURL           string                  `json:"ptsURL,omitempty"`
+	PTS              *api.PodTemplateSpec    `json:"pts,omitempty"`
+	EnvVars          []api.EnvVar            `json:"envVars,omitempty"`
+	ContainerEnvVars map[string][]api.EnvVar `json:"containerEnvVars,omitempty"`
 }
 
 type deploymentResponse struct {
@@ -60,17 +101,49 @@ type deploymentResponse struct {
 	PodTemplateSpec *api.PodTemplateSpec `json:"podTemplateSpec"`
 }
 
-type apigeeKVMEntry struct {
-	Name  string `json:"name"`
-	Value string `json:"value"`
+type revisionContainer struct {
+	Name  string       `json:"name"`
+	Image string       `json:"image"`
+	Env   []api.EnvVar `json:"env,omitempty"`
 }
-type apigeeKVMBody struct {
-	Name  string           `json:"name"`
-	Entry []apigeeKVMEntry `json:"entry"`
+
+type deploymentRevision struct {
+	Revision     int64               `json:"revision"`
+	ReplicaSet   string              `json:"replicaSet"`
+	Current      bool                `json:"current"`
+	Replicas     int32               `json:"replicas"`
+	PublicHosts  string              `json:"publicHosts,omitempty"`
+	PrivateHosts string              `json:"privateHosts,omitempty"`
+	Containers   []revisionContainer `json:"containers"`
+}
+
+type deploymentRollbackPost struct {
+	Revision int64 `json:"revision"`
+}
+
+type podStatus struct {
+	Name     string `json:"name"`
+	Phase    string `json:"phase"`
+	Ready    bool   `json:"ready"`
+	Restarts int32  `json:"restarts"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+type deploymentStatus struct {
+	DeploymentName      string      `json:"deploymentName"`
+	Revision            int64       `json:"revision"`
+	Generation          int64       `json:"generation"`
+	ObservedGeneration  int64       `json:"observedGeneration"`
+	Replicas            int32       `json:"replicas"`
+	UpdatedReplicas     int32       `json:"updatedReplicas"`
+	AvailableReplicas   int32       `json:"availableReplicas"`
+	UnavailableReplicas int32       `json:"unavailableReplicas"`
+	Complete            bool        `json:"complete"`
+	Failed              bool        `json:"failed"`
+	Reason              string      `json:"reason,omitempty"`
+	Pods                []podStatus `json:"pods"`
 }
 
-type retryResponse struct {
-	Code     string   `json:"code"`
-	Message  string   `json:"message"`
-	Contexts []string `json:"contexts"`
+type roleBindings struct {
+	Bindings map[string]auth.Role `json:"bindings"`
 }